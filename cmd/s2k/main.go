@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
 	"runtime/debug"
+	"syscall"
 	"time"
 
 	cli "github.com/urfave/cli/v2"
@@ -94,6 +97,9 @@ func main() {
 				Flags: []cli.Flag{
 					&cli.BoolFlag{Name: "ignore-device-removals", Aliases: []string{"i"}, Usage: "do not respect books removals on the device"},
 					&cli.BoolFlag{Name: "dry-run", Usage: "do not perform any actual changes"},
+					&cli.DurationFlag{Name: "wait", Usage: "wait up to `DURATION` for other processes using the same device or history to finish"},
+					&cli.BoolFlag{Name: "offline", Usage: "plan sync against history without connected device, implies dry-run"},
+					&cli.StringSliceFlag{Name: "only", Usage: "synchronize only books matching `PATTERN` (path relative to 'source' or glob), could be repeated"},
 				},
 				Action: sync.RunMTP,
 				CustomHelpTemplate: fmt.Sprintf(`%s
@@ -102,6 +108,19 @@ Both could be specified in configuration file, otherwise 'source' is current wor
 Kindle device is expected to be connected at the time of operation.
 
 When 'ignore-device-removals' flag is set, books removed from the device are not removed from the local source.
+
+With 'offline' flag device does not have to be connected: books sent by the last sync are assumed to be on the device
+and sync is only planned (as with 'dry-run'). Changes made on the device since then, including removed books, cannot
+be known. Device is selected by 'device_serial' from configuration or by the only history for the target.
+
+With 'only' flag only selected books are scanned and synchronized, the rest of the source, history and device is left
+as it was. Pattern is a path of a book or folder relative to 'source' or a glob using the same syntax as routing rules.
+Content channels are skipped.
+
+Content channels from configuration (fonts, dictionaries, etc.) are synchronized in the same device session after books.
+
+Only one process could use device and history database at a time, unless 'wait' is specified sync fails immediately
+when they are busy. Locks left by crashed processes are removed automatically.
 `, cli.CommandHelpTemplate),
 			},
 			{
@@ -111,6 +130,9 @@ When 'ignore-device-removals' flag is set, books removed from the device are not
 				Flags: []cli.Flag{
 					&cli.BoolFlag{Name: "ignore-device-removals", Aliases: []string{"i"}, Usage: "do not respect books removals on the device"},
 					&cli.BoolFlag{Name: "dry-run", Usage: "do not perform any actual changes"},
+					&cli.DurationFlag{Name: "wait", Usage: "wait up to `DURATION` for other processes using the same device or history to finish"},
+					&cli.BoolFlag{Name: "offline", Usage: "plan sync against history without connected device, implies dry-run"},
+					&cli.StringSliceFlag{Name: "only", Usage: "synchronize only books matching `PATTERN` (path relative to 'source' or glob), could be repeated"},
 					&cli.BoolFlag{Name: "unmount", Aliases: []string{"u"}, Usage: "Attempts to prepare device for safe disconnect"},
 				},
 				Action: sync.RunUSB,
@@ -121,6 +143,19 @@ Kindle device is expected to be mounted at the time of operation.
 
 When 'ignore-device-removals' flag is set, books removed from the device are not removed from the local source.
 
+With 'offline' flag device does not have to be connected: books sent by the last sync are assumed to be on the device
+and sync is only planned (as with 'dry-run'). Changes made on the device since then, including removed books, cannot
+be known. Device is selected by 'device_serial' from configuration or by the only history for the target.
+
+With 'only' flag only selected books are scanned and synchronized, the rest of the source, history and device is left
+as it was. Pattern is a path of a book or folder relative to 'source' or a glob using the same syntax as routing rules.
+Content channels are skipped.
+
+Content channels from configuration (fonts, dictionaries, etc.) are synchronized in the same device session after books.
+
+Only one process could use device and history database at a time, unless 'wait' is specified sync fails immediately
+when they are busy. Locks left by crashed processes are removed automatically.
+
 With 'unmount' flag set, attempt is made to safely unmount storage after sync operation. Has no effect with 'dry-run'.
 Results of this flag are very OS dependent, for example on Windows it may fail if not all buffers have been yet written
 to storage and will fail if something still have device opened, on Linux it requires admin priviliges and will only
@@ -135,6 +170,9 @@ you could simply use 'eject' or 'udisksctl' commands.
 				Before: beforeCmdRun,
 				Flags: []cli.Flag{
 					&cli.BoolFlag{Name: "dry-run", Usage: "do not perform any actual changes"},
+					&cli.DurationFlag{Name: "wait", Usage: "wait up to `DURATION` for other processes using the same device or history to finish"},
+					&cli.BoolFlag{Name: "offline", Usage: "plan sync against history without connected device, implies dry-run"},
+					&cli.StringSliceFlag{Name: "only", Usage: "synchronize only books matching `PATTERN` (path relative to 'source' or glob), could be repeated"},
 				},
 				Action: sync.RunMail,
 				CustomHelpTemplate: fmt.Sprintf(`%s
@@ -142,18 +180,271 @@ Using Amazon e-mail delivery syncronizes books between 'source' local directory
 Both could be specified in configuration file, otherwise 'source' is current working directory and 'target' has no default.
 In this case have no way of accessing device content, so all decisions are based on local files and history.
 
+With 'offline' flag SMTP server is not contacted and sync is only planned (as with 'dry-run').
+
+With 'only' flag only selected books are scanned and synchronized, the rest of the source and history is left as it
+was. Pattern is a path of a book or folder relative to 'source' or a glob using the same syntax as routing rules.
+
 Proper configuration is expected for succesful operation, including working smtp server auth and authorized e-mail address
 (amazon account settings).
+
+Only one process could use device and history database at a time, unless 'wait' is specified sync fails immediately
+when they are busy. Locks left by crashed processes are removed automatically.
 `, cli.CommandHelpTemplate),
 			},
+			{
+				Name:   "send",
+				Usage:  "Sends books from outside of the source to the device or by e-mail",
+				Before: beforeCmdRun,
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "to", Value: "mtp", Usage: "deliver books using `PROTOCOL`: mtp, usb or mail"},
+					&cli.StringFlag{Name: "dir", DefaultText: "target", Usage: "device `FOLDER` to put books in"},
+					&cli.BoolFlag{Name: "manage", Usage: "record sent books in target history"},
+					&cli.BoolFlag{Name: "dry-run", Usage: "do not perform any actual changes"},
+					&cli.DurationFlag{Name: "wait", Usage: "wait up to `DURATION` for other processes using the same device or history to finish"},
+				},
+				Action:    sync.RunSend,
+				ArgsUsage: "FILE...",
+				CustomHelpTemplate: fmt.Sprintf(`%s
+FILE:
+    book to send, its extension has to be listed in 'book_extensions'
+
+Sends books which are not part of the library to the device (into 'target' folder unless 'dir' is specified) along
+with their page indexes (.apnx) and thumbnails, or by e-mail. Routing rules are not applied.
+
+Sent books are not known to sync and are left alone by it. With 'manage' flag they are recorded in history of the
+'target', so sync knows they are there and never removes them, "doctor --fix" forgets them once they are removed from
+the device.
+`, cli.CommandHelpTemplate),
+			},
+			{
+				Name:   "migrate-target",
+				Usage:  "Moves synchronized books on the device from one target to another together with their history",
+				Before: beforeCmdRun,
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "protocol", Aliases: []string{"p"}, Value: "mtp", Usage: "connection `PROTOCOL` used for sync: mtp, usb or mail"},
+					&cli.BoolFlag{Name: "dry-run", Usage: "do not perform any actual changes"},
+					&cli.DurationFlag{Name: "wait", Usage: "wait up to `DURATION` for other processes using the same device or history to finish"},
+				},
+				Action:    sync.RunMigrateTarget,
+				ArgsUsage: "OLD NEW",
+				CustomHelpTemplate: fmt.Sprintf(`%s
+OLD:
+    target books have been synchronized to
+NEW:
+    target books should be moved to
+
+Moves books (with their page indexes and reading data) synchronized to 'OLD' target on the device to 'NEW' target,
+keeping relative layout, and updates history, so the following sync with 'NEW' target has nothing to send.
+Books routed to other folders by routing rules are not affected. For e-mail delivery only history is updated.
+Kindle device is expected to be connected at the time of operation, do not forget to change 'target' in configuration.
+When migration is interrupted books already moved are recorded in history of 'OLD' target: run migration again to
+complete it or sync with 'OLD' target to move them back.
+`, cli.CommandHelpTemplate),
+			},
+			{
+				Name:   "migrate-device",
+				Usage:  "Continues history of replaced device with the new one and sends books to it",
+				Before: beforeCmdRun,
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "protocol", Aliases: []string{"p"}, Value: "mtp", Usage: "connection `PROTOCOL` used for sync: mtp or usb"},
+					&cli.StringFlag{Name: "from", Usage: "`SERIAL` number of the replaced device"},
+					&cli.StringFlag{Name: "to", Usage: "`SERIAL` number of the new device"},
+					&cli.BoolFlag{Name: "dry-run", Usage: "do not perform any actual changes"},
+					&cli.DurationFlag{Name: "wait", Usage: "wait up to `DURATION` for other processes using the same device or history to finish"},
+				},
+				Action: sync.RunMigrateDevice,
+				CustomHelpTemplate: fmt.Sprintf(`%s
+Clones history databases of the replaced device (for 'target' and content channels from configuration) under identity
+of the new device and sends all books known to history to the new device along with their thumbnails. Books are never
+removed locally during migration.
+
+New device is expected to be connected at the time of operation. When 'to' is not specified connected device is used,
+when 'from' is not specified the only other device with history for the same protocol is used.
+`, cli.CommandHelpTemplate),
+			},
+			{
+				Name:   "doctor",
+				Usage:  "Audits device state against local source and history, optionally fixing problems",
+				Before: beforeCmdRun,
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "protocol", Aliases: []string{"p"}, Value: "mtp", Usage: "connection `PROTOCOL` used for sync: mtp or usb"},
+					&cli.BoolFlag{Name: "fix", Usage: "clean up problems caused by artifacts sync has created"},
+					&cli.DurationFlag{Name: "wait", Usage: "wait up to `DURATION` for other processes using the same device or history to finish"},
+				},
+				Action: sync.RunDoctor,
+				CustomHelpTemplate: fmt.Sprintf(`%s
+Cross-checks local source, history and device for 'target' and content channels from configuration and reports:
+books on the device unknown to history, history entries for books gone both locally and from the device, page indexes
+(.apnx) and .sdr folders left without their books, thumbnails sent for books which are gone and empty or truncated
+device copies of synchronized books.
+
+With 'fix' flag only artifacts sync has created itself are removed: stale entries are dropped from history, broken
+device copies are removed (and sent again by the next sync). Books added to the device manually, reading data and
+thumbnails created by device are never touched. Kindle device is expected to be connected at the time of operation.
+`, cli.CommandHelpTemplate),
+			},
+			{
+				Name:   "verify",
+				Usage:  "Verifies content of books on the device against history, optionally repairing them",
+				Before: beforeCmdRun,
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "protocol", Aliases: []string{"p"}, Value: "mtp", Usage: "connection `PROTOCOL` used for sync: mtp or usb"},
+					&cli.BoolFlag{Name: "repair", Usage: "send corrupted or truncated books again"},
+					&cli.DurationFlag{Name: "wait", Usage: "wait up to `DURATION` for other processes using the same device or history to finish"},
+				},
+				Action: sync.RunVerify,
+				CustomHelpTemplate: fmt.Sprintf(`%s
+Reads every book sync has sent to the device (for 'target' and content channels from configuration) and compares it
+with content hash recorded in history, reporting missing, truncated, corrupted and unreadable books. Every book is
+read in full, so over MTP verification of a large library takes a while.
+
+With 'repair' flag broken books are sent again along with their page indexes (.apnx) and thumbnails, but only when
+local book is still the one which was sent. Kindle device is expected to be connected at the time of operation.
+`, cli.CommandHelpTemplate),
+			},
+			{
+				Name:   "thumbs",
+				Usage:  "Maintains thumbnails of books on the device",
+				Before: beforeCmdRun,
+				Subcommands: []*cli.Command{
+					{
+						Name:  "repair",
+						Usage: "Sends again thumbnails missing from the device",
+						Flags: []cli.Flag{
+							&cli.StringFlag{Name: "protocol", Aliases: []string{"p"}, Value: "mtp", Usage: "connection `PROTOCOL` used for sync: mtp or usb"},
+							&cli.BoolFlag{Name: "dry-run", Usage: "do not perform any actual changes"},
+							&cli.DurationFlag{Name: "wait", Usage: "wait up to `DURATION` for other processes using the same device or history to finish"},
+						},
+						Action: sync.RunThumbsRepair,
+						CustomHelpTemplate: fmt.Sprintf(`%s
+Kindle firmware purges its thumbnails folder from time to time and sideloaded books are left with blank covers. For
+every book sync has sent to the device (for 'target' and content channels from configuration) thumbnail is sent again
+when it is missing from the device or differs in size from the one extracted from the book. Sync does the same for
+books it finds in place. Kindle device is expected to be connected at the time of operation.
+`, cli.CommandHelpTemplate),
+					},
+				},
+			},
 			{
 				Name:   "history",
-				Usage:  "Lists details for local history files",
+				Usage:  "Inspects local history files",
 				Before: beforeCmdRun,
 				Action: history.RunList,
 				CustomHelpTemplate: fmt.Sprintf(`%s
-Lists local history databases specifying details for each of them.
+Without subcommand lists local history databases specifying details for each of them.
+`, cli.CommandHelpTemplate),
+				Subcommands: []*cli.Command{
+					{
+						Name:   "list",
+						Usage:  "Lists local history databases with protocol, device, source, destination and sync times",
+						Action: history.RunList,
+					},
+					{
+						Name:  "show",
+						Usage: "Lists files managed by history at the specified step",
+						Flags: []cli.Flag{
+							&cli.StringFlag{Name: "db", Usage: "history database `PATH` or name, by default the only database for configured target"},
+							&cli.Int64Flag{Name: "step", Usage: "history `STEP` to show, by default the last one"},
+						},
+						Action: history.RunShow,
+					},
+					{
+						Name:  "diff",
+						Usage: "Shows files added, removed or changed between history steps",
+						Flags: []cli.Flag{
+							&cli.StringFlag{Name: "db", Usage: "history database `PATH` or name, by default the only database for configured target"},
+						},
+						ArgsUsage: "[A B]",
+						Action:    history.RunDiff,
+						CustomHelpTemplate: fmt.Sprintf(`%s
+A, B:
+    history steps to compare, by default the last two
+`, cli.CommandHelpTemplate),
+					},
+					{
+						Name:  "stats",
+						Usage: "Reports reading statistics computed from history steps",
+						Flags: []cli.Flag{
+							&cli.StringFlag{Name: "db", Usage: "history database `PATH` or name, by default the only database for configured target"},
+							&cli.StringFlag{Name: "format", Aliases: []string{"f"}, Value: "table", Usage: "output `FORMAT`: table or json"},
+						},
+						Action: history.RunStats,
+						CustomHelpTemplate: fmt.Sprintf(`%s
+Replays all history steps and reports books added and removed per month, library growth, bytes transferred, average
+time book stays on the device before it is finished (history cannot tell why book was removed, every removal counts)
+and breakdowns by format and top level folder for the last step.
+`, cli.CommandHelpTemplate),
+					},
+					{
+						Name:  "prune",
+						Usage: "Removes old history steps and compacts database",
+						Flags: []cli.Flag{
+							&cli.StringFlag{Name: "db", Usage: "history database `PATH` or name, by default the only database for configured target"},
+							&cli.Int64Flag{Name: "keep", Usage: "keep `N` latest steps"},
+							&cli.StringFlag{Name: "older-than", Usage: "remove steps older than `AGE` (Go duration or number of days, like 90d)"},
+							&cli.BoolFlag{Name: "dry-run", Usage: "do not perform any actual changes"},
+							&cli.DurationFlag{Name: "wait", Usage: "wait up to `DURATION` for other processes using the same device or history to finish"},
+						},
+						Action: history.RunPrune,
+						CustomHelpTemplate: fmt.Sprintf(`%s
+Removes history steps which are beyond 'keep' latest steps and older than 'older-than' (when both are specified step
+has to satisfy both conditions). The latest step is always kept and its state is never affected.
+`, cli.CommandHelpTemplate),
+					},
+					{
+						Name:  "merge",
+						Usage: "Merges history of the same device and target diverged on another computer",
+						Flags: []cli.Flag{
+							&cli.StringFlag{Name: "db", Usage: "history database `PATH` or name, by default the only database for configured target"},
+							&cli.BoolFlag{Name: "dry-run", Usage: "do not perform any actual changes"},
+							&cli.DurationFlag{Name: "wait", Usage: "wait up to `DURATION` for other processes using the same device or history to finish"},
+						},
+						ArgsUsage: "OTHER",
+						Action:    history.RunMerge,
+						CustomHelpTemplate: fmt.Sprintf(`%s
+OTHER:
+    history database of the same device and target from another computer
+
+Interleaves steps of both histories by time, steps they share are taken once. Every step keeps its complete state,
+so the most recent sync from either computer defines what is considered to be on the device. Steps are renumbered.
 `, cli.CommandHelpTemplate),
+					},
+					{
+						Name:  "export",
+						Usage: "Exports history database in portable format",
+						Flags: []cli.Flag{
+							&cli.StringFlag{Name: "db", Usage: "history database `PATH` or name, by default the only database for configured target"},
+						},
+						ArgsUsage: "DESTINATION",
+						Action:    history.RunExport,
+						CustomHelpTemplate: fmt.Sprintf(`%s
+DESTINATION:
+    file name to write history to, if absent - STDOUT
+
+Produces versioned NDJSON dump with history identifiers, steps and per step changes.
+`, cli.CommandHelpTemplate),
+					},
+					{
+						Name:  "import",
+						Usage: "Recreates history database from portable format",
+						Flags: []cli.Flag{
+							&cli.StringFlag{Name: "source-root", Usage: "replace source of every history step with `PATH`"},
+							&cli.BoolFlag{Name: "overwrite", Usage: "replace existing history database"},
+							&cli.BoolFlag{Name: "dry-run", Usage: "do not perform any actual changes"},
+							&cli.DurationFlag{Name: "wait", Usage: "wait up to `DURATION` for other processes using the same device or history to finish"},
+						},
+						ArgsUsage: "SOURCE",
+						Action:    history.RunImport,
+						CustomHelpTemplate: fmt.Sprintf(`%s
+SOURCE:
+    file name produced by history export
+
+Database is only created when its target is configured (as 'target' or content channel) and source of the last
+step matches configured source. Use 'source-root' when library was moved, for example to another computer.
+`, cli.CommandHelpTemplate),
+					},
+				},
 			},
 			{
 				Name:   "dumpconfig",
@@ -175,7 +466,15 @@ To see actual "active" configuration use dry-run mode.
 		},
 	}
 
-	err := app.Run(os.Args)
+	// first interrupt cancels context and lets current operation stop cleanly, second one kills the program
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	err := app.RunContext(ctx, os.Args)
+	stop()
 	if err != nil {
 		if env.Log != nil {
 			env.Log.Error("Command ended with error", zap.Error(err))
@@ -194,10 +493,6 @@ To see actual "active" configuration use dry-run mode.
 			fmt.Fprintf(os.Stderr, "Error creating debug report: %v\n", err)
 		}
 	}
-	// cleanup temporary directory with thumbnails if any
-	if env.Cfg != nil && len(env.Cfg.Thumbnails.Dir) > 0 {
-		os.RemoveAll(env.Cfg.Thumbnails.Dir)
-	}
 	// cleanup temporary directory with mails if any
 	if env.Cfg != nil && len(env.Cfg.Smtp.Dir) > 0 {
 		os.RemoveAll(env.Cfg.Smtp.Dir)
@@ -0,0 +1,24 @@
+package common
+
+import (
+	"context"
+	"io"
+)
+
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+// ContextReader returns reader which fails with context error as soon as context is done, so long copy operations
+// could be interrupted between reads.
+func ContextReader(ctx context.Context, r io.Reader) io.Reader {
+	return &ctxReader{ctx: ctx, r: r}
+}
+
+func (cr *ctxReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
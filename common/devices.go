@@ -1,6 +1,7 @@
 package common
 
 import (
+	"fmt"
 	"maps"
 	"strings"
 )
@@ -30,6 +31,20 @@ func (p SupportedProtocols) String() string {
 	}
 }
 
+// ParseProtocol returns protocol by its command line name ("usb", "mtp" or "mail").
+func ParseProtocol(name string) (SupportedProtocols, error) {
+	switch strings.ToLower(name) {
+	case "usb":
+		return ProtocolUSB, nil
+	case "mtp":
+		return ProtocolMTP, nil
+	case "mail":
+		return ProtocolMail, nil
+	default:
+		return 0, fmt.Errorf("unknown protocol '%s'", name)
+	}
+}
+
 var supportedFileFormatsForEMail = map[string]string{
 	".DOC":  "application/msword",
 	".DOCX": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
@@ -82,3 +97,19 @@ func IsKindleDevice(protocol SupportedProtocols, vid, pid int) bool {
 	}
 	return false
 }
+
+// colorModels lists (lower case) parts of the model names of Kindles with color screen.
+var colorModels = []string{
+	"colorsoft",
+}
+
+// IsColorDevice reports whether Kindle with "model" name has color screen.
+func IsColorDevice(model string) bool {
+	model = strings.ToLower(model)
+	for _, m := range colorModels {
+		if strings.Contains(model, m) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,24 @@
+package common
+
+import "testing"
+
+func TestIsColorDevice(t *testing.T) {
+	cases := []struct {
+		model string
+		color bool
+	}{
+		{"Kindle Colorsoft", true},
+		{"Kindle Colorsoft Signature Edition", true},
+		{"KINDLE COLORSOFT", true},
+		{"kindle colorsoft kids", true},
+		{"Kindle Paperwhite", false},
+		{"Kindle Scribe", false},
+		{"Kindle", false},
+		{"", false},
+	}
+	for _, c := range cases {
+		if color := IsColorDevice(c.model); color != c.color {
+			t.Errorf("Model '%s': expected color %t, got %t", c.model, c.color, color)
+		}
+	}
+}
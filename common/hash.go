@@ -0,0 +1,18 @@
+package common
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+)
+
+// HashContent calculates content hash used as persistent ID of local books, so device copies could be compared with
+// them.
+func HashContent(ctx context.Context, r io.Reader, buf []byte) (string, error) {
+	h := sha256.New()
+	if _, err := io.CopyBuffer(h, ContextReader(ctx, r), buf); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
@@ -0,0 +1,179 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var ErrLocked = errors.New("locked by another process")
+
+// how often lock is checked while waiting for it
+const lockPollInterval = time.Second
+
+// Lock is advisory cross-process lock implemented as a file with owner information. Lock left by crashed process on
+// the same host is detected and recovered, lock from another host (shared history directory) has to be removed
+// manually. Within the process lock is reentrant, every acquisition has to be released.
+type Lock struct {
+	path string
+	log  *zap.Logger
+}
+
+var (
+	heldMu sync.Mutex
+	held   = make(map[string]int)
+)
+
+type lockOwner struct {
+	PID     int       `json:"pid"`
+	Host    string    `json:"host"`
+	Created time.Time `json:"created"`
+}
+
+// AcquireLock creates lock file "path", waiting up to "wait" for other process to release it.
+func AcquireLock(path string, wait time.Duration, log *zap.Logger) (*Lock, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("bad lock path: %w", err)
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		heldMu.Lock()
+		if held[path] > 0 {
+			held[path]++
+			heldMu.Unlock()
+			return &Lock{path: path, log: log}, nil
+		}
+		owner, err := tryLock(path)
+		if err == nil {
+			held[path] = 1
+			heldMu.Unlock()
+			log.Debug("Lock acquired", zap.String("path", path))
+			return &Lock{path: path, log: log}, nil
+		}
+		heldMu.Unlock()
+
+		if !errors.Is(err, ErrLocked) {
+			return nil, fmt.Errorf("unable to lock '%s': %w", path, err)
+		}
+		if owner.stale() {
+			log.Warn("Removing stale lock", zap.String("path", path), zap.Int("pid", owner.PID), zap.String("host", owner.Host), zap.Time("created", owner.Created))
+			if err := removeStaleLock(path, owner); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("'%s' is %w (pid %d on '%s' since %s)", path, ErrLocked, owner.PID, owner.Host, owner.Created.Local().Format(time.DateTime))
+		}
+		log.Debug("Waiting for lock", zap.String("path", path), zap.Int("pid", owner.PID), zap.String("host", owner.Host))
+		time.Sleep(min(lockPollInterval, time.Until(deadline)+time.Millisecond))
+	}
+}
+
+// removeStaleLock removes lock file "path" left by "owner". Several processes could find the same stale lock, so it is
+// moved aside first and checked again: lock created in the meantime by the process which has already recovered it is
+// put back instead of being removed.
+func removeStaleLock(path string, owner *lockOwner) error {
+	aside := fmt.Sprintf("%s.stale-%d-%d", path, os.Getpid(), time.Now().UnixNano())
+	if err := os.Rename(path, aside); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			// somebody else got to it first
+			return nil
+		}
+		return fmt.Errorf("unable to remove stale lock '%s': %w", path, err)
+	}
+	defer os.Remove(aside)
+
+	if current := readLockOwner(aside); !current.same(owner) {
+		if err := os.Link(aside, path); err != nil {
+			return fmt.Errorf("unable to restore lock '%s' of pid %d on '%s': %w", path, current.PID, current.Host, err)
+		}
+	}
+	return nil
+}
+
+// Release removes lock file when the last acquisition in the process is released, it is safe to call on nil lock.
+func (l *Lock) Release() {
+	if l == nil || len(l.path) == 0 {
+		return
+	}
+
+	heldMu.Lock()
+	defer heldMu.Unlock()
+
+	path := l.path
+	l.path = ""
+	if held[path]--; held[path] > 0 {
+		return
+	}
+	delete(held, path)
+	if err := os.Remove(path); err != nil {
+		l.log.Warn("Unable to release lock", zap.String("path", path), zap.Error(err))
+		return
+	}
+	l.log.Debug("Lock released", zap.String("path", path))
+}
+
+func tryLock(path string) (*lockOwner, error) {
+	host, _ := os.Hostname()
+	data, err := json.Marshal(lockOwner{PID: os.Getpid(), Host: host, Created: time.Now()})
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+		return readLockOwner(path), ErrLocked
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return nil, nil
+}
+
+// readLockOwner never fails, lock which cannot be read is reported with zero PID.
+func readLockOwner(path string) *lockOwner {
+	owner := &lockOwner{}
+	data, err := os.ReadFile(path)
+	if err != nil || json.Unmarshal(data, owner) != nil {
+		owner.PID = 0
+		if fi, err := os.Stat(path); err == nil {
+			owner.Created = fi.ModTime()
+		}
+	}
+	return owner
+}
+
+// maximum time unreadable lock could stay, owner may be in the middle of writing it.
+const lockWriteTimeout = 10 * time.Second
+
+func (o *lockOwner) same(other *lockOwner) bool {
+	return o.PID == other.PID && o.Host == other.Host && o.Created.Equal(other.Created)
+}
+
+func (o *lockOwner) stale() bool {
+	if o.PID == 0 {
+		return time.Since(o.Created) > lockWriteTimeout
+	}
+	if host, _ := os.Hostname(); host != o.Host {
+		return false
+	}
+	return !processAlive(o.PID)
+}
@@ -0,0 +1,102 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestLock(t *testing.T) {
+	log := zaptest.NewLogger(t, zaptest.Level(zap.ErrorLevel))
+	path := filepath.Join(t.TempDir(), "test.lock")
+
+	l1, err := AcquireLock(path, 0, log)
+	if err != nil {
+		t.Fatalf("Unable to acquire lock: %v", err)
+	}
+	// reentrant within the process
+	l2, err := AcquireLock(path, 0, log)
+	if err != nil {
+		t.Fatalf("Unable to acquire lock again: %v", err)
+	}
+	l1.Release()
+	l1.Release()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("Lock removed while still held: %v", err)
+	}
+	l2.Release()
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Lock was not removed: %v", err)
+	}
+
+	// held by another live process on the same host
+	host, _ := os.Hostname()
+	writeOwner := func(pid int, host string) {
+		data, _ := json.Marshal(lockOwner{PID: pid, Host: host, Created: time.Now()})
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatalf("Unable to write lock: %v", err)
+		}
+	}
+	writeOwner(os.Getppid(), host)
+	start := time.Now()
+	if _, err := AcquireLock(path, 1500*time.Millisecond, log); !errors.Is(err, ErrLocked) {
+		t.Fatalf("Lock held by another process acquired: %v", err)
+	}
+	if time.Since(start) < 1500*time.Millisecond {
+		t.Fatal("Lock was not waited for")
+	}
+
+	// another host, could not be checked
+	writeOwner(1, host+"-other")
+	if _, err := AcquireLock(path, 0, log); !errors.Is(err, ErrLocked) {
+		t.Fatalf("Lock held on another host acquired: %v", err)
+	}
+
+	// stale lock from dead process
+	writeOwner(1<<22+1, host)
+	l, err := AcquireLock(path, 0, log)
+	if err != nil {
+		t.Fatalf("Stale lock was not recovered: %v", err)
+	}
+	l.Release()
+}
+
+func TestRemoveStaleLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.lock")
+	host, _ := os.Hostname()
+	writeOwner := func(o *lockOwner) {
+		data, _ := json.Marshal(o)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatalf("Unable to write lock: %v", err)
+		}
+	}
+	stale := &lockOwner{PID: 1<<22 + 1, Host: host, Created: time.Now().Add(-time.Hour).Round(0)}
+	fresh := &lockOwner{PID: os.Getppid(), Host: host, Created: time.Now().Round(0)}
+
+	// another process has recovered stale lock we have seen and holds its own already
+	writeOwner(fresh)
+	if err := removeStaleLock(path, stale); err != nil {
+		t.Fatalf("Unable to check stale lock: %v", err)
+	}
+	if owner := readLockOwner(path); !owner.same(fresh) {
+		t.Fatalf("Lock of another process was not kept: %+v", owner)
+	}
+
+	writeOwner(stale)
+	if err := removeStaleLock(path, stale); err != nil {
+		t.Fatalf("Unable to remove stale lock: %v", err)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 0 {
+		t.Fatalf("Expected no files left, got %d", len(entries))
+	}
+	// already removed by somebody else
+	if err := removeStaleLock(path, stale); err != nil {
+		t.Fatalf("Missing stale lock reported: %v", err)
+	}
+}
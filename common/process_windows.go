@@ -0,0 +1,25 @@
+package common
+
+import (
+	"errors"
+
+	"golang.org/x/sys/windows"
+)
+
+// STILL_ACTIVE
+const stillActive = 259
+
+func processAlive(pid int) bool {
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		// process does not exist or belongs to somebody we cannot see, only the former is stale
+		return errors.Is(err, windows.ERROR_ACCESS_DENIED)
+	}
+	defer windows.CloseHandle(h)
+
+	var code uint32
+	if err := windows.GetExitCodeProcess(h, &code); err != nil {
+		return true
+	}
+	return code == stillActive
+}
@@ -0,0 +1,39 @@
+package common
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// RetryPolicy describes how operations failed with transient errors are repeated.
+type RetryPolicy struct {
+	Attempts int           `yaml:"attempts" validate:"gte=0"`  // additional attempts after the first failure, 0 disables retries
+	Delay    time.Duration `yaml:"delay" validate:"gte=0"`     // delay before the first retry, doubled for every next one
+	MaxDelay time.Duration `yaml:"max_delay" validate:"gte=0"` // upper limit for the delay, 0 means no limit
+}
+
+// Retry executes "op" until it succeeds, fails with an error "transient" does not recognize, attempts are exhausted or
+// context is done. Attempt number (starting with 0) is passed to "op", so it could restore the state before retrying.
+func Retry(ctx context.Context, policy RetryPolicy, op func(attempt int) error, transient func(error) bool, log *zap.Logger) error {
+	delay := policy.Delay
+	for attempt := 0; ; attempt++ {
+		err := op(attempt)
+		if err == nil || attempt >= policy.Attempts || ctx.Err() != nil || !transient(err) {
+			return err
+		}
+		log.Warn("Transient failure, retrying", zap.Int("attempt", attempt+1), zap.Int("attempts", policy.Attempts), zap.Duration("delay", delay), zap.Error(err))
+
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+		if delay *= 2; policy.MaxDelay > 0 && delay > policy.MaxDelay {
+			delay = policy.MaxDelay
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestRetry(t *testing.T) {
+	log := zaptest.NewLogger(t, zaptest.Level(zap.ErrorLevel))
+	errTransient, errFatal := errors.New("transient"), errors.New("fatal")
+	transient := func(err error) bool { return errors.Is(err, errTransient) }
+	policy := RetryPolicy{Attempts: 3, Delay: time.Millisecond, MaxDelay: 2 * time.Millisecond}
+
+	cases := []struct {
+		failures []error
+		calls    int
+		err      error
+	}{
+		{failures: nil, calls: 1},
+		{failures: []error{errTransient, errTransient}, calls: 3},
+		{failures: []error{errTransient, errTransient, errTransient, errTransient}, calls: 4, err: errTransient},
+		{failures: []error{errTransient, errFatal}, calls: 2, err: errFatal},
+	}
+	for i, c := range cases {
+		calls := 0
+		err := Retry(context.Background(), policy, func(attempt int) error {
+			if attempt != calls {
+				t.Fatalf("Case %d: unexpected attempt %d", i, attempt)
+			}
+			calls++
+			if attempt < len(c.failures) {
+				return c.failures[attempt]
+			}
+			return nil
+		}, transient, log)
+		if calls != c.calls || !errors.Is(err, c.err) || (c.err == nil && err != nil) {
+			t.Fatalf("Case %d: expected %d calls and %v, got %d and %v", i, c.calls, c.err, calls, err)
+		}
+	}
+
+	// no retries after context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := Retry(ctx, policy, func(int) error {
+		calls++
+		cancel()
+		return errTransient
+	}, transient, log)
+	if calls != 1 || !errors.Is(err, errTransient) {
+		t.Fatalf("Expected single call after cancel, got %d: %v", calls, err)
+	}
+}
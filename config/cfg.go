@@ -5,12 +5,15 @@ import (
 	_ "embed"
 	"fmt"
 	"os"
+	"path"
 	"strings"
 
 	validator "github.com/go-playground/validator/v10"
 	yaml "gopkg.in/yaml.v3"
 
 	"github.com/rupor-github/gencfg"
+
+	"sync2kindle/common"
 )
 
 //go:embed config.yaml.tmpl
@@ -21,7 +24,15 @@ type (
 		Width  int `yaml:"width" validate:"required,gt=0"`
 		Height int `yaml:"height" validate:"required,gt=0"`
 
-		Dir string `yaml:"-"` // internal use only
+		// processing for the device screen
+		Profile  string  `yaml:"profile,omitempty" validate:"omitempty,oneof=auto mono color"`
+		Gamma    float64 `yaml:"gamma,omitempty" validate:"gte=0"`
+		Contrast float64 `yaml:"contrast,omitempty" validate:"gte=-100,lte=100"`
+		Sharpen  float64 `yaml:"sharpen,omitempty" validate:"gte=0"`
+		Dither   bool    `yaml:"dither,omitempty"`
+
+		Dir   string `yaml:"-"` // internal use only
+		Color bool   `yaml:"-"` // internal use only (profile selected for connected device)
 	}
 
 	SmtpConfig struct {
@@ -34,26 +45,101 @@ type (
 		Dir string `yaml:"-"` // internal use only (storing mails for debugging)
 	}
 
+	// ChannelConfig describes additional content (fonts, dictionaries, etc.) synchronized in the same device
+	// session as books, each channel has its own device folder and history.
+	ChannelConfig struct {
+		Name       string   `yaml:"name" validate:"required"`
+		SourcePath string   `yaml:"source" sanitize:"path_abs,path_toslash" validate:"required,dir"`
+		TargetPath string   `yaml:"target" sanitize:"path_clean,path_toslash" validate:"required,filepath,excludes=@"`
+		Extensions []string `yaml:"extensions" validate:"required,gt=0"`
+		Removals   string   `yaml:"removals,omitempty" validate:"omitempty,oneof=sync keep-local keep-all"`
+		Thumbnails bool     `yaml:"thumbnails,omitempty"`
+	}
+
+	// RouteConfig sends books matching pattern (relative to "source") to a different folder on the device.
+	RouteConfig struct {
+		Pattern    string `yaml:"pattern" validate:"required"`
+		TargetPath string `yaml:"target" sanitize:"path_clean,path_toslash" validate:"required,filepath,excludes=@"`
+	}
+
+	// RetryConfig defines how transient failures are handled for each protocol.
+	RetryConfig struct {
+		MTP  common.RetryPolicy `yaml:"mtp"`
+		Mail common.RetryPolicy `yaml:"mail"`
+	}
+
 	Config struct {
 		SourcePath   string `yaml:"source" sanitize:"path_abs,path_toslash" validate:"required,dir"`
 		TargetPath   string `yaml:"target" sanitize:"path_clean,path_toslash" validate:"required,filepath|email"`
 		HistoryPath  string `yaml:"history" sanitize:"path_clean,assure_dir_exists" validate:"required,dir"`
 		DeviceSerial string `yaml:"device_serial" validate:"omitempty,gt=0"`
 
+		// stable identity of the books library, allows several computers to share history
+		Library       string `yaml:"library,omitempty"`
+		HistoryShared bool   `yaml:"history_shared,omitempty"`
+
 		BookExtensions  []string `yaml:"book_extensions" validate:"required,gt=0"`
 		ThumbExtensions []string `yaml:"thumb_extensions" validate:"required,gt=0"`
 
+		Routes   []RouteConfig   `yaml:"routes,omitempty" validate:"omitempty,dive"`
+		Channels []ChannelConfig `yaml:"channels,omitempty" validate:"omitempty,dive"`
+
 		Smtp       SmtpConfig       `yaml:"smtp"`
 		Thumbnails ThumbnailsConfig `yaml:"thumbnails"`
+		Retry      RetryConfig      `yaml:"retry"`
 
 		Logging   LoggingConfig  `yaml:"logging"`
 		Reporting ReporterConfig `yaml:"reporting"`
 	}
 )
 
+// Channel removal policies.
+const (
+	RemovalsSync      = "sync"       // removals are synchronized both ways (default)
+	RemovalsKeepLocal = "keep-local" // books removed from device are not removed locally
+	RemovalsKeepAll   = "keep-all"   // nothing is ever removed, neither locally nor on device
+)
+
+// Thumbnail profiles.
+const (
+	ProfileAuto  = "auto"  // selected by model of connected device (default)
+	ProfileMono  = "mono"  // grayscale e-ink screen
+	ProfileColor = "color" // color e-ink screen (Colorsoft)
+)
+
 func checks(sl validator.StructLevel) {
 	c := sl.Current().Interface().(Config)
 
+	for i, r := range c.Routes {
+		if _, err := path.Match(strings.Trim(r.Pattern, "/"), ""); err != nil {
+			sl.ReportError(r.Pattern, fmt.Sprintf("Routes[%d].Pattern", i), "", fmt.Sprintf("bad routing pattern: %v", err), "")
+		}
+		if overlappingPaths(r.TargetPath, common.ThumbnailFolder) {
+			sl.ReportError(r.TargetPath, fmt.Sprintf("Routes[%d].TargetPath", i), "", fmt.Sprintf("route target overlaps with \"%s\"", common.ThumbnailFolder), "")
+		}
+	}
+
+	names := make(map[string]bool, len(c.Channels))
+	for i, ch := range c.Channels {
+		if names[ch.Name] {
+			sl.ReportError(ch.Name, fmt.Sprintf("Channels[%d].Name", i), "", "channel names must be unique", "")
+		}
+		names[ch.Name] = true
+
+		targets := []string{common.ThumbnailFolder, c.TargetPath}
+		for _, r := range c.Routes {
+			targets = append(targets, r.TargetPath)
+		}
+		for _, other := range c.Channels[:i] {
+			targets = append(targets, other.TargetPath)
+		}
+		for _, t := range targets {
+			if overlappingPaths(ch.TargetPath, t) {
+				sl.ReportError(ch.TargetPath, fmt.Sprintf("Channels[%d].TargetPath", i), "", fmt.Sprintf("channel target overlaps with \"%s\"", t), "")
+			}
+		}
+	}
+
 	if strings.Contains(c.TargetPath, "@") {
 		if len(c.Smtp.From) == 0 {
 			sl.ReportError(c.Smtp.From, "From", "", "when \"target\" is e-mail sender address cannot be empty", "")
@@ -70,6 +156,30 @@ func checks(sl validator.StructLevel) {
 	}
 }
 
+// LibraryID returns identity of the library recorded in history: configured library name or absolute source path.
+func (c *Config) LibraryID() string {
+	if len(c.Library) > 0 {
+		return c.Library
+	}
+	return c.SourcePath
+}
+
+// ChannelLibraryID returns identity of the content channel recorded in history.
+func (c *Config) ChannelLibraryID(ch *ChannelConfig) string {
+	if len(c.Library) > 0 {
+		return c.Library + "/" + ch.Name
+	}
+	return ch.SourcePath
+}
+
+// overlappingPaths reports if one of the slash separated paths is the same or contains the other.
+func overlappingPaths(a, b string) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return false
+	}
+	return a == b || strings.HasPrefix(a, b+"/") || strings.HasPrefix(b, a+"/")
+}
+
 func unmarshalConfig(data []byte, cfg *Config, process bool) (*Config, error) {
 	// We want to use only fields we defined so we cannot use yaml.Unmarshal directly here
 	dec := yaml.NewDecoder(bytes.NewReader(data))
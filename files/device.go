@@ -1,7 +1,7 @@
 package files
 
 import (
-	"crypto/sha256"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -27,6 +27,7 @@ type Device struct {
 	roots []string
 	mount string
 	tmbs  *config.ThumbnailsConfig
+	keep  func(key string, dir bool) bool
 }
 
 func Connect(paths, mount string, tmbs *config.ThumbnailsConfig, log *zap.Logger) (*Device, error) {
@@ -49,6 +50,12 @@ func Connect(paths, mount string, tmbs *config.ThumbnailsConfig, log *zap.Logger
 	return d, nil
 }
 
+// Filter limits enumeration to objects "keep" accepts, rejected folders are not descended into. Key is the path
+// object would have in the enumeration result, enumeration roots are always accepted.
+func (d *Device) Filter(keep func(key string, dir bool) bool) {
+	d.keep = keep
+}
+
 // driver interface
 
 func (d *Device) Disconnect() {
@@ -63,7 +70,7 @@ func (d *Device) UniqueID() string {
 	return driverName
 }
 
-func (d *Device) MkDir(obj *objects.ObjectInfo) (err error) {
+func (d *Device) MkDir(ctx context.Context, obj *objects.ObjectInfo) (err error) {
 	if obj == nil {
 		panic("MkDir is called with nil object")
 	}
@@ -75,10 +82,13 @@ func (d *Device) MkDir(obj *objects.ObjectInfo) (err error) {
 		d.log.Debug("Executed action MkDir", zap.String("actor", d.Name()), zap.Any("object", obj), zap.Duration("elapsed", time.Since(start)), zap.Error(err))
 	}(time.Now())
 
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	return os.Mkdir(obj.FullPath, 0755)
 }
 
-func (d *Device) Remove(obj *objects.ObjectInfo) (err error) {
+func (d *Device) Remove(ctx context.Context, obj *objects.ObjectInfo) (err error) {
 	if obj == nil {
 		panic("Remove is called with nil object")
 	}
@@ -90,10 +100,13 @@ func (d *Device) Remove(obj *objects.ObjectInfo) (err error) {
 		d.log.Debug("Executed action Remove", zap.String("actor", d.Name()), zap.Any("object", obj), zap.Duration("elapsed", time.Since(start)), zap.Error(err))
 	}(time.Now())
 
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	return os.Remove(obj.FullPath)
 }
 
-func (d *Device) Copy(obj *objects.ObjectInfo) (err error) {
+func (d *Device) Copy(ctx context.Context, obj *objects.ObjectInfo) (err error) {
 	if obj == nil {
 		panic("Copy is called with nil object")
 	}
@@ -123,7 +136,7 @@ func (d *Device) Copy(obj *objects.ObjectInfo) (err error) {
 	}(to)
 
 	// our files are typically quite small...
-	written, err := io.CopyBuffer(to, from, make([]byte, 256*1024))
+	written, err := io.CopyBuffer(to, common.ContextReader(ctx, from), make([]byte, 256*1024))
 	if err != nil {
 		return fmt.Errorf("failed to copy file '%s' to '%s': %w", obj.ObjectName, obj.FullPath, err)
 	}
@@ -133,7 +146,31 @@ func (d *Device) Copy(obj *objects.ObjectInfo) (err error) {
 	return nil
 }
 
-func (d *Device) GetObjectInfos() (objects.ObjectInfoSet, error) {
+// Move renames file "obj.ObjectName" to "obj.FullPath", destination directory must exist.
+func (d *Device) Move(ctx context.Context, obj *objects.ObjectInfo) (err error) {
+	if obj == nil {
+		panic("Move is called with nil object")
+	}
+
+	if len(d.mount) > 0 {
+		obj.FullPath = path.Join(d.mount, obj.FullPath)
+		obj.ObjectName = path.Join(d.mount, obj.ObjectName)
+	}
+
+	defer func(start time.Time) {
+		d.log.Debug("Executed action Move", zap.String("actor", d.Name()), zap.Any("object", obj), zap.Duration("elapsed", time.Since(start)), zap.Error(err))
+	}(time.Now())
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if _, err := os.Stat(obj.FullPath); err == nil {
+		return fmt.Errorf("unable to move '%s', destination '%s' already exists", obj.ObjectName, obj.FullPath)
+	}
+	return os.Rename(obj.ObjectName, obj.FullPath)
+}
+
+func (d *Device) GetObjectInfos(ctx context.Context) (objects.ObjectInfoSet, error) {
 
 	// To get the same behavior for different connection protocols (MTP, USB, files) we will check source path here, rather than on Connect()
 	// NOTE: for source path it should never happen since configuration is validated
@@ -157,12 +194,21 @@ func (d *Device) GetObjectInfos() (objects.ObjectInfoSet, error) {
 				d.log.Warn("Skipping path during file enumeration", zap.String("path", next), zap.Error(err))
 				return nil
 			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
 			if info.Mode().IsRegular() || info.IsDir() {
 				key := next
 				if len(d.mount) > 0 {
 					key, _ = filepath.Rel(d.mount, next)
 				}
 				key = filepath.ToSlash(key)
+				if d.keep != nil && next != root && !d.keep(key, info.IsDir()) {
+					if info.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
 				if _, exists := oset[key]; exists {
 					d.log.Warn("Duplicate path during file enumeration, ignoring", zap.String("path", key))
 					return nil
@@ -176,15 +222,16 @@ func (d *Device) GetObjectInfos() (objects.ObjectInfoSet, error) {
 					File:     info.Mode().IsRegular(),
 				}
 				if !info.IsDir() {
-					hash, err := hashFileContent(next, buf)
+					hash, err := hashFileContent(ctx, next, buf)
 					if err != nil {
 						return fmt.Errorf("unable to hash file content for '%s': %w", next, err)
 					}
 					o.PersistentID = hash
 					if d.tmbs != nil {
-						// see if file needs thumb extraction
-						if name := thumbs.ExtractThumbnail(key, d.tmbs, d.log); len(name) > 0 {
-							o.ThumbName = name
+						if cover := thumbs.CoverOverride(next); len(cover) > 0 {
+							if o.CoverID, err = hashFileContent(ctx, cover, buf); err != nil {
+								return fmt.Errorf("unable to hash cover content for '%s': %w", cover, err)
+							}
 						}
 					}
 				}
@@ -198,18 +245,42 @@ func (d *Device) GetObjectInfos() (objects.ObjectInfoSet, error) {
 	return oset, nil
 }
 
+// Thumbnail returns name of the thumbnail for the book, extracting it into thumbnail cache when necessary. Empty name
+// is returned when book has no thumbnail or thumbnails were not requested.
+func (d *Device) Thumbnail(_ context.Context, obj *objects.ObjectInfo) string {
+	if obj == nil {
+		panic("Thumbnail is called with nil object")
+	}
+	if d.tmbs == nil || len(obj.PersistentID) == 0 {
+		return ""
+	}
+	name := obj.FullPath
+	if len(d.mount) > 0 {
+		name = path.Join(d.mount, name)
+	}
+	return thumbs.CachedThumbnail(name, thumbs.CacheKey(obj.PersistentID, obj.CoverID), d.tmbs, d.log)
+}
+
+// Hash calculates content hash of the file, result could be compared with object persistent ID.
+func (d *Device) Hash(ctx context.Context, obj *objects.ObjectInfo) (string, error) {
+	if obj == nil {
+		panic("Hash is called with nil object")
+	}
+	name := obj.FullPath
+	if len(d.mount) > 0 {
+		name = path.Join(d.mount, name)
+	}
+	return hashFileContent(ctx, name, make([]byte, 256*1024))
+}
+
 // implementation
 
-func hashFileContent(path string, buf []byte) (string, error) {
+func hashFileContent(ctx context.Context, path string, buf []byte) (string, error) {
 	file, err := os.Open(path)
 	if err != nil {
 		return "", err
 	}
 	defer file.Close()
 
-	h := sha256.New()
-	if _, err := io.CopyBuffer(h, file, buf); err != nil {
-		return "", err
-	}
-	return fmt.Sprintf("%x", h.Sum(nil)), nil
+	return common.HashContent(ctx, file, buf)
 }
@@ -1,7 +1,10 @@
 package history
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
@@ -32,8 +35,13 @@ func Connect(path string, log *zap.Logger) (*Connection, error) {
 		conn.Close()
 		return nil, err
 	}
+	if err := migrate(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
 	stepID, err := lastStep(conn)
 	if err != nil {
+		conn.Close()
 		return nil, fmt.Errorf("unable to read last history step value: %w", err)
 	}
 	return &Connection{log: log.Named(driverName), conn: conn, stepID: stepID}, nil
@@ -59,19 +67,19 @@ func (c *Connection) UniqueID() string {
 	return driverName
 }
 
-func (c *Connection) MkDir(obj *objects.ObjectInfo) error {
+func (c *Connection) MkDir(_ context.Context, obj *objects.ObjectInfo) error {
 	return ole.NewError(ole.E_NOTIMPL)
 }
 
-func (c *Connection) Remove(obj *objects.ObjectInfo) error {
+func (c *Connection) Remove(_ context.Context, obj *objects.ObjectInfo) error {
 	return ole.NewError(ole.E_NOTIMPL)
 }
 
-func (c *Connection) Copy(obj *objects.ObjectInfo) error {
+func (c *Connection) Copy(_ context.Context, obj *objects.ObjectInfo) error {
 	return ole.NewError(ole.E_NOTIMPL)
 }
 
-func (c *Connection) GetObjectInfos() (ois objects.ObjectInfoSet, err error) {
+func (c *Connection) GetObjectInfos(context.Context) (ois objects.ObjectInfoSet, err error) {
 	ois, err = stepObjectInfos(c.conn, c.stepID)
 	if err != nil {
 		return nil, err
@@ -88,6 +96,7 @@ func (c *Connection) StepID() int64 {
 	return c.stepID
 }
 
+// SaveObjectInfos records new step, only objects which are different from the previous step are stored.
 func (c *Connection) SaveObjectInfos(src, dst string, ois objects.ObjectInfoSet) (err error) {
 	var (
 		stepID = int64(-1)
@@ -105,23 +114,168 @@ func (c *Connection) SaveObjectInfos(src, dst string, ois objects.ObjectInfoSet)
 		endFn(&err)
 	}()
 
-	stepID, err = nextStep(c.conn, src, dst)
+	prev, err := stepObjectInfos(c.conn, c.stepID)
 	if err != nil {
 		return
 	}
 
+	stepID, err = nextStep(c.conn, src, dst, time.Now().UTC())
+	if err != nil {
+		return
+	}
+	err = saveChanges(c.conn, stepID, prev, ois)
+	return
+}
+
+// Recorded returns keys of all objects and names of all thumbnails ever recorded in history (unless pruned), so
+// leftovers of earlier syncs could be recognized as ours.
+func (c *Connection) Recorded() (keys, thumbs map[string]bool, err error) {
+	return recordedObjects(c.conn)
+}
+
+// Thumbnails returns names of thumbnails used by objects of the last step of history database at "path" and names of
+// all thumbnails ever recorded in it (unless pruned). Database is opened read only and is not migrated, history in
+// original format (full snapshot for every step) is read as is.
+func Thumbnails(path string) (used, recorded map[string]bool, err error) {
+	conn, legacy, err := openReadOnly(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+
+	ois, err := latestObjects(conn, legacy)
+	if err != nil {
+		return nil, nil, err
+	}
+	used = make(map[string]bool)
+	for _, o := range ois {
+		if len(o.ThumbName) > 0 {
+			used[o.ThumbName] = true
+		}
+	}
+	table := "versions"
+	if legacy {
+		table = "objects"
+	}
+	if _, recorded, err = recordedIn(conn, table); err != nil {
+		return nil, nil, err
+	}
+	return used, recorded, nil
+}
+
+// Latest returns objects of the last step of history database at "path". Database is opened read only and is not
+// migrated, history in original format is read as is.
+func Latest(path string) (objects.ObjectInfoSet, error) {
+	conn, legacy, err := openReadOnly(path)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return latestObjects(conn, legacy)
+}
+
+// openReadOnly opens history database without changing it, reporting whether it is still in original format.
+func openReadOnly(path string) (conn *sqlite.Conn, legacy bool, err error) {
+	conn, err = sqlite.OpenConn(path, sqlite.OpenReadOnly)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := checkSchema(conn); err != nil {
+		if !errors.Is(err, ErrOldSchema) {
+			conn.Close()
+			return nil, false, err
+		}
+		legacy = true
+	}
+	return conn, legacy, nil
+}
+
+func latestObjects(conn *sqlite.Conn, legacy bool) (objects.ObjectInfoSet, error) {
+	step, err := lastStep(conn)
+	if err != nil {
+		return nil, err
+	}
+	return readStep(conn, legacy, step)
+}
+
+// readStep reads objects of the step from history in either format.
+func readStep(conn *sqlite.Conn, legacy bool, stepID int64) (objects.ObjectInfoSet, error) {
+	if legacy {
+		return snapshotObjectInfos(conn, stepID)
+	}
+	return stepObjectInfos(conn, stepID)
+}
+
+func recordedObjects(conn *sqlite.Conn) (keys, thumbs map[string]bool, err error) {
+	return recordedIn(conn, "versions")
+}
+
+// recordedIn reads recorded objects from "table", which is "objects" for history in original format.
+func recordedIn(conn *sqlite.Conn, table string) (keys, thumbs map[string]bool, err error) {
+	keys, thumbs = make(map[string]bool), make(map[string]bool)
+	if err := sqlitex.Execute(conn, `SELECT DISTINCT path, ifnull(json_extract(data, '$.thumb_name'), '') FROM `+table+`;`, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			keys[stmt.ColumnText(0)] = true
+			if thumb := stmt.ColumnText(1); len(thumb) > 0 {
+				thumbs[thumb] = true
+			}
+			return nil
+		},
+	}); err != nil {
+		return nil, nil, fmt.Errorf("unable to read recorded objects from history: %w", err)
+	}
+	return keys, thumbs, nil
+}
+
+// SetShared selects database journal mode. WAL requires shared memory and cannot be used when database is accessed
+// from several computers over network share, rollback journal is used in this case.
+func (c *Connection) SetShared(shared bool) error {
+	mode := "WAL"
+	if shared {
+		mode = "DELETE"
+	}
+	if err := sqlitex.ExecuteTransient(c.conn, `PRAGMA journal_mode=`+mode+`;`, nil); err != nil {
+		return fmt.Errorf("unable to set history journal mode to %s: %w", mode, err)
+	}
+	return nil
+}
+
+// saveChanges records objects which differ from "prev" and removals of objects absent in "ois" as changes of the step.
+func saveChanges(conn *sqlite.Conn, stepID int64, prev, ois objects.ObjectInfoSet) error {
 	for k, v := range ois {
 		data, err := json.Marshal(v)
 		if err != nil {
 			return fmt.Errorf("unable to marshal object info for '%s': %w", k, err)
 		}
-		if err := sqlitex.Execute(c.conn, `INSERT INTO objects (step_id, path, data) VALUES (?, ?, json(?));`, &sqlitex.ExecOptions{
-			Args: []any{stepID, k, string(data)},
+		if p, exists := prev[k]; exists {
+			if pdata, err := json.Marshal(p); err == nil && bytes.Equal(pdata, data) {
+				continue
+			}
+		}
+		if err := sqlitex.Execute(conn, `INSERT INTO versions (path, hash, size, modified, data) VALUES (?, ?, ?, ?, json(?));`, &sqlitex.ExecOptions{
+			Args: []any{k, v.PersistentID, v.ObjSize, v.Modified.Unix(), string(data)},
 		}); err != nil {
 			return fmt.Errorf("unable to save object '%s' in history: %w", k, err)
 		}
+		if err := saveChange(conn, stepID, k, conn.LastInsertRowID()); err != nil {
+			return err
+		}
 	}
-	return
+	for k := range prev.Subtract(ois) {
+		if err := saveChange(conn, stepID, k, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func saveChange(conn *sqlite.Conn, stepID int64, path string, versionID any) error {
+	if err := sqlitex.Execute(conn, `INSERT INTO changes (step_id, path, version_id) VALUES (?, ?, ?);`, &sqlitex.ExecOptions{
+		Args: []any{stepID, path, versionID},
+	}); err != nil {
+		return fmt.Errorf("unable to save change for '%s' in history: %w", path, err)
+	}
+	return nil
 }
 
 func lastStep(conn *sqlite.Conn) (int64, error) {
@@ -137,9 +291,9 @@ func lastStep(conn *sqlite.Conn) (int64, error) {
 	return step, nil
 }
 
-func nextStep(conn *sqlite.Conn, src, dst string) (int64, error) {
+func nextStep(conn *sqlite.Conn, src, dst string, created time.Time) (int64, error) {
 	if err := sqlitex.Execute(conn, `INSERT INTO steps (source, destination, created) VALUES (?, ?, ?);`, &sqlitex.ExecOptions{
-		Args: []any{src, dst, time.Now().UTC().Unix()},
+		Args: []any{src, dst, created.Unix()},
 	}); err != nil {
 		return 0, fmt.Errorf("unable to create next history step: %w", err)
 	}
@@ -152,7 +306,11 @@ func stepObjectInfos(conn *sqlite.Conn, stepID int64) (objects.ObjectInfoSet, er
 	}
 
 	ois := objects.New()
-	if err := sqlitex.Execute(conn, `SELECT path, data FROM objects WHERE step_id=?;`, &sqlitex.ExecOptions{
+	// object state at the step is its latest change at or before the step
+	if err := sqlitex.Execute(conn, `SELECT c.path, v.data
+		FROM (SELECT path, max(step_id) AS step_id FROM changes WHERE step_id<=? GROUP BY path) l
+		JOIN changes c ON c.path=l.path AND c.step_id=l.step_id
+		JOIN versions v ON v.version_id=c.version_id;`, &sqlitex.ExecOptions{
 		Args: []any{stepID},
 		ResultFunc: func(stmt *sqlite.Stmt) error {
 			var oi objects.ObjectInfo
@@ -169,3 +327,22 @@ func stepObjectInfos(conn *sqlite.Conn, stepID int64) (objects.ObjectInfoSet, er
 	}
 	return ois, nil
 }
+
+// snapshotObjectInfos reads objects of the step from history in original format, where every step is a full snapshot.
+func snapshotObjectInfos(conn *sqlite.Conn, stepID int64) (objects.ObjectInfoSet, error) {
+	ois := objects.New()
+	if err := sqlitex.Execute(conn, `SELECT path, data FROM objects WHERE step_id=?;`, &sqlitex.ExecOptions{
+		Args: []any{stepID},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			var oi objects.ObjectInfo
+			if err := json.Unmarshal([]byte(stmt.ColumnText(1)), &oi); err != nil {
+				return fmt.Errorf("unable to unmarshal object info: %w", err)
+			}
+			ois[stmt.ColumnText(0)] = &oi
+			return nil
+		},
+	}); err != nil {
+		return nil, fmt.Errorf("unable to retrieve step '%d' objects from history: %w", stepID, err)
+	}
+	return ois, nil
+}
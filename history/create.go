@@ -2,6 +2,7 @@ package history
 
 import (
 	"context"
+	"errors"
 	"fmt"
 
 	"go.uber.org/zap"
@@ -30,9 +31,72 @@ var schema = sqlitemigration.Schema{
 			PRIMARY KEY("step_id","path"),
 			FOREIGN KEY(step_id) REFERENCES steps(step_id)
 		);`,
+		// full snapshots of every step are replaced with per step changes referencing object versions
+		`CREATE TABLE "versions" (
+			"version_id" INTEGER NOT NULL UNIQUE,
+			"path"       TEXT NOT NULL,
+			"hash"       TEXT,
+			"size"       INTEGER NOT NULL DEFAULT 0,
+			"modified"   INTEGER NOT NULL DEFAULT 0, -- Unix timestamp (epoch seconds)
+			"data"       JSON,
+			PRIMARY KEY("version_id" AUTOINCREMENT)
+		);
+		CREATE INDEX "versions_path_hash" ON "versions" ("path", "hash");
+		CREATE TABLE "changes" (
+			"step_id"    INTEGER NOT NULL,
+			"path"       TEXT NOT NULL,
+			"version_id" INTEGER, -- NULL when object is gone
+			PRIMARY KEY("step_id","path"),
+			FOREIGN KEY(step_id) REFERENCES steps(step_id),
+			FOREIGN KEY(version_id) REFERENCES versions(version_id)
+		);
+		CREATE INDEX "changes_path_step" ON "changes" ("path", "step_id");
+		CREATE INDEX "changes_version" ON "changes" ("version_id");
+		INSERT INTO versions (path, hash, size, modified, data)
+			SELECT path, json_extract(data, '$.persistent_id'), ifnull(json_extract(data, '$.size'), 0),
+				ifnull(unixepoch(json_extract(data, '$.modified')), 0), data
+			FROM objects GROUP BY path, data ORDER BY min(step_id);
+		INSERT INTO changes (step_id, path, version_id)
+			SELECT o.step_id, o.path, v.version_id
+			FROM objects o JOIN versions v ON v.path = o.path AND v.data = o.data
+			WHERE NOT EXISTS (SELECT 1 FROM objects p WHERE p.path = o.path AND p.data = o.data
+				AND p.step_id = (SELECT max(step_id) FROM steps WHERE step_id < o.step_id));
+		INSERT INTO changes (step_id, path, version_id)
+			SELECT s.step_id, p.path, NULL
+			FROM steps s JOIN objects p ON p.step_id = (SELECT max(step_id) FROM steps WHERE step_id < s.step_id)
+			WHERE NOT EXISTS (SELECT 1 FROM objects o WHERE o.step_id = s.step_id AND o.path = p.path);
+		DROP TABLE "objects";`,
 	},
 }
 
+// ErrOldSchema is returned when history database, which is opened read only, was not brought up to date yet.
+var ErrOldSchema = errors.New("history database schema is out of date")
+
+// checkSchema makes sure database schema is up to date without changing it.
+func checkSchema(conn *sqlite.Conn) error {
+	var version int
+	if err := sqlitex.ExecuteTransient(conn, `PRAGMA user_version;`, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			version = stmt.ColumnInt(0)
+			return nil
+		},
+	}); err != nil {
+		return fmt.Errorf("unable to read history database schema version: %w", err)
+	}
+	if version < len(schema.Migrations) {
+		return ErrOldSchema
+	}
+	return nil
+}
+
+// migrate brings database schema up to date, existing history is converted as necessary.
+func migrate(conn *sqlite.Conn) error {
+	if err := sqlitemigration.Migrate(context.TODO(), conn, schema); err != nil {
+		return fmt.Errorf("unable to migrate history database: %w", err)
+	}
+	return nil
+}
+
 func Create(path string, log *zap.Logger, values ...string) error {
 	log = log.Named("history-migration")
 
@@ -0,0 +1,164 @@
+package history
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitemigration"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// createSnapshotHistory creates history in original format - full snapshot for every step.
+func createSnapshotHistory(t *testing.T, dbpath string) {
+	t.Helper()
+	conn, err := sqlite.OpenConn(dbpath, sqlite.OpenReadWrite|sqlite.OpenCreate)
+	if err != nil {
+		t.Fatalf("Unable to create database: %v", err)
+	}
+	defer conn.Close()
+	if err := sqlitemigration.Migrate(context.TODO(), conn, sqlitemigration.Schema{Migrations: schema.Migrations[:3]}); err != nil {
+		t.Fatalf("Unable to prepare old schema: %v", err)
+	}
+	if err := sqlitex.ExecuteScript(conn, `
+		INSERT INTO steps (source, destination, created) VALUES ('/src', 'documents/mybooks', 1), ('/src', 'documents/mybooks', 2), ('/src', 'documents/mybooks', 3);
+		INSERT INTO objects (step_id, path, data) VALUES
+			(1, 'a.azw3', json('{"file_name":"a.azw3","persistent_id":"a","size":10,"modified":"2025-01-01T12:22:09.8542057-05:00","full_path":"/src/a.azw3","thumb_name":"ta.jpg"}')),
+			(1, 'b.azw3', json('{"file_name":"b.azw3","persistent_id":"b","size":20,"full_path":"/src/b.azw3"}')),
+			(2, 'a.azw3', json('{"file_name":"a.azw3","persistent_id":"a","size":10,"modified":"2025-01-01T12:22:09.8542057-05:00","full_path":"/src/a.azw3","thumb_name":"ta.jpg"}')),
+			(2, 'b.azw3', json('{"file_name":"b.azw3","persistent_id":"b2","size":25,"full_path":"/src/b.azw3","thumb_name":"tb.jpg"}')),
+			(3, 'b.azw3', json('{"file_name":"b.azw3","persistent_id":"b2","size":25,"full_path":"/src/b.azw3","thumb_name":"tb.jpg"}')),
+			(3, 'c.azw3', json('{"file_name":"c.azw3","persistent_id":"c","size":30,"full_path":"/src/c.azw3"}'));`, nil); err != nil {
+		t.Fatalf("Unable to fill old schema: %v", err)
+	}
+}
+
+func TestMigrateSnapshots(t *testing.T) {
+	log := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	dbpath := filepath.Join(t.TempDir(), "test.db")
+	createSnapshotHistory(t, dbpath)
+
+	hst, err := Connect(dbpath, log)
+	if err != nil {
+		t.Fatalf("Unable to open history: %v", err)
+	}
+	defer hst.Disconnect()
+
+	expected := []map[string]string{
+		{"a.azw3": "a", "b.azw3": "b"},
+		{"a.azw3": "a", "b.azw3": "b2"},
+		{"b.azw3": "b2", "c.azw3": "c"},
+	}
+	for i, exp := range expected {
+		ois, err := stepObjectInfos(hst.conn, int64(i+1))
+		if err != nil {
+			t.Fatalf("Unable to read step %d: %v", i+1, err)
+		}
+		if len(ois) != len(exp) {
+			t.Fatalf("Step %d: expected %d objects, got %d", i+1, len(exp), len(ois))
+		}
+		for k, v := range exp {
+			if ois[k] == nil || ois[k].PersistentID != v {
+				t.Fatalf("Step %d: unexpected object '%s': %+v", i+1, k, ois[k])
+			}
+		}
+	}
+
+	var versions, changes, modified int64
+	if err := sqlitex.Execute(hst.conn, `SELECT (SELECT count(*) FROM versions), (SELECT count(*) FROM changes), (SELECT modified FROM versions WHERE path='a.azw3');`, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			versions, changes, modified = stmt.ColumnInt64(0), stmt.ColumnInt64(1), stmt.ColumnInt64(2)
+			return nil
+		},
+	}); err != nil {
+		t.Fatalf("Unable to count rows: %v", err)
+	}
+	// a, b, b2, c versions; step 1: a, b; step 2: b2; step 3: a removed, c
+	if versions != 4 || changes != 5 {
+		t.Fatalf("Expected 4 versions and 5 changes, got %d and %d", versions, changes)
+	}
+	if modified != 1735752129 {
+		t.Fatalf("Unexpected modification time: %d", modified)
+	}
+}
+
+func TestOpenDatabaseOldSchema(t *testing.T) {
+	log := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	dir := t.TempDir()
+	dbpath := filepath.Join(dir, "test.db")
+	createSnapshotHistory(t, dbpath)
+
+	conn, legacy, err := openDatabase(dbpath)
+	if err != nil {
+		t.Fatalf("Unable to open database: %v", err)
+	}
+	defer conn.Close()
+	if !legacy {
+		t.Fatal("Expected old schema to be reported")
+	}
+	ois, err := readStep(conn, legacy, 3)
+	if err != nil {
+		t.Fatalf("Unable to read step: %v", err)
+	}
+	if len(ois) != 2 || ois["b.azw3"] == nil || ois["c.azw3"] == nil {
+		t.Fatalf("Unexpected step objects: %v", ois)
+	}
+	var old bytes.Buffer
+	if err := exportHistory(conn, legacy, &old); err != nil {
+		t.Fatalf("Unable to export history: %v", err)
+	}
+	// inspection does not upgrade database
+	if err := checkSchema(conn); !errors.Is(err, ErrOldSchema) {
+		t.Fatalf("Expected database to keep old schema, got %v", err)
+	}
+
+	// export of original format is the same as after upgrade
+	upgraded := filepath.Join(dir, "upgraded.db")
+	createSnapshotHistory(t, upgraded)
+	hst, err := Connect(upgraded, log)
+	if err != nil {
+		t.Fatalf("Unable to open history: %v", err)
+	}
+	defer hst.Disconnect()
+	var cur bytes.Buffer
+	if err := exportHistory(hst.conn, false, &cur); err != nil {
+		t.Fatalf("Unable to export history: %v", err)
+	}
+	if old.String() != cur.String() {
+		t.Fatalf("Export differs from upgraded history:\n%s\n%s", old.String(), cur.String())
+	}
+}
+
+func TestThumbnailsOldSchema(t *testing.T) {
+	dbpath := filepath.Join(t.TempDir(), "test.db")
+	createSnapshotHistory(t, dbpath)
+
+	used, recorded, err := Thumbnails(dbpath)
+	if err != nil {
+		t.Fatalf("Unable to read thumbnails: %v", err)
+	}
+	if len(used) != 1 || !used["tb.jpg"] {
+		t.Errorf("Expected only 'tb.jpg' to be used, got %v", used)
+	}
+	if len(recorded) != 2 || !recorded["ta.jpg"] || !recorded["tb.jpg"] {
+		t.Errorf("Expected 'ta.jpg' and 'tb.jpg' to be recorded, got %v", recorded)
+	}
+}
+
+func TestLatestOldSchema(t *testing.T) {
+	dbpath := filepath.Join(t.TempDir(), "test.db")
+	createSnapshotHistory(t, dbpath)
+
+	ois, err := Latest(dbpath)
+	if err != nil {
+		t.Fatalf("Unable to read history: %v", err)
+	}
+	if len(ois) != 2 || ois["b.azw3"] == nil || ois["b.azw3"].PersistentID != "b2" || ois["c.azw3"] == nil {
+		t.Fatalf("Unexpected objects of the last step: %v", ois)
+	}
+}
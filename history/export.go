@@ -0,0 +1,330 @@
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	cli "github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+
+	"sync2kindle/common"
+	"sync2kindle/config"
+	"sync2kindle/objects"
+	"sync2kindle/state"
+)
+
+// Portable history is NDJSON: header record followed by step records, each step record followed by its changes.
+const (
+	exportFormat  = "s2k-history"
+	exportVersion = 1
+)
+
+type exportRecord struct {
+	Type string `json:"type"` // "header", "step" or "change"
+
+	// header
+	Format      string   `json:"format,omitempty"`
+	Version     int      `json:"version,omitempty"`
+	Identifiers []string `json:"identifiers,omitempty"`
+
+	// step and change
+	StepID      int64  `json:"step_id,omitempty"`
+	Source      string `json:"source,omitempty"`
+	Destination string `json:"destination,omitempty"`
+	Created     int64  `json:"created,omitempty"`
+
+	// change, object is absent when it was removed
+	Path   string              `json:"path,omitempty"`
+	Object *objects.ObjectInfo `json:"object,omitempty"`
+}
+
+func RunExport(ctx *cli.Context) error {
+	env := ctx.Generic(state.FlagName).(*state.LocalEnv)
+	log := env.Log.Named(driverName)
+
+	dbpath, err := resolveDatabase(ctx.String("db"), env)
+	if err != nil {
+		return err
+	}
+	conn, legacy, err := openDatabase(dbpath)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	out := ctx.App.Writer
+	fname := ctx.Args().Get(0)
+	if len(fname) > 0 {
+		f, err := os.Create(fname)
+		if err != nil {
+			return fmt.Errorf("unable to create destination file '%s': %w", fname, err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	w := bufio.NewWriter(out)
+	if err := exportHistory(conn, legacy, w); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("unable to write history: %w", err)
+	}
+	log.Info("History exported", zap.String("path", dbpath), zap.String("file", fname))
+	return nil
+}
+
+func RunImport(ctx *cli.Context) error {
+	env := ctx.Generic(state.FlagName).(*state.LocalEnv)
+	log := env.Log.Named(driverName)
+
+	if ctx.Args().Len() != 1 {
+		return errors.New("file to import has to be specified")
+	}
+	fname := ctx.Args().Get(0)
+	f, err := os.Open(fname)
+	if err != nil {
+		return fmt.Errorf("unable to open file '%s': %w", fname, err)
+	}
+	defer f.Close()
+
+	sourceRoot := ctx.String("source-root")
+	if len(sourceRoot) > 0 {
+		if sourceRoot, err = filepath.Abs(sourceRoot); err != nil {
+			return fmt.Errorf("bad source root: %w", err)
+		}
+		sourceRoot = filepath.ToSlash(sourceRoot)
+	}
+
+	// build database next to its final location and only replace it when everything is good
+	tmp, err := os.CreateTemp(env.Cfg.HistoryPath, "import-*.tmp")
+	if err != nil {
+		return fmt.Errorf("unable to create temporary file: %w", err)
+	}
+	tmp.Close()
+	os.Remove(tmp.Name())
+	defer os.Remove(tmp.Name())
+
+	ids, source, err := importHistory(bufio.NewReader(f), tmp.Name(), sourceRoot, log)
+	if err != nil {
+		return err
+	}
+	if err := validateImport(ids, source, env.Cfg); err != nil {
+		return fmt.Errorf("imported history does not match configuration: %w", err)
+	}
+
+	protocol, err := protocolByName(ids[0])
+	if err != nil {
+		return err
+	}
+	dbpath := filepath.Join(env.Cfg.HistoryPath, GetName(protocol, ids[1], ids[2]))
+	lock, err := Lock(dbpath, ctx.Duration("wait"), log)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	if _, err := os.Stat(dbpath); err == nil && !ctx.Bool("overwrite") {
+		return fmt.Errorf("history database '%s' already exists", dbpath)
+	}
+	if ctx.Bool("dry-run") {
+		log.Info("History could be imported", zap.String("file", fname), zap.String("path", dbpath))
+		return nil
+	}
+	if err := os.Rename(tmp.Name(), dbpath); err != nil {
+		return fmt.Errorf("unable to create history database '%s': %w", dbpath, err)
+	}
+	log.Info("History imported", zap.String("file", fname), zap.String("path", dbpath))
+	return nil
+}
+
+func exportHistory(conn *sqlite.Conn, legacy bool, w io.Writer) error {
+	enc := json.NewEncoder(w)
+
+	ids, err := readIdentifiers(conn)
+	if err != nil {
+		return err
+	}
+	if err := enc.Encode(exportRecord{Type: "header", Format: exportFormat, Version: exportVersion, Identifiers: ids}); err != nil {
+		return fmt.Errorf("unable to write history header: %w", err)
+	}
+
+	var steps []exportRecord
+	if err := sqlitex.Execute(conn, `SELECT step_id, source, destination, created FROM steps ORDER BY step_id;`, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			steps = append(steps, exportRecord{Type: "step", StepID: stmt.ColumnInt64(0), Source: stmt.ColumnText(1), Destination: stmt.ColumnText(2), Created: stmt.ColumnInt64(3)})
+			return nil
+		},
+	}); err != nil {
+		return fmt.Errorf("unable to read history steps: %w", err)
+	}
+	for _, step := range steps {
+		if err := enc.Encode(step); err != nil {
+			return fmt.Errorf("unable to write history step: %w", err)
+		}
+		query := `SELECT c.path, v.data FROM changes c LEFT JOIN versions v ON v.version_id=c.version_id
+			WHERE c.step_id=?1 ORDER BY c.path;`
+		if legacy {
+			query = legacyChanges
+		}
+		if err := sqlitex.Execute(conn, query, &sqlitex.ExecOptions{
+			Args: []any{step.StepID},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				rec := exportRecord{Type: "change", StepID: step.StepID, Path: stmt.ColumnText(0)}
+				if stmt.ColumnType(1) != sqlite.TypeNull {
+					rec.Object = &objects.ObjectInfo{}
+					if err := json.Unmarshal([]byte(stmt.ColumnText(1)), rec.Object); err != nil {
+						return fmt.Errorf("unable to unmarshal object info: %w", err)
+					}
+				}
+				return enc.Encode(rec)
+			},
+		}); err != nil {
+			return fmt.Errorf("unable to export step '%d' changes: %w", step.StepID, err)
+		}
+	}
+	return nil
+}
+
+// legacyChanges computes changes of the step from history in original format, where every step is a full snapshot,
+// the same way schema migration does.
+const legacyChanges = `
+	SELECT o.path, o.data FROM objects o
+		WHERE o.step_id=?1 AND NOT EXISTS (SELECT 1 FROM objects p WHERE p.path=o.path AND p.data=o.data
+			AND p.step_id=(SELECT max(step_id) FROM steps WHERE step_id<?1))
+	UNION ALL
+	SELECT p.path, NULL FROM objects p
+		WHERE p.step_id=(SELECT max(step_id) FROM steps WHERE step_id<?1)
+			AND NOT EXISTS (SELECT 1 FROM objects o WHERE o.step_id=?1 AND o.path=p.path)
+	ORDER BY 1;`
+
+// importHistory creates history database at "dbpath" from portable dump, rewriting source root of every step to
+// "sourceRoot" when specified. It returns identifiers and source of the last step.
+func importHistory(r io.Reader, dbpath, sourceRoot string, log *zap.Logger) (ids []string, source string, err error) {
+	dec := json.NewDecoder(r)
+
+	var rec exportRecord
+	if err := dec.Decode(&rec); err != nil {
+		return nil, "", fmt.Errorf("unable to read history header: %w", err)
+	}
+	if rec.Type != "header" || rec.Format != exportFormat {
+		return nil, "", errors.New("not a history dump")
+	}
+	if rec.Version != exportVersion {
+		return nil, "", fmt.Errorf("unsupported history dump version %d", rec.Version)
+	}
+	if len(rec.Identifiers) != 3 {
+		return nil, "", fmt.Errorf("unexpected history identifiers: %v", rec.Identifiers)
+	}
+	ids = rec.Identifiers
+
+	if err := Create(dbpath, log, ids...); err != nil {
+		return nil, "", fmt.Errorf("unable to create history database: %w", err)
+	}
+	hst, err := Connect(dbpath, log)
+	if err != nil {
+		return nil, "", err
+	}
+	defer hst.Disconnect()
+	conn := hst.conn
+
+	endFn, err := sqlitex.ImmediateTransaction(conn)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to start transaction: %w", err)
+	}
+	defer endFn(&err)
+
+	var oldSource string
+	for {
+		rec = exportRecord{}
+		if err := dec.Decode(&rec); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, "", fmt.Errorf("unable to read history record: %w", err)
+		}
+		switch rec.Type {
+		case "step":
+			oldSource, source = rec.Source, rec.Source
+			if len(sourceRoot) > 0 {
+				source = sourceRoot
+			}
+			if err := sqlitex.Execute(conn, `INSERT INTO steps (step_id, source, destination, created) VALUES (?, ?, ?, ?);`, &sqlitex.ExecOptions{
+				Args: []any{rec.StepID, source, rec.Destination, rec.Created},
+			}); err != nil {
+				return nil, "", fmt.Errorf("unable to import step '%d': %w", rec.StepID, err)
+			}
+		case "change":
+			var versionID any
+			if rec.Object != nil {
+				if len(sourceRoot) > 0 {
+					if rel, ok := strings.CutPrefix(rec.Object.FullPath, oldSource+"/"); ok {
+						rec.Object.FullPath = path.Join(sourceRoot, rel)
+					}
+				}
+				data, err := json.Marshal(rec.Object)
+				if err != nil {
+					return nil, "", fmt.Errorf("unable to marshal object info for '%s': %w", rec.Path, err)
+				}
+				if err := sqlitex.Execute(conn, `INSERT INTO versions (path, hash, size, modified, data) VALUES (?, ?, ?, ?, json(?));`, &sqlitex.ExecOptions{
+					Args: []any{rec.Path, rec.Object.PersistentID, rec.Object.ObjSize, rec.Object.Modified.Unix(), string(data)},
+				}); err != nil {
+					return nil, "", fmt.Errorf("unable to import object '%s': %w", rec.Path, err)
+				}
+				versionID = conn.LastInsertRowID()
+			}
+			if err := saveChange(conn, rec.StepID, rec.Path, versionID); err != nil {
+				return nil, "", err
+			}
+		default:
+			return nil, "", fmt.Errorf("unexpected history record '%s'", rec.Type)
+		}
+	}
+	return ids, source, nil
+}
+
+// validateImport makes sure that imported history belongs to the main target or to one of the content channels and
+// its source matches configured source or library identity.
+func validateImport(ids []string, source string, cfg *config.Config) error {
+	if _, err := protocolByName(ids[0]); err != nil {
+		return err
+	}
+	target := ids[2]
+	expected := ""
+	switch {
+	case target == cfg.TargetPath:
+		expected = cfg.LibraryID()
+	default:
+		for _, ch := range cfg.Channels {
+			if ch.TargetPath == target {
+				expected = cfg.ChannelLibraryID(&ch)
+				break
+			}
+		}
+	}
+	if len(expected) == 0 {
+		return fmt.Errorf("target '%s' is not configured", target)
+	}
+	if len(source) > 0 && source != expected {
+		return fmt.Errorf("source '%s' is not '%s', use source root rewrite or name the library", source, expected)
+	}
+	return nil
+}
+
+func protocolByName(name string) (common.SupportedProtocols, error) {
+	for _, p := range []common.SupportedProtocols{common.ProtocolUSB, common.ProtocolMTP, common.ProtocolMail} {
+		if p.String() == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown protocol '%s' in history", name)
+}
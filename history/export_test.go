@@ -0,0 +1,92 @@
+package history
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+
+	"sync2kindle/config"
+	"sync2kindle/objects"
+)
+
+func TestExportImport(t *testing.T) {
+	log := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	dir := t.TempDir()
+	dbpath := filepath.Join(dir, "test.db")
+	if err := Create(dbpath, log, "MTP", "SN", "documents/mybooks"); err != nil {
+		t.Fatalf("Unable to create history: %v", err)
+	}
+	hst, err := Connect(dbpath, log)
+	if err != nil {
+		t.Fatalf("Unable to open history: %v", err)
+	}
+	defer hst.Disconnect()
+
+	sets := []objects.ObjectInfoSet{
+		{"a.azw3": {Name: "a.azw3", PersistentID: "a", FullPath: "/src/a.azw3"}, "b.azw3": {Name: "b.azw3", PersistentID: "b", FullPath: "/src/b.azw3"}},
+		{"b.azw3": {Name: "b.azw3", PersistentID: "b2", FullPath: "/src/b.azw3"}, "c/c.azw3": {Name: "c.azw3", PersistentID: "c", FullPath: "/src/c/c.azw3"}},
+	}
+	for _, ois := range sets {
+		if err := hst.SaveObjectInfos("/src", "documents/mybooks", ois); err != nil {
+			t.Fatalf("Unable to save step: %v", err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := exportHistory(hst.conn, false, &buf); err != nil {
+		t.Fatalf("Unable to export history: %v", err)
+	}
+	if lines := strings.Count(buf.String(), "\n"); lines != 1+2+2+3 {
+		t.Fatalf("Unexpected number of exported records: %d\n%s", lines, buf.String())
+	}
+
+	newpath := filepath.Join(dir, "new.db")
+	ids, source, err := importHistory(bytes.NewReader(buf.Bytes()), newpath, "/books", log)
+	if err != nil {
+		t.Fatalf("Unable to import history: %v", err)
+	}
+	if strings.Join(ids, ",") != "MTP,SN,documents/mybooks" || source != "/books" {
+		t.Fatalf("Unexpected import result: %v, %s", ids, source)
+	}
+
+	imported, err := Connect(newpath, log)
+	if err != nil {
+		t.Fatalf("Unable to open imported history: %v", err)
+	}
+	defer imported.Disconnect()
+	for step := range sets {
+		ois, err := stepObjectInfos(imported.conn, int64(step+1))
+		if err != nil {
+			t.Fatalf("Unable to read step %d: %v", step+1, err)
+		}
+		if len(ois) != len(sets[step]) {
+			t.Fatalf("Step %d has %d objects, expected %d", step+1, len(ois), len(sets[step]))
+		}
+		for k, v := range sets[step] {
+			o := ois.Find(k)
+			if o == nil || o.PersistentID != v.PersistentID || o.FullPath != "/books/"+k {
+				t.Fatalf("Step %d has unexpected object for '%s': %+v", step+1, k, o)
+			}
+		}
+	}
+
+	cfg := &config.Config{SourcePath: "/books", TargetPath: "documents/mybooks"}
+	if err := validateImport(ids, source, cfg); err != nil {
+		t.Fatalf("Valid import rejected: %v", err)
+	}
+	if err := validateImport(ids, "/src", cfg); err == nil {
+		t.Fatal("Import with wrong source accepted")
+	}
+	cfg.TargetPath = "documents/other"
+	if err := validateImport(ids, source, cfg); err == nil {
+		t.Fatal("Import with unknown target accepted")
+	}
+
+	if _, _, err := importHistory(strings.NewReader(`{"type":"header","format":"s2k-history","version":2}`), filepath.Join(dir, "bad.db"), "", log); err == nil {
+		t.Fatal("Unsupported version accepted")
+	}
+}
@@ -0,0 +1,185 @@
+package history
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	cli "github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+
+	"sync2kindle/objects"
+	"sync2kindle/state"
+)
+
+func RunMerge(ctx *cli.Context) error {
+	env := ctx.Generic(state.FlagName).(*state.LocalEnv)
+	log := env.Log.Named(driverName)
+
+	if ctx.Args().Len() != 1 {
+		return errors.New("history database to merge has to be specified")
+	}
+	other := ctx.Args().Get(0)
+
+	dbpath, err := resolveDatabase(ctx.String("db"), env)
+	if err != nil {
+		return err
+	}
+	if a, b := absPath(dbpath), absPath(other); a == b {
+		return fmt.Errorf("cannot merge history database '%s' with itself", dbpath)
+	}
+
+	for _, p := range []string{dbpath, other} {
+		lock, err := Lock(p, ctx.Duration("wait"), log)
+		if err != nil {
+			return err
+		}
+		defer lock.Release()
+	}
+
+	// build merged database next to the original and only replace it when everything is good
+	tmp, err := os.CreateTemp(filepath.Dir(dbpath), "merge-*.tmp")
+	if err != nil {
+		return fmt.Errorf("unable to create temporary file: %w", err)
+	}
+	tmp.Close()
+	os.Remove(tmp.Name())
+	defer os.Remove(tmp.Name())
+
+	added, err := merge(dbpath, other, tmp.Name(), log)
+	if err != nil {
+		return err
+	}
+	if added == 0 {
+		log.Info("Nothing to merge", zap.String("path", dbpath), zap.String("other", other))
+		return nil
+	}
+	if ctx.Bool("dry-run") {
+		log.Info("Steps would be merged", zap.String("path", dbpath), zap.String("other", other), zap.Int("steps", added))
+		return nil
+	}
+	if err := os.Rename(tmp.Name(), dbpath); err != nil {
+		return fmt.Errorf("unable to replace history database '%s': %w", dbpath, err)
+	}
+	log.Info("History merged", zap.String("path", dbpath), zap.String("other", other), zap.Int("steps", added))
+	return nil
+}
+
+// mergeStep is a step of one of the merged histories.
+type mergeStep struct {
+	conn        *sqlite.Conn
+	id          int64
+	source      string
+	destination string
+	created     int64
+}
+
+// merge interleaves steps of history databases "dbpath" and "other" by creation time and writes result into new
+// database "out". Steps present in both databases (history was copied before they diverged) are only taken once.
+// Every step keeps its complete state, so the most recent sync from either history defines the latest state. Returns
+// number of steps taken from "other".
+func merge(dbpath, other, out string, log *zap.Logger) (added int, err error) {
+	conn, err := upgradeDatabase(dbpath)
+	if err != nil {
+		return 0, fmt.Errorf("unable to open history database '%s': %w", dbpath, err)
+	}
+	defer conn.Close()
+	otherConn, err := upgradeDatabase(other)
+	if err != nil {
+		return 0, fmt.Errorf("unable to open history database '%s': %w", other, err)
+	}
+	defer otherConn.Close()
+
+	ids, err := readIdentifiers(conn)
+	if err != nil {
+		return 0, err
+	}
+	otherIDs, err := readIdentifiers(otherConn)
+	if err != nil {
+		return 0, err
+	}
+	if !slices.Equal(ids, otherIDs) {
+		return 0, fmt.Errorf("histories belong to different devices or targets: %v and %v", ids, otherIDs)
+	}
+
+	steps, err := readMergeSteps(conn)
+	if err != nil {
+		return 0, err
+	}
+	otherSteps, err := readMergeSteps(otherConn)
+	if err != nil {
+		return 0, err
+	}
+	for _, s := range otherSteps {
+		if !slices.ContainsFunc(steps, func(o mergeStep) bool {
+			return o.created == s.created && o.source == s.source && o.destination == s.destination
+		}) {
+			steps = append(steps, s)
+			added++
+		}
+	}
+	if added == 0 {
+		return 0, nil
+	}
+	slices.SortStableFunc(steps, func(a, b mergeStep) int {
+		return cmp.Compare(a.created, b.created)
+	})
+
+	if err := Create(out, log, ids...); err != nil {
+		return 0, fmt.Errorf("unable to create history database: %w", err)
+	}
+	hst, err := Connect(out, log)
+	if err != nil {
+		return 0, err
+	}
+	defer hst.Disconnect()
+
+	endFn, err := sqlitex.ImmediateTransaction(hst.conn)
+	if err != nil {
+		return 0, fmt.Errorf("unable to start transaction: %w", err)
+	}
+	defer endFn(&err)
+
+	prev := objects.New()
+	for _, s := range steps {
+		ois, err := stepObjectInfos(s.conn, s.id)
+		if err != nil {
+			return 0, err
+		}
+		stepID, err := nextStep(hst.conn, s.source, s.destination, time.Unix(s.created, 0))
+		if err != nil {
+			return 0, err
+		}
+		if err := saveChanges(hst.conn, stepID, prev, ois); err != nil {
+			return 0, err
+		}
+		prev = ois
+	}
+	return added, nil
+}
+
+func readMergeSteps(conn *sqlite.Conn) ([]mergeStep, error) {
+	var steps []mergeStep
+	if err := sqlitex.Execute(conn, `SELECT step_id, source, destination, created FROM steps ORDER BY step_id;`, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			steps = append(steps, mergeStep{conn: conn, id: stmt.ColumnInt64(0), source: stmt.ColumnText(1), destination: stmt.ColumnText(2), created: stmt.ColumnInt64(3)})
+			return nil
+		},
+	}); err != nil {
+		return nil, fmt.Errorf("unable to read history steps: %w", err)
+	}
+	return steps, nil
+}
+
+func absPath(p string) string {
+	if a, err := filepath.Abs(p); err == nil {
+		return a
+	}
+	return p
+}
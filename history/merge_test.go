@@ -0,0 +1,99 @@
+package history
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+	"zombiezen.com/go/sqlite/sqlitex"
+
+	"sync2kindle/objects"
+)
+
+func TestMerge(t *testing.T) {
+	log := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	dir := t.TempDir()
+
+	now := time.Now()
+	save := func(hst *Connection, created time.Time, ois objects.ObjectInfoSet) {
+		t.Helper()
+		if err := hst.SaveObjectInfos("family", "documents/mybooks", ois); err != nil {
+			t.Fatalf("Unable to save step: %v", err)
+		}
+		if err := sqlitex.Execute(hst.conn, `UPDATE steps SET created=? WHERE step_id=?;`, &sqlitex.ExecOptions{
+			Args: []any{created.Unix(), hst.StepID()},
+		}); err != nil {
+			t.Fatalf("Unable to update step: %v", err)
+		}
+	}
+	open := func(name string) *Connection {
+		t.Helper()
+		dbpath := filepath.Join(dir, name)
+		if err := Create(dbpath, log, "MTP", "SN", "documents/mybooks"); err != nil {
+			t.Fatalf("Unable to create history: %v", err)
+		}
+		hst, err := Connect(dbpath, log)
+		if err != nil {
+			t.Fatalf("Unable to open history: %v", err)
+		}
+		return hst
+	}
+
+	// both computers share the first sync, then sync in turns
+	a, b := open("a.db"), open("b.db")
+	common := objects.ObjectInfoSet{"a.azw3": {Name: "a.azw3", PersistentID: "a"}}
+	save(a, now.Add(-4*time.Hour), common)
+	save(b, now.Add(-4*time.Hour), common)
+	save(a, now.Add(-3*time.Hour), objects.ObjectInfoSet{"a.azw3": {Name: "a.azw3", PersistentID: "a"}, "b.azw3": {Name: "b.azw3", PersistentID: "b"}})
+	save(b, now.Add(-2*time.Hour), objects.ObjectInfoSet{"a.azw3": {Name: "a.azw3", PersistentID: "a"}, "b.azw3": {Name: "b.azw3", PersistentID: "b"}, "c.azw3": {Name: "c.azw3", PersistentID: "c"}})
+	save(a, now.Add(-1*time.Hour), objects.ObjectInfoSet{"b.azw3": {Name: "b.azw3", PersistentID: "b"}, "c.azw3": {Name: "c.azw3", PersistentID: "c"}})
+	a.Disconnect()
+	b.Disconnect()
+
+	out := filepath.Join(dir, "out.db")
+	added, err := merge(filepath.Join(dir, "a.db"), filepath.Join(dir, "b.db"), out, log)
+	if err != nil {
+		t.Fatalf("Unable to merge histories: %v", err)
+	}
+	if added != 1 {
+		t.Fatalf("Expected 1 step merged, got %d", added)
+	}
+
+	merged, err := Connect(out, log)
+	if err != nil {
+		t.Fatalf("Unable to open merged history: %v", err)
+	}
+	defer merged.Disconnect()
+	if merged.StepID() != 4 {
+		t.Fatalf("Expected 4 steps in merged history, got %d", merged.StepID())
+	}
+	for step, keys := range map[int64][]string{1: {"a.azw3"}, 2: {"a.azw3", "b.azw3"}, 3: {"a.azw3", "b.azw3", "c.azw3"}, 4: {"b.azw3", "c.azw3"}} {
+		ois, err := stepObjectInfos(merged.conn, step)
+		if err != nil {
+			t.Fatalf("Unable to read step %d: %v", step, err)
+		}
+		if len(ois) != len(keys) {
+			t.Fatalf("Step %d has %d objects, expected %d", step, len(ois), len(keys))
+		}
+		for _, k := range keys {
+			if ois.Find(k) == nil {
+				t.Fatalf("Step %d does not have '%s'", step, k)
+			}
+		}
+	}
+
+	// nothing new the second time
+	if added, err := merge(out, filepath.Join(dir, "b.db"), filepath.Join(dir, "again.db"), log); err != nil || added != 0 {
+		t.Fatalf("Unexpected second merge result: %d, %v", added, err)
+	}
+
+	other := filepath.Join(dir, "other.db")
+	if err := Create(other, log, "MTP", "SN2", "documents/mybooks"); err != nil {
+		t.Fatalf("Unable to create history: %v", err)
+	}
+	if _, err := merge(out, other, filepath.Join(dir, "bad.db"), log); err == nil {
+		t.Fatal("Histories of different devices merged")
+	}
+}
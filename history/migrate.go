@@ -0,0 +1,177 @@
+package history
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// MigrateTarget rewrites history database at "from" to reflect target folder change from "oldTarget" to "newTarget"
+// and renames it to "to". Device paths of books recorded under old target are moved under new one, paths relative to
+// the source are not affected.
+func MigrateTarget(from, to, oldTarget, newTarget string, log *zap.Logger) (err error) {
+	log = log.Named(driverName)
+
+	if _, err := os.Stat(to); err == nil {
+		return fmt.Errorf("history database '%s' already exists", to)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("history database '%s' cannot be accessed: %w", to, err)
+	}
+
+	conn, err := sqlite.OpenConn(from, sqlite.OpenReadWrite)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if e := conn.Close(); e != nil && err == nil {
+			err = fmt.Errorf("unable to close history database: %w", e)
+		}
+		if err == nil {
+			err = os.Rename(from, to)
+		}
+	}()
+
+	if err := migrate(conn); err != nil {
+		return err
+	}
+
+	endFn, err := sqlitex.ImmediateTransaction(conn)
+	if err != nil {
+		return fmt.Errorf("unable to start transaction: %w", err)
+	}
+	defer endFn(&err)
+
+	if err := sqlitex.Execute(conn, `UPDATE identifiers SET value=? WHERE value=?;`, &sqlitex.ExecOptions{
+		Args: []any{newTarget, oldTarget},
+	}); err != nil {
+		return fmt.Errorf("unable to update history identifiers: %w", err)
+	}
+	if conn.Changes() != 1 {
+		return fmt.Errorf("history database '%s' does not belong to target '%s'", from, oldTarget)
+	}
+	if err := sqlitex.Execute(conn, `UPDATE steps SET destination=? WHERE destination=?;`, &sqlitex.ExecOptions{
+		Args: []any{newTarget, oldTarget},
+	}); err != nil {
+		return fmt.Errorf("unable to update history steps: %w", err)
+	}
+	// NOTE: substr() counts characters, not bytes
+	prefix := oldTarget + "/"
+	n := utf8.RuneCountInString(prefix)
+	if err := sqlitex.Execute(conn, `UPDATE versions SET data=json_set(data, '$.device_path', ? || substr(json_extract(data, '$.device_path'), ?))
+		WHERE substr(json_extract(data, '$.device_path'), 1, ?)=?;`, &sqlitex.ExecOptions{
+		Args: []any{newTarget + "/", n + 1, n, prefix},
+	}); err != nil {
+		return fmt.Errorf("unable to update history objects: %w", err)
+	}
+	log.Debug("History object versions updated", zap.Int("count", conn.Changes()))
+	return nil
+}
+
+// RecordMoves records new step in history database at "path" with device paths of objects "moved" (history key to
+// new device path) updated, so books already moved by interrupted target migration are still known to history.
+func RecordMoves(path string, moved map[string]string, log *zap.Logger) (err error) {
+	c, err := Connect(path, log)
+	if err != nil {
+		return err
+	}
+	defer c.Disconnect()
+
+	var src, dst string
+	if err := sqlitex.Execute(c.conn, `SELECT source, destination FROM steps WHERE step_id=?;`, &sqlitex.ExecOptions{
+		Args: []any{c.stepID},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			src, dst = stmt.ColumnText(0), stmt.ColumnText(1)
+			return nil
+		},
+	}); err != nil {
+		return fmt.Errorf("unable to read last history step: %w", err)
+	}
+	ois, err := stepObjectInfos(c.conn, c.stepID)
+	if err != nil {
+		return err
+	}
+	for key, to := range moved {
+		if obj, exists := ois[key]; exists {
+			o := *obj
+			o.DevicePath = to
+			ois[key] = &o
+		}
+	}
+	if err := c.SaveObjectInfos(src, dst, ois); err != nil {
+		return err
+	}
+	log.Debug("Moved objects recorded", zap.Int("count", len(moved)), zap.Int64("stepID", c.stepID))
+	return nil
+}
+
+// Identifiers returns values history database at "path" was created with: protocol, device ID and target.
+func Identifiers(path string) ([]string, error) {
+	conn, err := sqlite.OpenConn(path, sqlite.OpenReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return readIdentifiers(conn)
+}
+
+// CloneForDevice copies history database at "from" to "to" replacing device ID "oldID" with "newID", so history
+// could be continued with a different device.
+func CloneForDevice(from, to, oldID, newID string, log *zap.Logger) (err error) {
+	log = log.Named(driverName)
+
+	if _, err := os.Stat(to); err == nil {
+		return fmt.Errorf("history database '%s' already exists", to)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("history database '%s' cannot be accessed: %w", to, err)
+	}
+
+	src, err := sqlite.OpenConn(from, sqlite.OpenReadOnly)
+	if err != nil {
+		return err
+	}
+	err = sqlitex.Execute(src, `VACUUM INTO ?;`, &sqlitex.ExecOptions{Args: []any{to}})
+	src.Close()
+	if err != nil {
+		return fmt.Errorf("unable to copy history database: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(to)
+		}
+	}()
+
+	conn, err := sqlite.OpenConn(to, sqlite.OpenReadWrite)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := sqlitex.Execute(conn, `UPDATE identifiers SET value=? WHERE value=?;`, &sqlitex.ExecOptions{
+		Args: []any{newID, oldID},
+	}); err != nil {
+		return fmt.Errorf("unable to update history identifiers: %w", err)
+	}
+	if conn.Changes() != 1 {
+		return fmt.Errorf("history database '%s' does not belong to device '%s'", from, oldID)
+	}
+	log.Debug("History cloned", zap.String("from", from), zap.String("to", to))
+	return nil
+}
+
+func readIdentifiers(conn *sqlite.Conn) ([]string, error) {
+	var values []string
+	if err := sqlitex.Execute(conn, `SELECT value FROM identifiers ORDER BY rowid;`, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			values = append(values, stmt.ColumnText(0))
+			return nil
+		},
+	}); err != nil {
+		return nil, fmt.Errorf("unable to read history identifiers: %w", err)
+	}
+	return values, nil
+}
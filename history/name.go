@@ -4,6 +4,9 @@ import (
 	"crypto/sha256"
 	"fmt"
 	"io"
+	"time"
+
+	"go.uber.org/zap"
 
 	"sync2kindle/common"
 )
@@ -16,3 +19,8 @@ func GetName(protocol common.SupportedProtocols, ids ...string) string {
 	_, _ = io.WriteString(h, protocol.String())
 	return fmt.Sprintf("%x.db", h.Sum(nil))
 }
+
+// Lock prevents other processes from using history database "path" while it is held.
+func Lock(path string, wait time.Duration, log *zap.Logger) (*common.Lock, error) {
+	return common.AcquireLock(path+".lock", wait, log)
+}
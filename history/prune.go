@@ -0,0 +1,156 @@
+package history
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	cli "github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+
+	"sync2kindle/state"
+)
+
+func RunPrune(ctx *cli.Context) error {
+	env := ctx.Generic(state.FlagName).(*state.LocalEnv)
+	log := env.Log.Named(driverName)
+
+	if !ctx.IsSet("keep") && !ctx.IsSet("older-than") {
+		return fmt.Errorf("either 'keep' or 'older-than' has to be specified")
+	}
+	keep := ctx.Int64("keep")
+	if ctx.IsSet("keep") && keep < 1 {
+		return fmt.Errorf("at least one step has to be kept")
+	}
+	var cutoff time.Time
+	if ctx.IsSet("older-than") {
+		age, err := parseAge(ctx.String("older-than"))
+		if err != nil {
+			return err
+		}
+		cutoff = time.Now().Add(-age)
+	}
+
+	dbpath, err := resolveDatabase(ctx.String("db"), env)
+	if err != nil {
+		return err
+	}
+	lock, err := Lock(dbpath, ctx.Duration("wait"), log)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	conn, err := upgradeDatabase(dbpath)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	base, err := pruneBase(conn, keep, cutoff)
+	if err != nil {
+		return err
+	}
+	if base == 0 {
+		log.Info("Nothing to prune", zap.String("path", dbpath))
+		return nil
+	}
+	if ctx.Bool("dry-run") {
+		log.Info("Steps would be pruned", zap.String("path", dbpath), zap.Int64("before step", base))
+		return nil
+	}
+	if err := prune(conn, base); err != nil {
+		return err
+	}
+	log.Info("Steps pruned", zap.String("path", dbpath), zap.Int64("before step", base))
+	return nil
+}
+
+// parseAge understands Go durations and number of days ("30d").
+func parseAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("bad age '%s'", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("bad age '%s': %w", s, err)
+	}
+	return d, nil
+}
+
+// pruneBase returns the oldest step to keep or 0 if there is nothing to prune. Step is removed only when it is
+// beyond "keep" latest steps (if set) and older than "cutoff" (if set), the last step is always kept.
+func pruneBase(conn *sqlite.Conn, keep int64, cutoff time.Time) (int64, error) {
+	var (
+		steps   []int64
+		created []time.Time
+	)
+	if err := sqlitex.Execute(conn, `SELECT step_id, created FROM steps ORDER BY step_id;`, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			steps = append(steps, stmt.ColumnInt64(0))
+			created = append(created, time.Unix(stmt.ColumnInt64(1), 0))
+			return nil
+		},
+	}); err != nil {
+		return 0, fmt.Errorf("unable to read history steps: %w", err)
+	}
+
+	base := len(steps) - 1 // index of the oldest step to keep
+	if base < 1 {
+		return 0, nil
+	}
+	if keep > 0 && int64(len(steps))-keep < int64(base) {
+		base = max(0, len(steps)-int(keep))
+	}
+	if !cutoff.IsZero() {
+		for i := 0; i < base; i++ {
+			if !created[i].Before(cutoff) {
+				base = i
+				break
+			}
+		}
+	}
+	if base == 0 {
+		return 0, nil
+	}
+	return steps[base], nil
+}
+
+// prune removes all steps before "base" step, making state of "base" self contained, and compacts the database.
+func prune(conn *sqlite.Conn, base int64) (err error) {
+	endFn, err := sqlitex.ImmediateTransaction(conn)
+	if err != nil {
+		return fmt.Errorf("unable to start transaction: %w", err)
+	}
+	if err := sqlitex.ExecuteScript(conn, `
+		CREATE TEMP TABLE "base" AS
+			SELECT c.path, c.version_id
+			FROM (SELECT path, max(step_id) AS step_id FROM changes WHERE step_id<=$base GROUP BY path) l
+			JOIN changes c ON c.path=l.path AND c.step_id=l.step_id
+			WHERE c.version_id IS NOT NULL;
+		DELETE FROM changes WHERE step_id<=$base;
+		INSERT INTO changes (step_id, path, version_id) SELECT $base, path, version_id FROM temp.base;
+		DROP TABLE temp.base;
+		DELETE FROM steps WHERE step_id<$base;
+		DELETE FROM versions WHERE version_id NOT IN (SELECT version_id FROM changes WHERE version_id IS NOT NULL);`,
+		&sqlitex.ExecOptions{Named: map[string]any{"$base": base}}); err != nil {
+		err = fmt.Errorf("unable to prune history: %w", err)
+		endFn(&err)
+		return err
+	}
+	endFn(&err)
+	if err != nil {
+		return fmt.Errorf("unable to prune history: %w", err)
+	}
+	if err := sqlitex.ExecuteTransient(conn, `VACUUM;`, nil); err != nil {
+		return fmt.Errorf("unable to compact history: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package history
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+
+	"sync2kindle/objects"
+)
+
+func TestPrune(t *testing.T) {
+	log := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	dbpath := filepath.Join(t.TempDir(), "test.db")
+	if err := Create(dbpath, log, "MTP", "SN", "documents/mybooks"); err != nil {
+		t.Fatalf("Unable to create history: %v", err)
+	}
+	hst, err := Connect(dbpath, log)
+	if err != nil {
+		t.Fatalf("Unable to open history: %v", err)
+	}
+	defer hst.Disconnect()
+
+	sets := []objects.ObjectInfoSet{
+		{"a.azw3": {Name: "a.azw3", PersistentID: "a"}, "b.azw3": {Name: "b.azw3", PersistentID: "b"}},
+		{"a.azw3": {Name: "a.azw3", PersistentID: "a"}, "b.azw3": {Name: "b.azw3", PersistentID: "b2"}},
+		{"b.azw3": {Name: "b.azw3", PersistentID: "b2"}, "c.azw3": {Name: "c.azw3", PersistentID: "c"}},
+		{"b.azw3": {Name: "b.azw3", PersistentID: "b2"}, "c.azw3": {Name: "c.azw3", PersistentID: "c"}, "d.azw3": {Name: "d.azw3", PersistentID: "d"}},
+	}
+	now := time.Now()
+	for i, ois := range sets {
+		if err := hst.SaveObjectInfos("/src", "documents/mybooks", ois); err != nil {
+			t.Fatalf("Unable to save step: %v", err)
+		}
+		// steps are 10 days apart, the last one is today
+		if err := sqlitex.Execute(hst.conn, `UPDATE steps SET created=? WHERE step_id=?;`, &sqlitex.ExecOptions{
+			Args: []any{now.Add(-time.Duration(len(sets)-1-i) * 240 * time.Hour).Unix(), hst.StepID()},
+		}); err != nil {
+			t.Fatalf("Unable to update step: %v", err)
+		}
+	}
+
+	cases := []struct {
+		keep   int64
+		cutoff time.Time
+		base   int64
+	}{
+		{keep: 10, base: 0},
+		{keep: 1, base: 4},
+		{keep: 3, base: 2},
+		{cutoff: now.Add(-15 * 24 * time.Hour), base: 3},
+		{keep: 1, cutoff: now.Add(-15 * 24 * time.Hour), base: 3},
+		{cutoff: now.Add(24 * time.Hour), base: 4},
+	}
+	for i, c := range cases {
+		base, err := pruneBase(hst.conn, c.keep, c.cutoff)
+		if err != nil || base != c.base {
+			t.Fatalf("Case %d: expected base %d, got %d: %v", i, c.base, base, err)
+		}
+	}
+
+	if err := prune(hst.conn, 3); err != nil {
+		t.Fatalf("Unable to prune: %v", err)
+	}
+	for step, ois := range map[int64]objects.ObjectInfoSet{3: sets[2], 4: sets[3]} {
+		got, err := stepObjectInfos(hst.conn, step)
+		if err != nil {
+			t.Fatalf("Unable to read step %d: %v", step, err)
+		}
+		if len(got) != len(ois) {
+			t.Fatalf("Step %d: expected %d objects, got %d", step, len(ois), len(got))
+		}
+		for k, v := range ois {
+			if got[k] == nil || got[k].PersistentID != v.PersistentID {
+				t.Fatalf("Step %d: unexpected object '%s': %+v", step, k, got[k])
+			}
+		}
+	}
+	var steps, versions int64
+	if err := sqlitex.Execute(hst.conn, `SELECT (SELECT count(*) FROM steps), (SELECT count(*) FROM versions);`, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			steps, versions = stmt.ColumnInt64(0), stmt.ColumnInt64(1)
+			return nil
+		},
+	}); err != nil {
+		t.Fatalf("Unable to count rows: %v", err)
+	}
+	// versions a and b are gone
+	if steps != 2 || versions != 3 {
+		t.Fatalf("Expected 2 steps and 3 versions, got %d and %d", steps, versions)
+	}
+
+	for step, exp := range map[int64]int64{4: 3, 3: 0} {
+		if prev, err := previousStep(hst.conn, step); err != nil || prev != exp {
+			t.Fatalf("Expected step %d to follow %d, got %d: %v", step, exp, prev, err)
+		}
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	for s, d := range map[string]time.Duration{"30d": 30 * 24 * time.Hour, "12h": 12 * time.Hour} {
+		if got, err := parseAge(s); err != nil || got != d {
+			t.Fatalf("Unexpected age for '%s': %v, %v", s, got, err)
+		}
+	}
+	if _, err := parseAge("xd"); err == nil {
+		t.Fatalf("Expected error")
+	}
+}
@@ -1,68 +1,365 @@
 package history
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"text/tabwriter"
+	"time"
 
 	cli "github.com/urfave/cli/v2"
 	"go.uber.org/zap"
 	"zombiezen.com/go/sqlite"
 	"zombiezen.com/go/sqlite/sqlitex"
 
+	"sync2kindle/objects"
 	"sync2kindle/state"
 )
 
+const timeLayout = "2006-01-02 15:04:05"
+
+// summary describes history database in human terms.
+type summary struct {
+	path        string
+	protocol    string
+	device      string
+	target      string
+	source      string // from the last step
+	steps       int64
+	first, last time.Time
+	lastStep    int64
+}
+
 func RunList(ctx *cli.Context) error {
 	env := ctx.Generic(state.FlagName).(*state.LocalEnv)
 	log := env.Log.Named(driverName)
 
-	entries, err := os.ReadDir(env.Cfg.HistoryPath)
+	paths, err := databases(env.Cfg.HistoryPath)
 	if err != nil {
-		return fmt.Errorf("unable to read history directory '%s': %w", env.Cfg.HistoryPath, err)
+		return err
 	}
-	for _, e := range entries {
-		if e.IsDir() {
+	out := ctx.App.Writer
+	for _, p := range paths {
+		s, err := readSummary(p)
+		if err != nil {
+			log.Error("Unable to report history", zap.String("path", p), zap.Error(err))
 			continue
 		}
-		if filepath.Ext(e.Name()) != ".db" {
-			continue
+		s.print(out)
+	}
+	return nil
+}
+
+func RunShow(ctx *cli.Context) error {
+	env := ctx.Generic(state.FlagName).(*state.LocalEnv)
+
+	dbpath, err := resolveDatabase(ctx.String("db"), env)
+	if err != nil {
+		return err
+	}
+	s, err := readSummary(dbpath)
+	if err != nil {
+		return err
+	}
+	step := s.lastStep
+	if ctx.IsSet("step") {
+		step = ctx.Int64("step")
+	}
+
+	conn, legacy, err := openDatabase(dbpath)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	created, err := stepCreated(conn, step)
+	if err != nil {
+		return err
+	}
+	ois, err := readStep(conn, legacy, step)
+	if err != nil {
+		return err
+	}
+
+	out := ctx.App.Writer
+	s.print(out)
+	files := ois.SubsetByFunc(func(_ string, v *objects.ObjectInfo) bool { return !v.Dir })
+	fmt.Fprintf(out, "Step %d (%s), %d files:\n", step, created.Local().Format(timeLayout), len(files))
+
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "    SIZE\tHASH\tTHUMBNAIL\tPATH")
+	for _, k := range sortedKeys(files) {
+		v := files[k]
+		fmt.Fprintf(tw, "    %d\t%s\t%s\t%s\n", v.ObjSize, shortHash(v.PersistentID), orDash(v.ThumbName), k)
+	}
+	return tw.Flush()
+}
+
+func RunDiff(ctx *cli.Context) error {
+	env := ctx.Generic(state.FlagName).(*state.LocalEnv)
+
+	dbpath, err := resolveDatabase(ctx.String("db"), env)
+	if err != nil {
+		return err
+	}
+	s, err := readSummary(dbpath)
+	if err != nil {
+		return err
+	}
+
+	conn, legacy, err := openDatabase(dbpath)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var from, to int64
+	switch ctx.Args().Len() {
+	case 0:
+		// last two steps, everything is added when there is only one
+		to = s.lastStep
+		if from, err = previousStep(conn, to); err != nil {
+			return err
+		}
+	case 2:
+		if from, err = strconv.ParseInt(ctx.Args().Get(0), 10, 64); err != nil {
+			return fmt.Errorf("bad step '%s': %w", ctx.Args().Get(0), err)
+		}
+		if to, err = strconv.ParseInt(ctx.Args().Get(1), 10, 64); err != nil {
+			return fmt.Errorf("bad step '%s': %w", ctx.Args().Get(1), err)
+		}
+		if _, err := stepCreated(conn, from); err != nil {
+			return err
 		}
-		err := report(filepath.Join(env.Cfg.HistoryPath, e.Name()), log)
+	default:
+		return errors.New("either both steps or none have to be specified")
+	}
+	if _, err := stepCreated(conn, to); err != nil {
+		return err
+	}
+
+	sets := make([]objects.ObjectInfoSet, 2)
+	for i, step := range []int64{from, to} {
+		ois, err := readStep(conn, legacy, step)
 		if err != nil {
-			log.Error("Unable to report history", zap.String("path", filepath.Join(env.Cfg.HistoryPath, e.Name())), zap.Error(err))
+			return err
+		}
+		sets[i] = ois.SubsetByFunc(func(_ string, v *objects.ObjectInfo) bool { return !v.Dir })
+	}
+
+	added := sets[1].Subtract(sets[0])
+	removed := sets[0].Subtract(sets[1])
+	changed := sets[1].DiffByFunc(sets[0], func(a, b *objects.ObjectInfo) bool {
+		return a.PersistentID == b.PersistentID
+	})
+
+	out := ctx.App.Writer
+	s.print(out)
+	fmt.Fprintf(out, "Step %d -> %d: %d added, %d removed, %d changed\n", from, to, len(added), len(removed), len(changed))
+	for _, k := range sortedKeys(added.Union(removed).Union(changed)) {
+		switch {
+		case added[k] != nil:
+			fmt.Fprintf(out, "    + %s\n", k)
+		case removed[k] != nil:
+			fmt.Fprintf(out, "    - %s\n", k)
+		default:
+			fmt.Fprintf(out, "    * %s (%d -> %d bytes)\n", k, sets[0][k].ObjSize, sets[1][k].ObjSize)
 		}
 	}
 	return nil
 }
 
-func report(dbpath string, log *zap.Logger) error {
-	conn, err := sqlite.OpenConn(dbpath, sqlite.OpenReadOnly)
+// databases returns paths of all history databases in the directory.
+func databases(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("unable to read history directory '%s': %w", dir, err)
+	}
+	var paths []string
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".db" {
+			continue
+		}
+		paths = append(paths, filepath.Join(dir, e.Name()))
+	}
+	return paths, nil
+}
+
+// resolveDatabase returns path of the requested database, which could be specified by path or by name in history
+// directory. When nothing is requested the only database for configured target is used.
+func resolveDatabase(name string, env *state.LocalEnv) (string, error) {
+	if len(name) > 0 {
+		if _, err := os.Stat(name); err == nil {
+			return name, nil
+		}
+		p := filepath.Join(env.Cfg.HistoryPath, name)
+		if _, err := os.Stat(p); err != nil {
+			return "", fmt.Errorf("history database '%s' cannot be accessed: %w", name, err)
+		}
+		return p, nil
+	}
+
+	paths, err := databases(env.Cfg.HistoryPath)
+	if err != nil {
+		return "", err
+	}
+	var found []string
+	for _, p := range paths {
+		if values, err := Identifiers(p); err == nil && len(values) == 3 && values[2] == env.Cfg.TargetPath {
+			found = append(found, p)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("no history for target '%s', specify database", env.Cfg.TargetPath)
+	case 1:
+		return found[0], nil
+	default:
+		return "", fmt.Errorf("several histories for target '%s' (different devices or protocols), specify database", env.Cfg.TargetPath)
+	}
+}
+
+func readSummary(dbpath string) (*summary, error) {
+	conn, _, err := openDatabase(dbpath)
+	if err != nil {
+		return nil, err
 	}
 	defer conn.Close()
 
-	err = sqlitex.ExecuteTransient(conn, `PRAGMA foreign_keys = ON;`, nil)
+	values, err := readIdentifiers(conn)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	s := &summary{path: dbpath}
+	if len(values) == 3 {
+		s.protocol, s.device, s.target = values[0], values[1], values[2]
 	}
 
-	var values []string
-	if err := sqlitex.Execute(conn, `SELECT value FROM identifiers;`, &sqlitex.ExecOptions{
+	if err := sqlitex.Execute(conn, `SELECT count(*), ifnull(min(created), 0), ifnull(max(created), 0) FROM steps;`, &sqlitex.ExecOptions{
 		ResultFunc: func(stmt *sqlite.Stmt) error {
-			values = append(values, stmt.ColumnText(0))
+			s.steps = stmt.ColumnInt64(0)
+			s.first = time.Unix(stmt.ColumnInt64(1), 0)
+			s.last = time.Unix(stmt.ColumnInt64(2), 0)
 			return nil
 		},
 	}); err != nil {
-		return fmt.Errorf("unable to read history identifiers: %w", err)
+		return nil, fmt.Errorf("unable to read history steps: %w", err)
+	}
+	if s.lastStep, err = lastStep(conn); err != nil {
+		return nil, err
 	}
+	if err := sqlitex.Execute(conn, `SELECT source FROM steps WHERE step_id=?;`, &sqlitex.ExecOptions{
+		Args: []any{s.lastStep},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			s.source = stmt.ColumnText(0)
+			return nil
+		},
+	}); err != nil {
+		return nil, fmt.Errorf("unable to read history source: %w", err)
+	}
+	return s, nil
+}
 
-	step, err := lastStep(conn)
+func (s *summary) print(out io.Writer) {
+	fmt.Fprintf(out, "%s\n", s.path)
+	tw := tabwriter.NewWriter(out, 0, 4, 1, ' ', 0)
+	fmt.Fprintf(tw, "    protocol:\t%s\n", orDash(s.protocol))
+	fmt.Fprintf(tw, "    device:\t%s\n", orDash(s.device))
+	fmt.Fprintf(tw, "    destination:\t%s\n", orDash(s.target))
+	fmt.Fprintf(tw, "    source:\t%s\n", orDash(s.source))
+	if s.steps == 0 {
+		fmt.Fprintf(tw, "    steps:\tnone\n")
+	} else {
+		fmt.Fprintf(tw, "    steps:\t%d, last %d\n", s.steps, s.lastStep)
+		fmt.Fprintf(tw, "    first sync:\t%s\n", s.first.Local().Format(timeLayout))
+		fmt.Fprintf(tw, "    last sync:\t%s\n", s.last.Local().Format(timeLayout))
+	}
+	_ = tw.Flush()
+}
+
+// openDatabase opens existing history database for inspection. Database is opened read only and is never upgraded
+// here, since it could be used by sync at the same time - history in original format is read as is.
+func openDatabase(dbpath string) (conn *sqlite.Conn, legacy bool, err error) {
+	return openReadOnly(dbpath)
+}
+
+// upgradeDatabase opens existing history database for changes, bringing its schema up to date first. Database has to
+// be locked by caller.
+func upgradeDatabase(dbpath string) (*sqlite.Conn, error) {
+	conn, err := sqlite.OpenConn(dbpath, sqlite.OpenReadWrite)
 	if err != nil {
-		return fmt.Errorf("unable to read history last step: %w", err)
+		return nil, err
 	}
+	if err := sqlitex.ExecuteTransient(conn, `PRAGMA foreign_keys = ON;`, nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := migrate(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
 
-	log.Info("Report", zap.String("path", dbpath), zap.Int64("last step", step), zap.Strings("identifiers", values))
-	return nil
+func stepCreated(conn *sqlite.Conn, stepID int64) (time.Time, error) {
+	var (
+		created int64
+		found   bool
+	)
+	if err := sqlitex.Execute(conn, `SELECT created FROM steps WHERE step_id=?;`, &sqlitex.ExecOptions{
+		Args: []any{stepID},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			created, found = stmt.ColumnInt64(0), true
+			return nil
+		},
+	}); err != nil {
+		return time.Time{}, fmt.Errorf("unable to read history step '%d': %w", stepID, err)
+	}
+	if !found {
+		return time.Time{}, fmt.Errorf("history step '%d' does not exist", stepID)
+	}
+	return time.Unix(created, 0), nil
+}
+
+// previousStep returns step preceding "stepID", step ids are not necessarily consecutive. 0 is returned when there is
+// no such step.
+func previousStep(conn *sqlite.Conn, stepID int64) (int64, error) {
+	var prev int64
+	if err := sqlitex.Execute(conn, `SELECT ifnull(max(step_id), 0) FROM steps WHERE step_id<?;`, &sqlitex.ExecOptions{
+		Args: []any{stepID},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			prev = stmt.ColumnInt64(0)
+			return nil
+		},
+	}); err != nil {
+		return 0, fmt.Errorf("unable to read history step preceding '%d': %w", stepID, err)
+	}
+	return prev, nil
+}
+
+func sortedKeys(ois objects.ObjectInfoSet) []string {
+	keys := make([]string, 0, len(ois))
+	for k := range ois {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func shortHash(h string) string {
+	if len(h) > 12 {
+		return h[:12]
+	}
+	return orDash(h)
+}
+
+func orDash(s string) string {
+	if len(s) == 0 {
+		return "-"
+	}
+	return s
 }
@@ -0,0 +1,231 @@
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	cli "github.com/urfave/cli/v2"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+
+	"sync2kindle/config"
+	"sync2kindle/objects"
+	"sync2kindle/state"
+)
+
+// stats is computed by replaying history steps. History cannot tell why book disappeared, so every removal is
+// treated as book being finished.
+type stats struct {
+	Database         string       `json:"database"`
+	Device           string       `json:"device"`
+	Destination      string       `json:"destination"`
+	Steps            int          `json:"steps"`
+	Books            int          `json:"books"`
+	Bytes            int64        `json:"bytes"`
+	BytesTransferred int64        `json:"bytes_transferred"`
+	Finished         int          `json:"finished"`
+	AvgDaysOnDevice  float64      `json:"average_days_on_device"`
+	Months           []monthStats `json:"months"`
+	Formats          []groupStats `json:"formats"`
+	Folders          []groupStats `json:"folders"`
+}
+
+type monthStats struct {
+	Month       string `json:"month"`
+	Added       int    `json:"added"`
+	Removed     int    `json:"removed"`
+	Transferred int64  `json:"bytes_transferred"`
+	Books       int    `json:"books"` // library size at the end of the month
+	Bytes       int64  `json:"bytes"`
+}
+
+type groupStats struct {
+	Name  string `json:"name"`
+	Books int    `json:"books"`
+	Bytes int64  `json:"bytes"`
+}
+
+func RunStats(ctx *cli.Context) error {
+	env := ctx.Generic(state.FlagName).(*state.LocalEnv)
+
+	format := ctx.String("format")
+	if format != "table" && format != "json" {
+		return fmt.Errorf("unknown output format '%s'", format)
+	}
+
+	dbpath, err := resolveDatabase(ctx.String("db"), env)
+	if err != nil {
+		return err
+	}
+	s, err := readSummary(dbpath)
+	if err != nil {
+		return err
+	}
+
+	conn, legacy, err := openDatabase(dbpath)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	st, err := computeStats(conn, legacy, bookExtensions(s.target, env.Cfg))
+	if err != nil {
+		return err
+	}
+	st.Database, st.Device, st.Destination = dbpath, s.device, s.target
+
+	if format == "json" {
+		enc := json.NewEncoder(ctx.App.Writer)
+		enc.SetIndent("", "  ")
+		return enc.Encode(st)
+	}
+	return st.print(ctx.App.Writer)
+}
+
+// bookExtensions returns extensions of files considered books for the target, content channels have their own.
+func bookExtensions(target string, cfg *config.Config) []string {
+	for _, ch := range cfg.Channels {
+		if ch.TargetPath == target {
+			return ch.Extensions
+		}
+	}
+	return cfg.BookExtensions
+}
+
+func computeStats(conn *sqlite.Conn, legacy bool, exts []string) (*stats, error) {
+	type step struct {
+		id      int64
+		created time.Time
+	}
+	var steps []step
+	if err := sqlitex.Execute(conn, `SELECT step_id, created FROM steps ORDER BY step_id;`, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			steps = append(steps, step{id: stmt.ColumnInt64(0), created: time.Unix(stmt.ColumnInt64(1), 0)})
+			return nil
+		},
+	}); err != nil {
+		return nil, fmt.Errorf("unable to read history steps: %w", err)
+	}
+
+	st := &stats{Steps: len(steps)}
+	var (
+		prev     = objects.New()
+		added    = make(map[string]time.Time)
+		onDevice time.Duration
+		month    *monthStats
+	)
+	for _, s := range steps {
+		ois, err := readStep(conn, legacy, s.id)
+		if err != nil {
+			return nil, err
+		}
+		cur := ois.SubsetByFunc(func(_ string, v *objects.ObjectInfo) bool {
+			return !v.Dir && slices.Contains(exts, filepath.Ext(v.Name))
+		})
+
+		name := s.created.Local().Format("2006-01")
+		if month == nil || month.Month != name {
+			st.Months = append(st.Months, monthStats{Month: name})
+			month = &st.Months[len(st.Months)-1]
+		}
+		for k, v := range cur.Subtract(prev) {
+			added[k] = s.created
+			month.Added++
+			month.Transferred += v.ObjSize
+		}
+		// changed books are sent again
+		for _, v := range cur.DiffByFunc(prev, func(a, b *objects.ObjectInfo) bool { return a.PersistentID == b.PersistentID }) {
+			month.Transferred += v.ObjSize
+		}
+		for k := range prev.Subtract(cur) {
+			month.Removed++
+			st.Finished++
+			onDevice += s.created.Sub(added[k])
+			delete(added, k)
+		}
+		month.Books, month.Bytes = len(cur), totalSize(cur)
+		prev = cur
+	}
+
+	for _, m := range st.Months {
+		st.BytesTransferred += m.Transferred
+	}
+	if st.Finished > 0 {
+		st.AvgDaysOnDevice = onDevice.Hours() / 24 / float64(st.Finished)
+	}
+	st.Books, st.Bytes = len(prev), totalSize(prev)
+	st.Formats = groupBy(prev, func(k string) string { return strings.ToLower(path.Ext(k)) })
+	st.Folders = groupBy(prev, func(k string) string {
+		if dir, _, ok := strings.Cut(k, "/"); ok {
+			return dir
+		}
+		return "."
+	})
+	return st, nil
+}
+
+func totalSize(ois objects.ObjectInfoSet) (size int64) {
+	for _, v := range ois {
+		size += v.ObjSize
+	}
+	return
+}
+
+func groupBy(ois objects.ObjectInfoSet, key func(string) string) []groupStats {
+	groups := make(map[string]*groupStats)
+	for k, v := range ois {
+		name := key(k)
+		g, ok := groups[name]
+		if !ok {
+			g = &groupStats{Name: name}
+			groups[name] = g
+		}
+		g.Books++
+		g.Bytes += v.ObjSize
+	}
+	res := make([]groupStats, 0, len(groups))
+	for _, g := range groups {
+		res = append(res, *g)
+	}
+	slices.SortFunc(res, func(a, b groupStats) int {
+		if a.Books != b.Books {
+			return b.Books - a.Books
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+	return res
+}
+
+func (st *stats) print(out io.Writer) error {
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "%s\n", st.Database)
+	fmt.Fprintf(tw, "    device:\t%s\n", orDash(st.Device))
+	fmt.Fprintf(tw, "    destination:\t%s\n", orDash(st.Destination))
+	fmt.Fprintf(tw, "    steps:\t%d\n", st.Steps)
+	fmt.Fprintf(tw, "    books:\t%d (%d bytes)\n", st.Books, st.Bytes)
+	fmt.Fprintf(tw, "    transferred:\t%d bytes\n", st.BytesTransferred)
+	fmt.Fprintf(tw, "    finished:\t%d, %.1f days on device on average\n", st.Finished, st.AvgDaysOnDevice)
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "    MONTH\tADDED\tREMOVED\tTRANSFERRED\tBOOKS\tBYTES")
+	for _, m := range st.Months {
+		fmt.Fprintf(tw, "    %s\t%d\t%d\t%d\t%d\t%d\n", m.Month, m.Added, m.Removed, m.Transferred, m.Books, m.Bytes)
+	}
+	for _, g := range []struct {
+		title  string
+		groups []groupStats
+	}{{"FORMAT", st.Formats}, {"FOLDER", st.Folders}} {
+		fmt.Fprintln(tw)
+		fmt.Fprintf(tw, "    %s\tBOOKS\tBYTES\n", g.title)
+		for _, v := range g.groups {
+			fmt.Fprintf(tw, "    %s\t%d\t%d\n", v.Name, v.Books, v.Bytes)
+		}
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,76 @@
+package history
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+	"zombiezen.com/go/sqlite/sqlitex"
+
+	"sync2kindle/objects"
+)
+
+func TestComputeStats(t *testing.T) {
+	log := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	dbpath := filepath.Join(t.TempDir(), "test.db")
+	if err := Create(dbpath, log, "MTP", "SN", "documents/mybooks"); err != nil {
+		t.Fatalf("Unable to create history: %v", err)
+	}
+	hst, err := Connect(dbpath, log)
+	if err != nil {
+		t.Fatalf("Unable to open history: %v", err)
+	}
+	defer hst.Disconnect()
+
+	steps := []struct {
+		created time.Time
+		ois     objects.ObjectInfoSet
+	}{
+		{time.Date(2025, 1, 10, 12, 0, 0, 0, time.Local), objects.ObjectInfoSet{
+			"a.azw3":      {Name: "a.azw3", File: true, ObjSize: 100, PersistentID: "a"},
+			"f/b.kfx":     {Name: "b.kfx", File: true, ObjSize: 200, PersistentID: "b"},
+			"f":           {Name: "f", Dir: true},
+			"f/cover.jpg": {Name: "cover.jpg", File: true, ObjSize: 1000},
+		}},
+		{time.Date(2025, 1, 20, 12, 0, 0, 0, time.Local), objects.ObjectInfoSet{
+			"a.azw3":  {Name: "a.azw3", File: true, ObjSize: 150, PersistentID: "a2"},
+			"f/b.kfx": {Name: "b.kfx", File: true, ObjSize: 200, PersistentID: "b"},
+		}},
+		{time.Date(2025, 3, 1, 12, 0, 0, 0, time.Local), objects.ObjectInfoSet{
+			"f/b.kfx": {Name: "b.kfx", File: true, ObjSize: 200, PersistentID: "b"},
+			"f/c.pdf": {Name: "c.pdf", File: true, ObjSize: 50, PersistentID: "c"},
+		}},
+	}
+	for _, s := range steps {
+		if err := hst.SaveObjectInfos("/src", "documents/mybooks", s.ois); err != nil {
+			t.Fatalf("Unable to save step: %v", err)
+		}
+		if err := sqlitex.Execute(hst.conn, `UPDATE steps SET created=? WHERE step_id=?;`, &sqlitex.ExecOptions{
+			Args: []any{s.created.Unix(), hst.StepID()},
+		}); err != nil {
+			t.Fatalf("Unable to update step: %v", err)
+		}
+	}
+
+	st, err := computeStats(hst.conn, false, []string{".azw3", ".kfx", ".pdf"})
+	if err != nil {
+		t.Fatalf("Unable to compute stats: %v", err)
+	}
+	if st.Steps != 3 || st.Books != 2 || st.Bytes != 250 || st.Finished != 1 {
+		t.Fatalf("Unexpected totals: %+v", st)
+	}
+	if st.BytesTransferred != 100+200+150+50 {
+		t.Fatalf("Unexpected bytes transferred: %d", st.BytesTransferred)
+	}
+	if st.AvgDaysOnDevice < 49 || st.AvgDaysOnDevice > 51 {
+		t.Fatalf("Unexpected average days on device: %f", st.AvgDaysOnDevice)
+	}
+	if len(st.Months) != 2 || st.Months[0].Month != "2025-01" || st.Months[0].Added != 2 || st.Months[1].Removed != 1 || st.Months[1].Books != 2 {
+		t.Fatalf("Unexpected months: %+v", st.Months)
+	}
+	if len(st.Folders) != 1 || st.Folders[0].Name != "f" || len(st.Formats) != 2 {
+		t.Fatalf("Unexpected breakdowns: %+v, %+v", st.Folders, st.Formats)
+	}
+}
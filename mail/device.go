@@ -1,9 +1,13 @@
 package mail
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"mime"
+	"net"
+	"net/textproto"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -27,10 +31,11 @@ type Device struct {
 	target string
 	smtp   *config.SmtpConfig
 	debug  bool
+	retry  common.RetryPolicy
 }
 
-func Connect(target string, smtp *config.SmtpConfig, debug bool, log *zap.Logger) (*Device, error) {
-	return &Device{target: target, smtp: smtp, debug: debug, log: log.Named(driverName)}, nil
+func Connect(target string, smtp *config.SmtpConfig, debug bool, retry common.RetryPolicy, log *zap.Logger) (*Device, error) {
+	return &Device{target: target, smtp: smtp, debug: debug, retry: retry, log: log.Named(driverName)}, nil
 }
 
 // driver interface
@@ -49,12 +54,12 @@ func (d *Device) UniqueID() string {
 	return d.smtp.From
 }
 
-func (d *Device) MkDir(obj *objects.ObjectInfo) error {
+func (d *Device) MkDir(_ context.Context, obj *objects.ObjectInfo) error {
 	d.log.Error("Action MkDir is not supported", zap.String("actor", d.Name()))
 	return nil
 }
 
-func (d *Device) Remove(obj *objects.ObjectInfo) error {
+func (d *Device) Remove(_ context.Context, obj *objects.ObjectInfo) error {
 	d.log.Error("Action Remove is not supported", zap.String("actor", d.Name()))
 	return nil
 }
@@ -87,7 +92,7 @@ func encodeContentDispositionFilename(safename, realname string) string {
 	return res
 }
 
-func (d *Device) Copy(obj *objects.ObjectInfo) (err error) {
+func (d *Device) Copy(ctx context.Context, obj *objects.ObjectInfo) (err error) {
 	if obj == nil {
 		panic("Copy is called with nil object")
 	}
@@ -133,14 +138,38 @@ func (d *Device) Copy(obj *objects.ObjectInfo) (err error) {
 		}
 	}
 
-	// real send
-	if err := gomail.NewDialer(d.smtp.Server, d.smtp.Port, d.smtp.User, string(d.smtp.Password)).DialAndSend(m); err != nil {
+	// sending cannot be interrupted, so do not start it when we are asked to stop
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// real send, temporary failures are retried
+	dialer := gomail.NewDialer(d.smtp.Server, d.smtp.Port, d.smtp.User, string(d.smtp.Password))
+	if err := common.Retry(ctx, d.retry, func(int) error {
+		s, err := dialer.Dial()
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+		// gomail.Send does not wrap errors, so we cannot use it and still see SMTP reply codes
+		return s.Send(d.smtp.From, []string{d.target}, m)
+	}, transient, d.log); err != nil {
 		return fmt.Errorf("unable to send e-mail: %w", err)
 	}
 	return nil
 }
 
-func (d *Device) GetObjectInfos() (objects.ObjectInfoSet, error) {
+// transient reports if sending failed temporarily: SMTP server replied with 4xx code or network failed.
+func transient(err error) bool {
+	var terr *textproto.Error
+	if errors.As(err, &terr) {
+		return terr.Code >= 400 && terr.Code < 500
+	}
+	var nerr net.Error
+	return errors.As(err, &nerr)
+}
+
+func (d *Device) GetObjectInfos(context.Context) (objects.ObjectInfoSet, error) {
 	// always empty - it will be set outside, probably to history data, as we have no view into device state
 	return objects.New(), nil
 }
@@ -72,6 +72,9 @@ var (
 	WPD_OBJECT_DATE_MODIFIED        = &PropertyKey{fmtid: WPD_OBJECT_PROPERTIES_V1, pid: 19}
 	WPD_OBJECT_CAN_DELETE           = &PropertyKey{fmtid: WPD_OBJECT_PROPERTIES_V1, pid: 26}
 
+	// resource keys
+	WPD_RESOURCE_DEFAULT = &PropertyKey{fmtid: ole.GUID{Data1: 0xE81E79BE, Data2: 0x34F0, Data3: 0x41BF, Data4: [8]byte{0xB5, 0x3F, 0xF1, 0xA0, 0x6A, 0xE8, 0x78, 0x42}}, pid: 0}
+
 	// Legacy WPD Formats
 	WPD_OBJECT_FORMAT_UNSPECIFIED = ole.GUID{Data1: 0x30000000, Data2: 0xAE6C, Data3: 0x4804, Data4: [8]byte{0x98, 0xBA, 0xC5, 0x7B, 0x46, 0x96, 0x5F, 0xE7}}
 
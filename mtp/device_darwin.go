@@ -1,8 +1,10 @@
 package mtp
 
 import (
+	"context"
 	"errors"
 	"go.uber.org/zap"
+	"sync2kindle/common"
 	"sync2kindle/objects"
 )
 
@@ -10,17 +12,22 @@ import (
 type Device struct{}
 
 // Connect returns an error indicating MTP is not supported on macOS.
-func Connect(paths, serial string, verbose bool, _ *zap.Logger) (*Device, error) {
+func Connect(paths, serial string, verbose bool, _ common.RetryPolicy, _ *zap.Logger) (*Device, error) {
 	return nil, errors.New("MTP support not implemented on darwin")
 }
 
 // Stub implementations to satisfy driver interface.
-func (d *Device) Disconnect()                      {}
-func (d *Device) Name() string                     { return driverName }
-func (d *Device) UniqueID() string                 { return "" }
-func (d *Device) MkDir(*objects.ObjectInfo) error  { return errors.New("not supported") }
-func (d *Device) Remove(*objects.ObjectInfo) error { return errors.New("not supported") }
-func (d *Device) Copy(*objects.ObjectInfo) error   { return errors.New("not supported") }
-func (d *Device) GetObjectInfos() (objects.ObjectInfoSet, error) {
+func (d *Device) Disconnect()      {}
+func (d *Device) Name() string     { return driverName }
+func (d *Device) UniqueID() string { return "" }
+func (d *Device) MkDir(context.Context, *objects.ObjectInfo) error {
+	return errors.New("not supported")
+}
+func (d *Device) Remove(context.Context, *objects.ObjectInfo) error {
+	return errors.New("not supported")
+}
+func (d *Device) Copy(context.Context, *objects.ObjectInfo) error { return errors.New("not supported") }
+func (d *Device) Move(context.Context, *objects.ObjectInfo) error { return errors.New("not supported") }
+func (d *Device) GetObjectInfos(context.Context) (objects.ObjectInfoSet, error) {
 	return nil, errors.New("not supported")
 }
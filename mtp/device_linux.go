@@ -25,14 +25,31 @@ package mtp
 //     close(backup);
 // }
 //
+// // transfer progress is reported to Go, which could cancel it
+// extern int transferProgress(uintptr_t handle);
+//
+// static int progress(uint64_t const sent, uint64_t const total, void const * const data) {
+//     return transferProgress((uintptr_t)data);
+// }
+//
+// static int send_file(LIBMTP_mtpdevice_t *dev, char const * const path, LIBMTP_file_t * const file, uintptr_t handle) {
+//     return LIBMTP_Send_File_From_File(dev, path, file, progress, (void const *)handle);
+// }
+//
+// static int get_file(LIBMTP_mtpdevice_t *dev, uint32_t const id, char const * const path, uintptr_t handle) {
+//     return LIBMTP_Get_File_To_File(dev, id, path, progress, (void const *)handle);
+// }
+//
 import "C"
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
 	"path"
 	"path/filepath"
+	"runtime/cgo"
 	"slices"
 	"strings"
 	"time"
@@ -46,14 +63,18 @@ import (
 )
 
 type Device struct {
-	log   *zap.Logger
-	id    *common.PnPDeviceID
-	dev   *C.LIBMTP_mtpdevice_t
-	roots []string
+	log     *zap.Logger
+	id      *common.PnPDeviceID
+	dev     *C.LIBMTP_mtpdevice_t
+	model   string
+	roots   []string
+	verbose bool
+	retry   common.RetryPolicy
+	stale   bool // transient failure happened, device has to be re-opened
 }
 
 // Connect to the supported device.
-func Connect(paths, serial string, verbose bool, log *zap.Logger) (*Device, error) {
+func Connect(paths, serial string, verbose bool, retry common.RetryPolicy, log *zap.Logger) (*Device, error) {
 	C.LIBMTP_Init()
 
 	if !verbose {
@@ -78,9 +99,15 @@ func Connect(paths, serial string, verbose bool, log *zap.Logger) (*Device, erro
 	log.Debug("Device Storage", zap.Any("Properties", info))
 
 	d := &Device{
-		log: log.Named(driverName),
-		id:  id,
-		dev: dev,
+		log:     log.Named(driverName),
+		id:      id,
+		dev:     dev,
+		verbose: verbose,
+		retry:   retry,
+	}
+	if model := C.LIBMTP_Get_Modelname(dev); model != nil {
+		d.model = C.GoString(model)
+		C.free(unsafe.Pointer(model))
 	}
 	if WPDStorageAccessCapability(dev.storage.AccessCapability) != WPD_STORAGE_ACCESS_CAPABILITY_READWRITE {
 		return nil, common.ErrNoAccess
@@ -105,6 +132,7 @@ func (d *Device) Disconnect() {
 	}
 	if d.dev != nil {
 		C.LIBMTP_Release_Device(d.dev)
+		d.dev = nil
 	}
 }
 
@@ -116,7 +144,12 @@ func (d *Device) UniqueID() string {
 	return d.id.Serial()
 }
 
-func (d *Device) MkDir(obj *objects.ObjectInfo) (err error) {
+// Model returns device model name as reported by the device.
+func (d *Device) Model() string {
+	return d.model
+}
+
+func (d *Device) mkDir(ctx context.Context, obj *objects.ObjectInfo) (err error) {
 	if obj == nil {
 		panic("MkDir is called with nil object")
 	}
@@ -130,6 +163,10 @@ func (d *Device) MkDir(obj *objects.ObjectInfo) (err error) {
 		d.log.Debug("Executed action MkDir", zap.String("actor", d.Name()), zap.Any("object", obj), zap.Duration("elapsed", time.Since(start)), zap.Error(err))
 	}(time.Now())
 
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	name := C.CString(obj.Name)
 	defer C.free(unsafe.Pointer(name))
 
@@ -141,7 +178,7 @@ func (d *Device) MkDir(obj *objects.ObjectInfo) (err error) {
 	return nil
 }
 
-func (d *Device) Remove(obj *objects.ObjectInfo) (err error) {
+func (d *Device) remove(ctx context.Context, obj *objects.ObjectInfo) (err error) {
 	if obj == nil {
 		panic("Remove is called with nil object")
 	}
@@ -150,13 +187,16 @@ func (d *Device) Remove(obj *objects.ObjectInfo) (err error) {
 		d.log.Debug("Executed action Remove", zap.String("actor", d.Name()), zap.Any("object", obj), zap.Duration("elapsed", time.Since(start)), zap.Error(err))
 	}(time.Now())
 
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if res := C.LIBMTP_Delete_Object(d.dev, C.uint32_t(obj.Oid)); res != 0 {
 		return fmt.Errorf("failed to delete object '%s': %w", obj.Oid, d.getErrors())
 	}
 	return nil
 }
 
-func (d *Device) Copy(obj *objects.ObjectInfo) (err error) {
+func (d *Device) copyFile(ctx context.Context, obj *objects.ObjectInfo) (err error) {
 	if obj == nil {
 		panic("Copy is called with nil object")
 	}
@@ -183,19 +223,103 @@ func (d *Device) Copy(obj *objects.ObjectInfo) (err error) {
 	from := C.CString(obj.ObjectName)
 	defer C.free(unsafe.Pointer(from))
 
-	if res := C.LIBMTP_Send_File_From_File(d.dev, from, target, nil, nil); res != 0 {
+	// progress callback aborts transfer when context is done
+	h := cgo.NewHandle(ctx)
+	defer h.Delete()
+
+	if res := C.send_file(d.dev, from, target, C.uintptr_t(h)); res != 0 {
+		if err := ctx.Err(); err != nil {
+			// do not leave partially transferred object behind
+			if target.item_id != 0 {
+				C.LIBMTP_Delete_Object(d.dev, target.item_id)
+			}
+			C.LIBMTP_Clear_Errorstack(d.dev)
+			return fmt.Errorf("copying file '%s' to '%s' was interrupted: %w", obj.ObjectName, obj.FullPath, err)
+		}
 		return fmt.Errorf("failed to copy file '%s' (%d) to '%s': %w", obj.ObjectName, obj.ObjSize, obj.FullPath, d.getErrors())
 	}
 	obj.Oid = objects.ObjectID(target.item_id)
 	return nil
 }
 
-func (d *Device) GetObjectInfos() (objects.ObjectInfoSet, error) {
-	infos := d.enumerateObjects(WPD_DEVICE_OBJECT_ID, "", make([]*objects.ObjectInfo, 0))
-	if len(infos) == 0 {
-		if err := d.getErrors(); err != nil {
-			return nil, err
+// move moves object "obj.Oid" to the folder of "obj.FullPath", renaming objects is not supported.
+func (d *Device) move(ctx context.Context, obj *objects.ObjectInfo) (err error) {
+	if obj == nil {
+		panic("Move is called with nil object")
+	}
+	if path.Base(obj.FullPath) != obj.Name {
+		return fmt.Errorf("unable to move '%s' to '%s', renaming is not supported", obj.ObjectName, obj.FullPath)
+	}
+	parent := obj.OIS.Find(path.Dir(obj.FullPath))
+	if parent == nil {
+		return fmt.Errorf("parent object not found for '%s'", obj.FullPath)
+	}
+	obj.OidParent = parent.Oid
+
+	defer func(start time.Time) {
+		d.log.Debug("Executed action Move", zap.String("actor", d.Name()), zap.Any("object", obj), zap.Duration("elapsed", time.Since(start)), zap.Error(err))
+	}(time.Now())
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if res := C.LIBMTP_Move_Object(d.dev, C.uint32_t(obj.Oid), d.dev.storage.id, C.uint32_t(obj.OidParent)); res != 0 {
+		return fmt.Errorf("failed to move object '%s' to '%s': %w", obj.Oid, obj.FullPath, d.getErrors())
+	}
+	return nil
+}
+
+// hash downloads object content into temporary file to calculate its hash, libmtp cannot read objects in place.
+func (d *Device) hash(ctx context.Context, obj *objects.ObjectInfo) (hash string, err error) {
+	if obj == nil {
+		panic("Hash is called with nil object")
+	}
+
+	defer func(start time.Time) {
+		d.log.Debug("Executed action Hash", zap.String("actor", d.Name()), zap.Any("object", obj), zap.Duration("elapsed", time.Since(start)), zap.Error(err))
+	}(time.Now())
+
+	tmp, err := os.CreateTemp("", "s2k-hash-*")
+	if err != nil {
+		return "", fmt.Errorf("unable to create temporary file: %w", err)
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	to := C.CString(tmp.Name())
+	defer C.free(unsafe.Pointer(to))
+
+	// progress callback aborts transfer when context is done
+	h := cgo.NewHandle(ctx)
+	defer h.Delete()
+
+	if res := C.get_file(d.dev, C.uint32_t(obj.Oid), to, C.uintptr_t(h)); res != 0 {
+		if err := ctx.Err(); err != nil {
+			C.LIBMTP_Clear_Errorstack(d.dev)
+			return "", fmt.Errorf("reading '%s' was interrupted: %w", obj.FullPath, err)
 		}
+		return "", fmt.Errorf("failed to read '%s': %w", obj.FullPath, d.getErrors())
+	}
+
+	file, err := os.Open(tmp.Name())
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	return common.HashContent(ctx, file, make([]byte, 256*1024))
+}
+
+func (d *Device) getObjectInfos(ctx context.Context) (objects.ObjectInfoSet, error) {
+	infos := d.enumerateObjects(ctx, WPD_DEVICE_OBJECT_ID, "", make([]*objects.ObjectInfo, 0))
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	// incomplete enumeration cannot be trusted
+	if err := d.getErrors(); err != nil && (len(infos) == 0 || isTransient(err)) {
+		return nil, err
+	}
+	if len(infos) == 0 {
 		return nil, common.ErrNoObjects
 	}
 
@@ -209,22 +333,65 @@ func (d *Device) GetObjectInfos() (objects.ObjectInfoSet, error) {
 
 // implementation
 
+// transientError marks libmtp failures which may go away after device is re-opened.
+type transientError struct {
+	err error
+}
+
+func (e *transientError) Error() string {
+	return e.err.Error()
+}
+
+func (e *transientError) Unwrap() error {
+	return e.err
+}
+
+func deviceLost(err error) bool {
+	var te *transientError
+	return errors.As(err, &te)
+}
+
+// reopen releases device and opens it again using the same serial number.
+func (d *Device) reopen() error {
+	if d.dev != nil {
+		C.LIBMTP_Release_Device(d.dev)
+		d.dev = nil
+	}
+	id, dev, err := pickDevice(d.id.Serial(), d.verbose, d.log)
+	if err != nil {
+		return fmt.Errorf("unable to re-open device '%s': %w", d.id.Serial(), err)
+	}
+	d.id, d.dev = id, dev
+	return nil
+}
+
 func (d *Device) getErrors() (err error) {
 	if d == nil || d.dev == nil {
 		return
 	}
+	transient := false
 	for stack := C.LIBMTP_Get_Errorstack(d.dev); stack != nil; stack = stack.next {
 		if err != nil {
 			err = fmt.Errorf("%s(%d): %w", C.GoString(stack.error_text), stack.errornumber, err)
 		} else {
 			err = fmt.Errorf("%s (%d)", C.GoString(stack.error_text), stack.errornumber)
 		}
+		switch stack.errornumber {
+		case C.LIBMTP_ERROR_PTP_LAYER, C.LIBMTP_ERROR_USB_LAYER, C.LIBMTP_ERROR_CONNECTING, C.LIBMTP_ERROR_NO_DEVICE_ATTACHED:
+			transient = true
+		}
 	}
 	C.LIBMTP_Clear_Errorstack(d.dev)
+	if transient {
+		err = &transientError{err: err}
+	}
 	return
 }
 
-func (d *Device) enumerateObjects(parent objects.ObjectID, root string, infos []*objects.ObjectInfo) []*objects.ObjectInfo {
+func (d *Device) enumerateObjects(ctx context.Context, parent objects.ObjectID, root string, infos []*objects.ObjectInfo) []*objects.ObjectInfo {
+	if ctx.Err() != nil {
+		return infos
+	}
 	objs := C.LIBMTP_Get_Files_And_Folders(d.dev, d.dev.storage.id, C.uint32_t(parent))
 	if objs == nil {
 		return infos
@@ -257,7 +424,7 @@ func (d *Device) enumerateObjects(parent objects.ObjectID, root string, infos []
 		}
 		if info.Dir {
 			// recurse into the directory
-			infos = d.enumerateObjects(info.Oid, info.FullPath, infos)
+			infos = d.enumerateObjects(ctx, info.Oid, info.FullPath, infos)
 		}
 
 		if prev != nil {
@@ -1,6 +1,7 @@
 package mtp
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -26,6 +27,7 @@ import (
 type Device struct {
 	log            *zap.Logger
 	id             common.PnPDeviceID
+	model          string
 	pdmanager      *IPortableDeviceManager
 	clientInfo     *IPortableDeviceValues
 	pdevice        *IPortableDevice
@@ -34,10 +36,12 @@ type Device struct {
 	fullAccess     bool
 	storage        string
 	roots          []string
+	retry          common.RetryPolicy
+	stale          bool // transient failure happened, device has to be re-opened
 }
 
 // Connect to the supported device.
-func Connect(paths, serial string, _ bool, log *zap.Logger) (d *Device, err error) {
+func Connect(paths, serial string, _ bool, retry common.RetryPolicy, log *zap.Logger) (d *Device, err error) {
 	defer func() {
 		if err != nil {
 			d.Disconnect()
@@ -47,7 +51,7 @@ func Connect(paths, serial string, _ bool, log *zap.Logger) (d *Device, err erro
 	if err := ole.CoInitializeEx(0, ole.COINIT_MULTITHREADED); err != nil {
 		return nil, err
 	}
-	d = &Device{log: log.Named(driverName)}
+	d = &Device{log: log.Named(driverName), retry: retry}
 	d.pdmanager, err = CreatePortableDeviceManager()
 	if err != nil {
 		return
@@ -75,6 +79,7 @@ func Connect(paths, serial string, _ bool, log *zap.Logger) (d *Device, err erro
 		return
 	}
 	d.log.Debug("Device Info", zap.Any("Properties", info))
+	d.model = info["Model"]
 	storage, err := d.fillStorageInfo()
 	if err != nil {
 		err = fmt.Errorf("failed to get device storage properties: %w", err)
@@ -123,11 +128,16 @@ func (d *Device) UniqueID() string {
 	return d.id.Serial()
 }
 
+// Model returns device model name as reported by the device.
+func (d *Device) Model() string {
+	return d.model
+}
+
 func (d *Device) Name() string {
 	return driverName
 }
 
-func (d *Device) MkDir(obj *objects.ObjectInfo) (err error) {
+func (d *Device) mkDir(ctx context.Context, obj *objects.ObjectInfo) (err error) {
 	if obj == nil {
 		panic("MkDir is called with nil object")
 	}
@@ -141,6 +151,10 @@ func (d *Device) MkDir(obj *objects.ObjectInfo) (err error) {
 		d.log.Debug("Executed action MkDir", zap.String("actor", d.Name()), zap.Any("object", obj), zap.Duration("elapsed", time.Since(start)), zap.Error(err))
 	}(time.Now())
 
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	values, err := createObjectValues(obj.OidParent, obj.Name, &WPD_CONTENT_TYPE_FOLDER, 0)
 	if err != nil {
 		return fmt.Errorf("failed to create object values: %w", err)
@@ -160,7 +174,7 @@ func (d *Device) MkDir(obj *objects.ObjectInfo) (err error) {
 	return nil
 }
 
-func (d *Device) Remove(obj *objects.ObjectInfo) (err error) {
+func (d *Device) remove(ctx context.Context, obj *objects.ObjectInfo) (err error) {
 	if obj == nil {
 		panic("Remove is called with nil object")
 	}
@@ -169,6 +183,10 @@ func (d *Device) Remove(obj *objects.ObjectInfo) (err error) {
 		d.log.Debug("Executed action Remove", zap.String("actor", d.Name()), zap.Any("object", obj), zap.Duration("elapsed", time.Since(start)), zap.Error(err))
 	}(time.Now())
 
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	ids, err := CreatePortableDevicePropVariantCollection()
 	if err != nil {
 		return err
@@ -201,7 +219,7 @@ func (d *Device) Remove(obj *objects.ObjectInfo) (err error) {
 	return nil
 }
 
-func (d *Device) Copy(obj *objects.ObjectInfo) (err error) {
+func (d *Device) copyFile(ctx context.Context, obj *objects.ObjectInfo) (err error) {
 	if obj == nil {
 		panic("Copy is called with nil object")
 	}
@@ -240,7 +258,7 @@ func (d *Device) Copy(obj *objects.ObjectInfo) (err error) {
 	}
 	defer stream.Release()
 
-	written, err := io.CopyBuffer(stream, from, make([]byte, bufsize))
+	written, err := io.CopyBuffer(stream, common.ContextReader(ctx, from), make([]byte, bufsize))
 	if err != nil {
 		var oleerr *ole.OleError
 		if errors.As(err, &oleerr) {
@@ -274,7 +292,94 @@ func (d *Device) Copy(obj *objects.ObjectInfo) (err error) {
 	return nil
 }
 
-func (d *Device) GetObjectInfos() (objects.ObjectInfoSet, error) {
+// hash reads object content from the device to calculate its hash.
+func (d *Device) hash(ctx context.Context, obj *objects.ObjectInfo) (hash string, err error) {
+	if obj == nil {
+		panic("Hash is called with nil object")
+	}
+
+	defer func(start time.Time) {
+		d.log.Debug("Executed action Hash", zap.String("actor", d.Name()), zap.Any("object", obj), zap.Duration("elapsed", time.Since(start)), zap.Error(err))
+	}(time.Now())
+
+	content, err := d.pdevice.Content()
+	if err != nil {
+		return "", fmt.Errorf("failed to get device Content: %w", err)
+	}
+	defer content.Release()
+
+	resources, err := content.Transfer()
+	if err != nil {
+		return "", fmt.Errorf("failed to get device Resources: %w", err)
+	}
+	defer resources.Release()
+
+	stream, bufsize, err := resources.GetStream(obj.Oid, WPD_RESOURCE_DEFAULT, STGM_READ)
+	if err != nil {
+		return "", fmt.Errorf("failed to open stream for '%s': %w", obj.FullPath, err)
+	}
+	defer stream.Release()
+
+	if bufsize <= 0 {
+		bufsize = 256 * 1024
+	}
+	if hash, err = common.HashContent(ctx, stream, make([]byte, bufsize)); err != nil {
+		return "", fmt.Errorf("failed to read '%s': %w", obj.FullPath, err)
+	}
+	return hash, nil
+}
+
+// move moves object "obj.Oid" to the folder of "obj.FullPath", renaming objects is not supported.
+func (d *Device) move(ctx context.Context, obj *objects.ObjectInfo) (err error) {
+	if obj == nil {
+		panic("Move is called with nil object")
+	}
+	if path.Base(obj.FullPath) != obj.Name {
+		return fmt.Errorf("unable to move '%s' to '%s', renaming is not supported", obj.ObjectName, obj.FullPath)
+	}
+	parent := obj.OIS.Find(path.Dir(obj.FullPath))
+	if parent == nil {
+		return fmt.Errorf("parent object not found for '%s'", obj.FullPath)
+	}
+	obj.OidParent = parent.Oid
+
+	defer func(start time.Time) {
+		d.log.Debug("Executed action Move", zap.String("actor", d.Name()), zap.Any("object", obj), zap.Duration("elapsed", time.Since(start)), zap.Error(err))
+	}(time.Now())
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	ids, err := CreatePortableDevicePropVariantCollection()
+	if err != nil {
+		return err
+	}
+	defer ids.Release()
+
+	pv, err := NewPropVariantFromUTF16(obj.Oid)
+	if err != nil {
+		return fmt.Errorf("failed to create PROPVARIANT from string '%s': %w", obj.Oid.String(), err)
+	}
+	defer pv.Clear()
+
+	if err := ids.Add(pv); err != nil {
+		return fmt.Errorf("failed to Add PROPVARIANT to collection: %w", err)
+	}
+
+	content, err := d.pdevice.Content()
+	if err != nil {
+		return fmt.Errorf("failed to get device Content: %w", err)
+	}
+	defer content.Release()
+
+	if err := content.Move(ids, obj.OidParent); err != nil {
+		return fmt.Errorf("failed to Move object '%s' to '%s': %w", obj.Oid, obj.FullPath, err)
+	}
+	return nil
+}
+
+func (d *Device) getObjectInfos(ctx context.Context) (objects.ObjectInfoSet, error) {
 	content, err := d.pdevice.Content()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get device Content: %w", err)
@@ -325,7 +430,10 @@ func (d *Device) GetObjectInfos() (objects.ObjectInfoSet, error) {
 		}
 	}
 
-	infos := d.enumerateObjects(WPD_DEVICE_OBJECT_ID, "", content, properties, keysCommon, keysObjects, make([]*objects.ObjectInfo, 0))
+	infos := d.enumerateObjects(ctx, WPD_DEVICE_OBJECT_ID, "", content, properties, keysCommon, keysObjects, make([]*objects.ObjectInfo, 0))
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
 	// index the results by full path, loosing target directories
 	oset := objects.New()
@@ -337,7 +445,49 @@ func (d *Device) GetObjectInfos() (objects.ObjectInfoSet, error) {
 
 // implementation
 
+// HRESULTs of failures caused by device going away or not responding, they may go away after device is re-opened.
+var transientCodes = []uintptr{
+	hresultFromWin32(windows.ERROR_GEN_FAILURE),
+	hresultFromWin32(windows.ERROR_SEM_TIMEOUT),
+	hresultFromWin32(windows.ERROR_NOT_READY),
+	hresultFromWin32(windows.ERROR_BUSY),
+	hresultFromWin32(windows.ERROR_IO_DEVICE),
+	hresultFromWin32(windows.ERROR_DEVICE_NOT_CONNECTED),
+	uintptr(windows.STG_E_WRITEFAULT),
+	0x802A0002, // E_WPD_DEVICE_NOT_OPEN
+}
+
+func hresultFromWin32(e windows.Errno) uintptr {
+	return uintptr(e)&0xFFFF | 0x80070000
+}
+
+func deviceLost(err error) bool {
+	var oleerr *ole.OleError
+	return errors.As(err, &oleerr) && slices.Contains(transientCodes, oleerr.Code())
+}
+
+// reopen releases device and opens it again using the same serial number.
+func (d *Device) reopen() (err error) {
+	if d.pdevice != nil {
+		d.pdevice.Release()
+		d.pdevice = nil
+	}
+	if d.id, err = pickDevice(d.pdmanager, d.id.Serial(), d.log); err != nil {
+		return fmt.Errorf("unable to re-open device: %w", err)
+	}
+	if d.pdevice, err = CreatePortableDevice(); err != nil {
+		return err
+	}
+	if err = d.pdevice.Open(d.id, d.clientInfo); err != nil {
+		d.pdevice.Release()
+		d.pdevice = nil
+		return fmt.Errorf("failed to Open device '%s': %w", d.id, err)
+	}
+	return nil
+}
+
 func (d *Device) enumerateObjects(
+	ctx context.Context,
 	id objects.ObjectID, root string,
 	content *IPortableDeviceContent,
 	properties *IPortableDeviceProperties,
@@ -388,13 +538,13 @@ func (d *Device) enumerateObjects(
 		return infos
 	}
 
-	for {
+	for ctx.Err() == nil {
 		oids, err := objects.Next(1)
 		if err != nil {
 			break
 		}
 		for _, oid := range oids {
-			infos = d.enumerateObjects(oid, fullPath, content, properties, keysCommon, keysObjects, infos)
+			infos = d.enumerateObjects(ctx, oid, fullPath, content, properties, keysCommon, keysObjects, infos)
 		}
 	}
 	return infos
@@ -20,6 +20,15 @@ func (v *IPortableDeviceContent) Properties() (ipdp *IPortableDeviceProperties,
 	return
 }
 
+func (v *IPortableDeviceContent) Transfer() (ipdr *IPortableDeviceResources, err error) {
+	hr, _, _ := syscall.SyscallN(v.VTable().Transfer, uintptr(unsafe.Pointer(v)),
+		uintptr(unsafe.Pointer(&ipdr)))
+	if hr != 0 {
+		err = ole.NewError(hr)
+	}
+	return
+}
+
 func (v *IPortableDeviceContent) EnumObjects(flags uint32, parent objects.ObjectID, filter *IPortableDeviceValues) (ipe *IEnumPortableDeviceObjectIDs, err error) {
 	hr, _, _ := syscall.SyscallN(v.VTable().EnumObjects, uintptr(unsafe.Pointer(v)),
 		uintptr(flags), uintptr(unsafe.Pointer(&parent[0])), uintptr(unsafe.Pointer(filter)),
@@ -76,3 +85,12 @@ func (v *IPortableDeviceContent) Delete(options DeleteObjectOptions, objectIDs *
 	}
 	return nil
 }
+
+func (v *IPortableDeviceContent) Move(objectIDs *IPortableDevicePropVariantCollection, destination objects.ObjectID) error {
+	hr, _, _ := syscall.SyscallN(v.VTable().Move, uintptr(unsafe.Pointer(v)),
+		uintptr(unsafe.Pointer(objectIDs)), uintptr(unsafe.Pointer(&destination[0])), 0)
+	if hr != 0 {
+		return ole.NewError(hr)
+	}
+	return nil
+}
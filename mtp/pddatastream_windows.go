@@ -1,6 +1,7 @@
 package mtp
 
 import (
+	"io"
 	"syscall"
 	"unsafe"
 
@@ -10,6 +11,24 @@ import (
 	"sync2kindle/objects"
 )
 
+// implements io.Reader interface
+func (v *IPortableDeviceDataStream) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	var pcbRead uint32
+	hr, _, _ := syscall.SyscallN(v.VTable().Read, uintptr(unsafe.Pointer(v)),
+		uintptr(unsafe.Pointer(&p[0])), uintptr(uint32(len(p))), uintptr(unsafe.Pointer(&pcbRead)))
+	// S_FALSE is returned when less than requested has been read
+	if hr != 0 && hr != 1 {
+		return 0, ole.NewError(hr)
+	}
+	if pcbRead == 0 {
+		return 0, io.EOF
+	}
+	return int(pcbRead), nil
+}
+
 // implements io.Writer interface
 func (v *IPortableDeviceDataStream) Write(p []byte) (int, error) {
 	var pcbWritten uint32
@@ -0,0 +1,67 @@
+package mtp
+
+import (
+	"unsafe"
+
+	ole "github.com/go-ole/go-ole"
+)
+
+type IPortableDeviceResources struct {
+	ole.IUnknown
+}
+
+type IPortableDeviceResourcesVtbl struct {
+	ole.IUnknownVtbl
+	GetSupportedResources uintptr
+	GetResourceAttributes uintptr
+	GetStream             uintptr
+	Delete                uintptr
+	Cancel                uintptr
+	CreateResource        uintptr
+}
+
+func (v *IPortableDeviceResources) VTable() *IPortableDeviceResourcesVtbl {
+	return (*IPortableDeviceResourcesVtbl)(unsafe.Pointer(v.RawVTable))
+}
+
+// WINSDK\um\PortableDeviceApi.idl
+//---------------------------------------------------------
+// This interface is used to transfer resource data (such
+// as object content) to and from the device.
+//---------------------------------------------------------
+// [
+//     object,
+//     uuid(fd8878ac-d841-4d17-891c-e6829cdb6934),
+//     helpstring("IPortableDeviceResources Interface"),
+//     pointer_default(unique)
+// ]
+// interface IPortableDeviceResources : IUnknown
+// {
+//     HRESULT GetSupportedResources(
+//         [in]  LPCWSTR                         pszObjectID,
+//         [out] IPortableDeviceKeyCollection**  ppKeys);
+//
+//     HRESULT GetResourceAttributes(
+//         [in]  LPCWSTR                         pszObjectID,
+//         [in]  REFPROPERTYKEY                  Key,
+//         [out] IPortableDeviceValues**         ppResourceAttributes);
+//
+//     HRESULT GetStream(
+//         [in]                LPCWSTR           pszObjectID,
+//         [in]                REFPROPERTYKEY    Key,
+//         [in]                const DWORD       dwMode,
+//         [in, out, unique]   DWORD*            pdwOptimalBufferSize,
+//         [out]               IStream**         ppStream);
+//
+//     HRESULT Delete(
+//         [in] LPCWSTR                          pszObjectID,
+//         [in] IPortableDeviceKeyCollection*    pKeys);
+//
+//     HRESULT Cancel();
+//
+//     HRESULT CreateResource(
+//         [in]                IPortableDeviceValues*  pResourceAttributes,
+//         [out]               IStream**               ppData,
+//         [in, out, unique]   DWORD*                  pdwOptimalWriteBufferSize,
+//         [in, out, unique]   LPWSTR*                 ppszCookie);
+// };
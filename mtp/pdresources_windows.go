@@ -0,0 +1,38 @@
+package mtp
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	ole "github.com/go-ole/go-ole"
+
+	"sync2kindle/objects"
+)
+
+// stream access modes
+const (
+	STGM_READ      uint32 = 0x00000000
+	STGM_WRITE     uint32 = 0x00000001
+	STGM_READWRITE uint32 = 0x00000002
+)
+
+func (v *IPortableDeviceResources) GetStream(oid objects.ObjectID, key *PropertyKey, mode uint32) (*IPortableDeviceDataStream, int, error) {
+	var (
+		bufsize uint32
+		unk     *ole.IUnknown
+		stream  *IPortableDeviceDataStream
+	)
+	hr, _, _ := syscall.SyscallN(v.VTable().GetStream, uintptr(unsafe.Pointer(v)),
+		uintptr(unsafe.Pointer(&oid[0])), uintptr(unsafe.Pointer(key)), uintptr(mode),
+		uintptr(unsafe.Pointer(&bufsize)), uintptr(unsafe.Pointer(&unk)))
+	if hr != 0 {
+		return nil, 0, ole.NewError(hr)
+	}
+	defer unk.Release()
+
+	if err := unk.PutQueryInterface(ole.NewGUID("88e04db3-1012-4d64-9996-f703a950d3f4"), &stream); err != nil {
+		return nil, 0, fmt.Errorf("failed to get IPortableDeviceDataStream: %w", err)
+	}
+	return stream, int(bufsize), nil
+}
@@ -0,0 +1,19 @@
+package mtp
+
+// #include <stdint.h>
+import "C"
+
+import (
+	"context"
+	"runtime/cgo"
+)
+
+// transferProgress is called by libmtp during file transfers, non zero result cancels the transfer.
+//
+//export transferProgress
+func transferProgress(handle C.uintptr_t) C.int {
+	if ctx, ok := cgo.Handle(handle).Value().(context.Context); ok && ctx.Err() != nil {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,158 @@
+//go:build !darwin
+
+package mtp
+
+import (
+	"context"
+	"errors"
+
+	"go.uber.org/zap"
+
+	"sync2kindle/common"
+	"sync2kindle/objects"
+)
+
+// Kindles drop off the bus during long transfers or when screen goes to sleep. Every driver operation failed with
+// transient error is repeated according to the retry policy, device is re-opened by serial number before the next
+// attempt and object ids (which could change after reconnect) are refreshed.
+
+// isTransient reports if operation failed because device went away or stopped responding.
+func isTransient(err error) bool {
+	return errors.Is(err, common.ErrNoDevice) || deviceLost(err)
+}
+
+// driver interface
+
+func (d *Device) MkDir(ctx context.Context, obj *objects.ObjectInfo) error {
+	return d.withRetry(ctx, obj, d.mkDir, func(fresh objects.ObjectInfoSet) (bool, error) {
+		// folder may have been created before connection was lost
+		if o := fresh.Find(obj.FullPath); o != nil && o.Dir {
+			obj.Oid = o.Oid
+			return true, nil
+		}
+		return false, nil
+	})
+}
+
+func (d *Device) Remove(ctx context.Context, obj *objects.ObjectInfo) error {
+	return d.withRetry(ctx, obj, d.remove, func(fresh objects.ObjectInfoSet) (bool, error) {
+		o := fresh.Find(obj.FullPath)
+		if o == nil {
+			// object may have been removed before connection was lost
+			return true, nil
+		}
+		obj.Oid = o.Oid
+		return false, nil
+	})
+}
+
+func (d *Device) Copy(ctx context.Context, obj *objects.ObjectInfo) error {
+	return d.withRetry(ctx, obj, d.copyFile, func(fresh objects.ObjectInfoSet) (bool, error) {
+		// we cannot tell if transfer was complete, so object left from the failed attempt is removed
+		if o := fresh.Find(obj.FullPath); o != nil && !o.Dir {
+			if err := d.remove(ctx, o); err != nil {
+				return false, err
+			}
+		}
+		return false, nil
+	})
+}
+
+func (d *Device) Move(ctx context.Context, obj *objects.ObjectInfo) error {
+	return d.withRetry(ctx, obj, d.move, func(fresh objects.ObjectInfoSet) (bool, error) {
+		// ObjectName keeps original path of the object
+		if o := fresh.Find(obj.ObjectName); o != nil {
+			obj.Oid = o.Oid
+			return false, nil
+		}
+		if o := fresh.Find(obj.FullPath); o != nil {
+			// object may have been moved before connection was lost
+			obj.Oid = o.Oid
+			return true, nil
+		}
+		return false, errors.New("object to move is not found on device after reconnect")
+	})
+}
+
+func (d *Device) Hash(ctx context.Context, obj *objects.ObjectInfo) (hash string, err error) {
+	err = d.withRetry(ctx, obj, func(ctx context.Context, obj *objects.ObjectInfo) (err error) {
+		hash, err = d.hash(ctx, obj)
+		return err
+	}, func(fresh objects.ObjectInfoSet) (bool, error) {
+		o := fresh.Find(obj.FullPath)
+		if o == nil {
+			return false, errors.New("object to hash is not found on device after reconnect")
+		}
+		obj.Oid = o.Oid
+		return false, nil
+	})
+	return
+}
+
+func (d *Device) GetObjectInfos(ctx context.Context) (oset objects.ObjectInfoSet, err error) {
+	err = common.Retry(ctx, d.retry, func(int) error {
+		if _, err := d.recover(ctx); err != nil {
+			return err
+		}
+		oset, err = d.getObjectInfos(ctx)
+		d.stale = isTransient(err)
+		return err
+	}, isTransient, d.log)
+	return
+}
+
+// implementation
+
+// withRetry executes driver operation "op" on "obj" repeating it after transient failures. After device is re-opened
+// "settled" checks fresh device objects and reports if interrupted operation has been completed anyway.
+func (d *Device) withRetry(ctx context.Context, obj *objects.ObjectInfo,
+	op func(context.Context, *objects.ObjectInfo) error,
+	settled func(objects.ObjectInfoSet) (bool, error)) error {
+
+	return common.Retry(ctx, d.retry, func(int) error {
+		fresh, err := d.recover(ctx)
+		if err != nil {
+			return err
+		}
+		if fresh != nil {
+			refreshOids(obj.OIS, fresh)
+			if done, err := settled(fresh); err != nil || done {
+				d.stale = isTransient(err)
+				return err
+			}
+		}
+		err = op(ctx, obj)
+		d.stale = isTransient(err)
+		return err
+	}, isTransient, d.log)
+}
+
+// recover re-opens device after transient failure and returns its current objects, nothing is done (and nil set is
+// returned) when device is in good standing.
+func (d *Device) recover(ctx context.Context) (objects.ObjectInfoSet, error) {
+	if !d.stale {
+		return nil, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	d.log.Info("Reconnecting to device", zap.String("serial", d.UniqueID()))
+	if err := d.reopen(); err != nil {
+		return nil, err
+	}
+	fresh, err := d.getObjectInfos(ctx)
+	if err != nil {
+		return nil, err
+	}
+	d.stale = false
+	return fresh, nil
+}
+
+// refreshOids updates object ids in the set planned actions refer to, objects not yet created are left alone.
+func refreshOids(set, fresh objects.ObjectInfoSet) {
+	for k, o := range set {
+		if f := fresh.Find(k); f != nil {
+			o.Oid, o.OidParent = f.Oid, f.OidParent
+		}
+	}
+}
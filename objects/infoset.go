@@ -29,6 +29,18 @@ type ObjectInfo struct {
 	// file system and history drivers.
 	ThumbName string `json:"thumb_name,omitempty"`
 
+	// content hash of user supplied cover found next to the book, thumbnail is made of it instead of the cover
+	// embedded in the book. Changed cover means new thumbnail for the book.
+	CoverID string `json:"cover_id,omitempty"`
+
+	// books could be routed to different folders on the device, history keeps
+	// resolved device path for every book, so we know where to look for it later.
+	DevicePath string `json:"device_path,omitempty"`
+
+	// books sent from outside of the source by "send --manage" are recorded in history keyed by their device path,
+	// sync keeps them as they are and never removes them from the device.
+	External bool `json:"external,omitempty"`
+
 	// this part is needed by actions which create objects on MTP devices
 	// at the time when action is being created we do not know actual object properties
 	// including parent object id, creation of parent may be requested by another action...
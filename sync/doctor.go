@@ -0,0 +1,394 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	cli "github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+
+	"sync2kindle/common"
+	"sync2kindle/config"
+	"sync2kindle/files"
+	"sync2kindle/objects"
+	"sync2kindle/state"
+)
+
+// Problems doctor reports.
+const (
+	problemUnmanaged   = "unmanaged book"         // case #2, book on the device history does not know about
+	problemStale       = "stale history"          // case #5, book is gone both locally and from the device
+	problemEmpty       = "empty book"             // device copy has zero size
+	problemSize        = "size mismatch"          // device copy size differs from what was sent
+	problemOrphanIndex = "orphaned page index"    // .apnx file without its book
+	problemOrphanSdr   = "orphaned .sdr"          // .sdr folder without its book
+	problemThumb       = "unreferenced thumbnail" // thumbnail we sent for a book which is gone
+)
+
+// problem is a single inconsistency between local source, history and device. Problem could only be fixed when
+// offending artifacts have been created by sync, anything else is reported and left alone.
+type problem struct {
+	channel string
+	kind    string
+	path    string
+	detail  string
+	remove  []*objects.ObjectInfo // device objects to remove, in order
+	forget  []string              // history keys to drop
+	fixed   bool
+}
+
+func (p *problem) fixable() bool {
+	return len(p.remove) > 0 || len(p.forget) > 0
+}
+
+// RunDoctor cross-checks local source, history and device for target and content channels from configuration and
+// reports problems, with "fix" flag artifacts created by sync itself are cleaned up.
+func RunDoctor(ctx *cli.Context) error {
+	env := ctx.Generic(state.FlagName).(*state.LocalEnv)
+	log := env.Log.Named("doctor")
+
+	protocol, err := common.ParseProtocol(ctx.String("protocol"))
+	if err != nil {
+		return err
+	}
+	if protocol == common.ProtocolMail {
+		return errors.New("device content is not accessible with e-mail delivery, nothing to check")
+	}
+	fix := ctx.Bool("fix")
+
+	log.Info("Doctor starting", zap.Stringer("protocol", protocol), zap.String("source", env.Cfg.SourcePath), zap.String("target", env.Cfg.TargetPath), zap.Bool("fix", fix))
+	defer func(start time.Time) {
+		log.Info("Doctor finished", zap.Stringer("protocol", protocol), zap.Duration("elapsed", time.Since(start)))
+	}(time.Now())
+
+	jobs := prepareJobs(env.Cfg, protocol, false, log)
+
+	lock, err := lockDevice(ctx, protocol, env.Cfg, log)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	dev, err := connectDevice(ctx, protocol, devicePaths(jobs), env)
+	if err != nil {
+		return fmt.Errorf("unable to connect to device: %w", err)
+	}
+	defer dev.Disconnect()
+
+	dstOIS, err := dev.GetObjectInfos(ctx.Context)
+	if err != nil {
+		return fmt.Errorf("unable to get files on the device: %w", err)
+	}
+
+	// thumbnails are shared by all targets on the device, including ones not in configuration
+	refs, err := deviceThumbRefs(env.Cfg.HistoryPath, dev.UniqueID(), "", log)
+	if err != nil {
+		return err
+	}
+
+	var problems []problem
+	for _, j := range jobs {
+		jp, err := checkJob(ctx, j, protocol, dev, dstOIS, fix, log)
+		if err != nil {
+			if len(j.name) == 0 {
+				return err
+			}
+			return fmt.Errorf("channel '%s': %w", j.name, err)
+		}
+		problems = append(problems, jp...)
+	}
+
+	tp := diagnoseThumbs(env.Cfg, dstOIS, refs)
+	if fix {
+		fixProblems(ctx.Context, tp, dev, log)
+	}
+	problems = append(problems, tp...)
+
+	return printProblems(ctx.App.Writer, problems, fix)
+}
+
+func checkJob(ctx *cli.Context, j job, protocol common.SupportedProtocols, dev driver, dstOIS objects.ObjectInfoSet, fix bool, log *zap.Logger) ([]problem, error) {
+	if len(j.name) > 0 {
+		log = log.With(zap.String("channel", j.name))
+	}
+
+	hst, hstOIS, release, err := openJobHistory(ctx, j, protocol, dev, log)
+	if err != nil || hst == nil {
+		return nil, err
+	}
+	defer release()
+
+	src, err := files.Connect(j.cfg.SourcePath, "", nil, log)
+	if err != nil {
+		return nil, fmt.Errorf("bad source path: %w", err)
+	}
+	defer src.Disconnect()
+
+	srcOIS, err := src.GetObjectInfos(ctx.Context)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get source files: %w", err)
+	}
+
+	keys, _, err := hst.Recorded()
+	if err != nil {
+		return nil, err
+	}
+
+	problems, err := diagnose(j.cfg, srcOIS.SubsetByPath(j.cfg.SourcePath), hstOIS, dstOIS, keys)
+	if err != nil {
+		return nil, err
+	}
+	for i := range problems {
+		problems[i].channel = j.name
+	}
+	if !fix {
+		return problems, nil
+	}
+
+	forget := fixProblems(ctx.Context, problems, dev, log)
+	if len(forget) == 0 {
+		return problems, nil
+	}
+	ois := hstOIS.Clone()
+	for _, key := range forget {
+		delete(ois, key)
+	}
+	if err := hst.SaveObjectInfos(j.cfg.LibraryID(), j.cfg.TargetPath, ois); err != nil {
+		return nil, fmt.Errorf("history objects cannot be saved: %w", err)
+	}
+	log.Info("History updated", zap.Int("forgotten", len(forget)), zap.Int64("stepID", hst.StepID()))
+	return problems, nil
+}
+
+// diagnose compares local books (keyed relative to the source), history and device objects for a single target.
+// "recorded" has keys of all objects history ever knew about, artifacts of these books are considered ours.
+func diagnose(cfg *config.Config, local, hstOIS, dstOIS objects.ObjectInfoSet, recorded map[string]bool) ([]problem, error) {
+	rt, err := newRouter(cfg)
+	if err != nil {
+		return nil, err
+	}
+	isBook := func(_ string, v *objects.ObjectInfo) bool {
+		return !v.Dir && slices.Contains(cfg.BookExtensions, path.Ext(v.Name))
+	}
+	localBooks := local.SubsetByFunc(isBook)
+	historyBooks := hstOIS.SubsetByFunc(isBook)
+
+	var problems []problem
+
+	// books history knows about
+	claimed := make(map[string]bool, len(historyBooks))
+	for _, key := range slices.Sorted(maps.Keys(historyBooks)) {
+		hobj := historyBooks[key]
+		devPath := hobj.DevicePath
+		if len(devPath) == 0 {
+			devPath = path.Join(cfg.TargetPath, key)
+		}
+		claimed[devPath] = true
+
+		lobj, dobj := localBooks[key], dstOIS.Find(devPath)
+		if dobj == nil || dobj.Dir {
+			if lobj == nil {
+				forget := []string{key}
+				for _, p := range getSupplementalArtifactsPaths(key) {
+					if _, exists := hstOIS[p]; exists {
+						forget = append(forget, p)
+					}
+				}
+				problems = append(problems, problem{kind: problemStale, path: key, detail: "gone both locally and from the device", forget: forget})
+			}
+			continue
+		}
+
+		p := problem{path: devPath}
+		switch {
+		case dobj.ObjSize == 0:
+			p.kind, p.detail = problemEmpty, "device copy has no content"
+		case dobj.ObjSize != hobj.ObjSize && (lobj == nil || lobj.PersistentID == hobj.PersistentID):
+			p.kind, p.detail = problemSize, fmt.Sprintf("device copy has %d bytes, %d were sent", dobj.ObjSize, hobj.ObjSize)
+		default:
+			continue
+		}
+		if lobj != nil {
+			// broken copy is removed and forgotten, so the next sync sends it again
+			p.remove, p.forget = []*objects.ObjectInfo{dobj}, []string{key}
+			p.detail += ", it will be sent again"
+		}
+		problems = append(problems, p)
+	}
+
+	roots := []string{cfg.TargetPath}
+	for _, r := range cfg.Routes {
+		if !slices.Contains(roots, r.TargetPath) {
+			roots = append(roots, r.TargetPath)
+		}
+	}
+	underRoots := func(p string) bool {
+		return slices.ContainsFunc(roots, func(r string) bool {
+			_, ok := cutRoot(p, r)
+			return ok
+		})
+	}
+	// bookFor checks device for book "base" in folder "dir" and reports if such book was ever sent by sync
+	bookFor := func(dir, base string) (exists, ours bool) {
+		for _, ext := range cfg.BookExtensions {
+			p := path.Join(dir, base+ext)
+			if o := dstOIS.Find(p); o != nil && !o.Dir {
+				exists = true
+			}
+			if key, ok := rt.toLocal(p); ok && recorded[key] {
+				ours = true
+			}
+		}
+		return
+	}
+
+	var sdrs []problem
+	for _, devPath := range slices.Sorted(maps.Keys(dstOIS)) {
+		dobj := dstOIS[devPath]
+		if !underRoots(devPath) {
+			continue
+		}
+		dir, name := path.Dir(devPath), path.Base(devPath)
+		switch {
+		case !dobj.Dir && slices.Contains(cfg.BookExtensions, path.Ext(name)):
+			// case #2
+			if key, ok := rt.toLocal(devPath); ok && !claimed[devPath] {
+				if _, exists := localBooks[key]; !exists {
+					problems = append(problems, problem{kind: problemUnmanaged, path: devPath, detail: "not known to history, left alone"})
+				}
+			}
+		case !dobj.Dir && path.Ext(name) == ".apnx":
+			bookDir := dir
+			if path.Ext(dir) == ".sdr" {
+				bookDir = path.Dir(dir)
+			}
+			exists, ours := bookFor(bookDir, strings.TrimSuffix(name, ".apnx"))
+			if exists {
+				continue
+			}
+			p := problem{kind: problemOrphanIndex, path: devPath, detail: "book is gone"}
+			if ours {
+				p.remove = []*objects.ObjectInfo{dobj}
+			} else {
+				p.detail += ", not sent by sync"
+			}
+			problems = append(problems, p)
+		case dobj.Dir && path.Ext(name) == ".sdr":
+			exists, ours := bookFor(dir, strings.TrimSuffix(name, ".sdr"))
+			if exists {
+				continue
+			}
+			p := problem{kind: problemOrphanSdr, path: devPath, detail: "book is gone"}
+			// folder is ours only when it has nothing but our page indexes, which are removed before it
+			onlyIndexes := true
+			for _, c := range dstOIS.SubsetByPath(devPath) {
+				if c.Dir || path.Ext(c.Name) != ".apnx" {
+					onlyIndexes = false
+					break
+				}
+			}
+			switch {
+			case ours && onlyIndexes:
+				p.remove = []*objects.ObjectInfo{dobj}
+			case ours:
+				p.detail += ", has reading data created by device"
+			default:
+				p.detail += ", not created by sync"
+			}
+			sdrs = append(sdrs, p)
+		}
+	}
+	return append(problems, sdrs...), nil
+}
+
+// diagnoseThumbs finds thumbnails sync has sent for books which are gone. Thumbnails device created itself are
+// never reported.
+func diagnoseThumbs(cfg *config.Config, dstOIS objects.ObjectInfoSet, refs *thumbRefs) []problem {
+	var problems []problem
+	for _, devPath := range slices.Sorted(maps.Keys(dstOIS)) {
+		dobj := dstOIS[devPath]
+		name, ok := cutRoot(devPath, common.ThumbnailFolder)
+		if !ok || dobj.Dir || strings.Contains(name, "/") || !slices.Contains(cfg.ThumbExtensions, path.Ext(name)) {
+			continue
+		}
+		if refs.inUse(name) || !refs.recorded[name] {
+			continue
+		}
+		problems = append(problems, problem{kind: problemThumb, path: devPath, detail: "book is gone", remove: []*objects.ObjectInfo{dobj}})
+	}
+	return problems
+}
+
+// fixProblems removes device artifacts of fixable problems and returns history keys to be forgotten. Problem is not
+// fixed when any of its removals fails.
+func fixProblems(ctx context.Context, problems []problem, dev driver, log *zap.Logger) []string {
+	var forget []string
+	for i := range problems {
+		p := &problems[i]
+		if !p.fixable() || ctx.Err() != nil {
+			continue
+		}
+		log.Info("Fixing", zap.String("problem", p.kind), zap.String("path", p.path))
+		failed := false
+		for _, obj := range p.remove {
+			if err := dev.Remove(ctx, obj); err != nil {
+				log.Warn("Unable to fix", zap.String("problem", p.kind), zap.String("path", obj.FullPath), zap.Error(err))
+				failed = true
+				break
+			}
+		}
+		if failed {
+			continue
+		}
+		p.fixed = true
+		forget = append(forget, p.forget...)
+	}
+	return forget
+}
+
+func printProblems(out io.Writer, problems []problem, fix bool) error {
+	if len(problems) == 0 {
+		fmt.Fprintln(out, "No problems found")
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHANNEL\tPROBLEM\tPATH\tDETAILS\tFIX")
+	var fixable, fixed int
+	for _, p := range problems {
+		channel, status := p.channel, "-"
+		if len(channel) == 0 {
+			channel = "-"
+		}
+		if p.fixable() {
+			fixable++
+			switch {
+			case !fix:
+				status = "available"
+			case p.fixed:
+				fixed++
+				status = "fixed"
+			default:
+				status = "failed"
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", channel, p.kind, p.path, p.detail, status)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if fix {
+		fmt.Fprintf(out, "%d problems found, %d fixed\n", len(problems), fixed)
+	} else {
+		fmt.Fprintf(out, "%d problems found, %d could be fixed with --fix\n", len(problems), fixable)
+	}
+	return nil
+}
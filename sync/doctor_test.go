@@ -0,0 +1,104 @@
+package sync
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+
+	"sync2kindle/config"
+	"sync2kindle/objects"
+)
+
+func TestDiagnose(t *testing.T) {
+	cfg := &config.Config{TargetPath: "documents/mybooks", BookExtensions: []string{".azw3"}, ThumbExtensions: []string{".jpg"}}
+
+	book := func(name, id string, size int64) *objects.ObjectInfo {
+		return &objects.ObjectInfo{Name: name, File: true, PersistentID: id, ObjSize: size}
+	}
+	dir := func(name string) *objects.ObjectInfo {
+		return &objects.ObjectInfo{Name: name, Dir: true}
+	}
+	local := objects.ObjectInfoSet{
+		"a.azw3": book("a.azw3", "a", 10),
+		"c.azw3": book("c.azw3", "c", 10),
+		"d.azw3": book("d.azw3", "d2", 12),
+	}
+	hst := objects.ObjectInfoSet{
+		"a.azw3": book("a.azw3", "a", 10),
+		"b.azw3": book("b.azw3", "b", 10),
+		"b.apnx": book("b.apnx", "", 1),
+		"c.azw3": book("c.azw3", "c", 10),
+		"d.azw3": book("d.azw3", "d", 10),
+		"e.azw3": book("e.azw3", "e", 10),
+	}
+	hst["a.azw3"].ThumbName = "t1.jpg"
+	dst := objects.ObjectInfoSet{
+		"documents/mybooks":                   dir("mybooks"),
+		"documents/mybooks/a.azw3":            book("a.azw3", "", 10),
+		"documents/mybooks/a.sdr":             dir("a.sdr"),
+		"documents/mybooks/c.azw3":            book("c.azw3", "", 0),
+		"documents/mybooks/d.azw3":            book("d.azw3", "", 11),
+		"documents/mybooks/e.azw3":            book("e.azw3", "", 10),
+		"documents/mybooks/x.azw3":            book("x.azw3", "", 5),
+		"documents/mybooks/foreign.apnx":      book("foreign.apnx", "", 1),
+		"documents/mybooks/old.apnx":          book("old.apnx", "", 1),
+		"documents/mybooks/old.sdr":           dir("old.sdr"),
+		"documents/mybooks/old.sdr/old.apnx":  book("old.apnx", "", 1),
+		"documents/mybooks/gone.sdr":          dir("gone.sdr"),
+		"documents/mybooks/gone.sdr/gone.yjr": book("gone.yjr", "", 1),
+		"system/thumbnails":                   dir("thumbnails"),
+		"system/thumbnails/t1.jpg":            book("t1.jpg", "", 1),
+		"system/thumbnails/t2.jpg":            book("t2.jpg", "", 1),
+		"system/thumbnails/t3.jpg":            book("t3.jpg", "", 1),
+	}
+	for k, v := range dst {
+		v.FullPath = k
+	}
+	recorded := map[string]bool{"a.azw3": true, "b.azw3": true, "c.azw3": true, "d.azw3": true, "e.azw3": true, "old.azw3": true, "gone.azw3": true}
+
+	problems, err := diagnose(cfg, local, hst, dst, recorded)
+	if err != nil {
+		t.Fatalf("Unable to diagnose: %v", err)
+	}
+	expected := []struct {
+		kind, path string
+		fixable    bool
+	}{
+		{problemStale, "b.azw3", true},
+		{problemEmpty, "documents/mybooks/c.azw3", true},
+		{problemOrphanIndex, "documents/mybooks/foreign.apnx", false},
+		{problemOrphanIndex, "documents/mybooks/old.apnx", true},
+		{problemOrphanIndex, "documents/mybooks/old.sdr/old.apnx", true},
+		{problemUnmanaged, "documents/mybooks/x.azw3", false},
+		{problemOrphanSdr, "documents/mybooks/gone.sdr", false},
+		{problemOrphanSdr, "documents/mybooks/old.sdr", true},
+	}
+	if len(problems) != len(expected) {
+		t.Fatalf("Expected %d problems, got %d: %+v", len(expected), len(problems), problems)
+	}
+	for i, e := range expected {
+		if p := problems[i]; p.kind != e.kind || p.path != e.path || p.fixable() != e.fixable {
+			t.Fatalf("Problem %d: expected %+v, got %+v", i, e, p)
+		}
+	}
+
+	refs := thumbRefs{referenced: map[string]bool{"t1.jpg": true}, recorded: map[string]bool{"t1.jpg": true, "t2.jpg": true}}
+	thumbs := diagnoseThumbs(cfg, dst, &refs)
+	if len(thumbs) != 1 || thumbs[0].path != "system/thumbnails/t2.jpg" {
+		t.Fatalf("Unexpected thumbnail problems: %+v", thumbs)
+	}
+
+	log := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	dev := &testActor{name: "dst"}
+	forget := fixProblems(context.Background(), problems, dev, log)
+	slices.Sort(forget)
+	if !slices.Equal(forget, []string{"b.apnx", "b.azw3", "c.azw3"}) {
+		t.Fatalf("Unexpected keys to forget: %v", forget)
+	}
+	if dev.deletions != 4 {
+		t.Fatalf("Expected 4 removals, got %d", dev.deletions)
+	}
+}
@@ -0,0 +1,434 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	cli "github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+
+	"sync2kindle/common"
+	"sync2kindle/history"
+	"sync2kindle/objects"
+	"sync2kindle/state"
+)
+
+// RunMigrateTarget moves books synchronized to one target on the device to another, together with their page indexes
+// and reading data, and updates history accordingly, so the next sync has nothing to send.
+func RunMigrateTarget(ctx *cli.Context) error {
+	env := ctx.Generic(state.FlagName).(*state.LocalEnv)
+	log := env.Log.Named("migrate")
+
+	if ctx.Args().Len() != 2 {
+		return fmt.Errorf("both OLD and NEW targets have to be specified")
+	}
+	protocol, err := common.ParseProtocol(ctx.String("protocol"))
+	if err != nil {
+		return err
+	}
+	oldTarget, newTarget, err := checkTargets(protocol, ctx.Args().Get(0), ctx.Args().Get(1))
+	if err != nil {
+		return err
+	}
+
+	log.Info("Target migration starting",
+		zap.Stringer("protocol", protocol),
+		zap.String("from", oldTarget),
+		zap.String("to", newTarget),
+	)
+	defer func(start time.Time) {
+		log.Info("Target migration finished", zap.Stringer("protocol", protocol), zap.Duration("elapsed", time.Since(start)))
+	}(time.Now())
+
+	lock, err := lockDevice(ctx, protocol, env.Cfg, log)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	dev, err := connectDevice(ctx, protocol, []string{oldTarget, newTarget}, env)
+	if err != nil {
+		return fmt.Errorf("unable to connect to device: %w", err)
+	}
+	defer dev.Disconnect()
+
+	oldPath := filepath.Join(env.Cfg.HistoryPath, history.GetName(protocol, dev.UniqueID(), oldTarget))
+	newPath := filepath.Join(env.Cfg.HistoryPath, history.GetName(protocol, dev.UniqueID(), newTarget))
+	for _, p := range []string{oldPath, newPath} {
+		lock, err := history.Lock(p, ctx.Duration("wait"), log)
+		if err != nil {
+			return fmt.Errorf("history database cannot be used: %w", err)
+		}
+		defer lock.Release()
+	}
+
+	if _, err := os.Stat(oldPath); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("no history for target '%s' on this device", oldTarget)
+		}
+		return fmt.Errorf("history database '%s' cannot be accessed: %w", oldPath, err)
+	}
+	if _, err := os.Stat(newPath); err == nil {
+		return fmt.Errorf("history for target '%s' on this device already exists", newTarget)
+	}
+	log.Debug("History databases", zap.String("from", oldPath), zap.String("to", newPath))
+
+	dryRun := ctx.Bool("dry-run")
+
+	// there is nothing to move for e-mail delivery
+	if protocol != common.ProtocolMail {
+		hst, err := history.Connect(oldPath, log)
+		if err != nil {
+			return fmt.Errorf("history cannot be opened: %w", err)
+		}
+		hstOIS, err := hst.GetObjectInfos(ctx.Context)
+		hst.Disconnect()
+		if err != nil {
+			return fmt.Errorf("history objects cannot be read: %w", err)
+		}
+		dstOIS, err := dev.GetObjectInfos(ctx.Context)
+		if err != nil {
+			return fmt.Errorf("unable to get files on the device: %w", err)
+		}
+		actions, err := prepareMigrateActions(hstOIS, dstOIS, oldTarget, newTarget, dev, log)
+		if err != nil {
+			return err
+		}
+		if done, err := runActions(ctx.Context, actions, dryRun, log); err != nil {
+			if dryRun || done == 0 {
+				return err
+			}
+			return errors.Join(err, recordPartialMigration(ctx, hstOIS, oldPath, oldTarget, newTarget, dev, log))
+		}
+	}
+
+	if dryRun {
+		return nil
+	}
+
+	env.Rpt.StoreCopy("history/original.db", oldPath)
+	if err := history.MigrateTarget(oldPath, newPath, oldTarget, newTarget, log); err != nil {
+		return fmt.Errorf("unable to migrate history database '%s': %w", oldPath, err)
+	}
+	env.Rpt.Store("history/updated.db", newPath)
+
+	if env.Cfg.TargetPath == oldTarget {
+		log.Warn("Configuration still refers to the old target, update it before next sync", zap.String("target", oldTarget))
+	}
+	return nil
+}
+
+// recordPartialMigration records in the old history books interrupted target migration has already moved, so the
+// next sync finds them on the device instead of treating them as removed. Device is listed again, since actions could
+// fail halfway.
+func recordPartialMigration(ctx *cli.Context, hstOIS objects.ObjectInfoSet, oldPath, oldTarget, newTarget string, dev driver, log *zap.Logger) error {
+	dstOIS, err := dev.GetObjectInfos(context.WithoutCancel(ctx.Context))
+	if err != nil {
+		return fmt.Errorf("unable to get files on the device, history does not know about books already moved to '%s', move them back to '%s' before next sync: %w", newTarget, oldTarget, err)
+	}
+	moved := movedBooks(hstOIS, dstOIS, oldTarget, newTarget)
+	if len(moved) == 0 {
+		return nil
+	}
+	if err := history.RecordMoves(oldPath, moved, log); err != nil {
+		return fmt.Errorf("unable to record moved books in history, move them back from '%s' to '%s' before next sync: %w", newTarget, oldTarget, err)
+	}
+	log.Warn("Target migration interrupted, books already moved are recorded in history, run migration again to complete it or sync to move them back",
+		zap.Int("moved", len(moved)), zap.String("from", oldTarget), zap.String("to", newTarget))
+	return nil
+}
+
+// movedBooks returns new device paths of history objects which are under new target and no longer under old one.
+func movedBooks(hstOIS, dstOIS objects.ObjectInfoSet, oldTarget, newTarget string) map[string]string {
+	moved := make(map[string]string)
+	for key, hobj := range hstOIS {
+		if hobj.Dir {
+			continue
+		}
+		from := hobj.DevicePath
+		if len(from) == 0 {
+			from = path.Join(oldTarget, key)
+		}
+		rel, ok := cutRoot(from, oldTarget)
+		if !ok {
+			continue
+		}
+		to := path.Join(newTarget, rel)
+		if dstOIS.Find(from) == nil && dstOIS.Find(to) != nil {
+			moved[key] = to
+		}
+	}
+	return moved
+}
+
+// checkTargets makes sure that both targets are usable for the protocol and returns them in the form used by
+// configuration.
+func checkTargets(protocol common.SupportedProtocols, oldTarget, newTarget string) (string, string, error) {
+	if protocol == common.ProtocolMail {
+		if !strings.Contains(oldTarget, "@") || !strings.Contains(newTarget, "@") {
+			return "", "", fmt.Errorf("targets have to be e-mail addresses")
+		}
+		if oldTarget == newTarget {
+			return "", "", fmt.Errorf("targets are the same")
+		}
+		return oldTarget, newTarget, nil
+	}
+	targets := []string{oldTarget, newTarget}
+	for i, t := range targets {
+		t = path.Clean(filepath.ToSlash(t))
+		if path.IsAbs(t) || t == "." || strings.HasPrefix(t, "../") || strings.Contains(t, "@") {
+			return "", "", fmt.Errorf("bad target '%s', must be relative path on the device", targets[i])
+		}
+		if t == common.ThumbnailFolder || strings.HasPrefix(t, common.ThumbnailFolder+"/") {
+			return "", "", fmt.Errorf("bad target '%s', overlaps with thumbnails", targets[i])
+		}
+		targets[i] = t
+	}
+	if oldTarget, newTarget = targets[0], targets[1]; oldTarget == newTarget {
+		return "", "", fmt.Errorf("targets are the same")
+	}
+	if _, ok := cutRoot(newTarget, oldTarget); ok {
+		return "", "", fmt.Errorf("new target '%s' is inside old target '%s'", newTarget, oldTarget)
+	}
+	if _, ok := cutRoot(oldTarget, newTarget); ok {
+		return "", "", fmt.Errorf("old target '%s' is inside new target '%s'", oldTarget, newTarget)
+	}
+	return oldTarget, newTarget, nil
+}
+
+// prepareMigrateActions creates actions to move everything history knows under old target to the new one. Page index
+// files and reading data (.sdr folders) follow their books, folders left empty are removed.
+func prepareMigrateActions(hstOIS, dstOIS objects.ObjectInfoSet, oldTarget, newTarget string, dev driver, log *zap.Logger) ([]action, error) {
+	if _, ok := dev.(mover); !ok {
+		return nil, fmt.Errorf("moving objects is not supported by %s", dev.Name())
+	}
+
+	var actions []action
+	for _, key := range slices.Sorted(maps.Keys(hstOIS)) {
+		hobj := hstOIS[key]
+		if hobj.Dir {
+			continue
+		}
+		from := hobj.DevicePath
+		if len(from) == 0 {
+			from = path.Join(oldTarget, key)
+		}
+		rel, ok := cutRoot(from, oldTarget)
+		if !ok {
+			// routed elsewhere, not affected
+			continue
+		}
+		dobj := dstOIS.Find(from)
+		if dobj == nil || dobj.Dir {
+			log.Debug("Not on device, skipping", zap.String("path", from))
+			continue
+		}
+		to := path.Join(newTarget, rel)
+		if dstOIS.Find(to) != nil {
+			return nil, fmt.Errorf("unable to move '%s', '%s' already exists on device", from, to)
+		}
+		actions = makeMoveActions(actions, dobj, to, oldTarget, newTarget, dstOIS, dev, log)
+
+		base := strings.TrimSuffix(path.Base(from), path.Ext(from))
+		for _, name := range []string{base + ".apnx", base + ".sdr"} {
+			if sobj := dstOIS.Find(path.Join(path.Dir(from), name)); sobj != nil && dstOIS.Find(path.Join(path.Dir(to), name)) == nil {
+				actions = makeMoveActions(actions, sobj, path.Join(path.Dir(to), name), oldTarget, newTarget, dstOIS, dev, log)
+			}
+		}
+	}
+	if len(actions) > 0 {
+		actions = makeRemoveDirActions(actions, oldTarget, path.Dir(oldTarget), dstOIS, dev, log)
+	}
+	return actions, nil
+}
+
+// RunMigrateDevice continues history of one device with another (replacement) device. History databases of the old
+// device for configured targets are cloned under the new device identity and books known to history are pushed to
+// the new device together with their thumbnails.
+func RunMigrateDevice(ctx *cli.Context) error {
+	env := ctx.Generic(state.FlagName).(*state.LocalEnv)
+	log := env.Log.Named("migrate")
+
+	protocol, err := common.ParseProtocol(ctx.String("protocol"))
+	if err != nil {
+		return err
+	}
+	if protocol == common.ProtocolMail {
+		return fmt.Errorf("device migration is not supported for e-mail delivery")
+	}
+
+	fromID, toID := ctx.String("from"), ctx.String("to")
+	if len(toID) > 0 {
+		env.Cfg.DeviceSerial = toID
+	}
+	// device removals must be ignored - new device has none of our books yet
+	jobs := prepareJobs(env.Cfg, protocol, true, log)
+
+	lock, err := lockDevice(ctx, protocol, env.Cfg, log)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	dev, err := connectDevice(ctx, protocol, devicePaths(jobs), env)
+	if err != nil {
+		return fmt.Errorf("unable to connect to device: %w", err)
+	}
+	defer dev.Disconnect()
+
+	if err := prepareThumbsDir(env, dev, jobs, log); err != nil {
+		return err
+	}
+
+	if len(toID) > 0 && toID != dev.UniqueID() {
+		return fmt.Errorf("connected device '%s' is not '%s'", dev.UniqueID(), toID)
+	}
+	toID = dev.UniqueID()
+
+	if len(fromID) == 0 {
+		if fromID, err = detectOldDevice(env.Cfg.HistoryPath, protocol, toID); err != nil {
+			return err
+		}
+	}
+	if fromID == toID {
+		return fmt.Errorf("devices are the same: %s", toID)
+	}
+
+	log.Info("Device migration starting",
+		zap.Stringer("protocol", protocol),
+		zap.String("from", fromID),
+		zap.String("to", toID),
+	)
+	defer func(start time.Time) {
+		log.Info("Device migration finished", zap.Stringer("protocol", protocol), zap.Duration("elapsed", time.Since(start)))
+	}(time.Now())
+
+	dryRun := ctx.Bool("dry-run")
+	if dryRun {
+		// work on temporary copies, so we could see what would be sent
+		tmpDir, err := os.MkdirTemp("", "s2k-h-")
+		if err != nil {
+			return fmt.Errorf("unable to create temporary directory: %w", err)
+		}
+		defer os.RemoveAll(tmpDir)
+		for i := range jobs {
+			cfg := *jobs[i].cfg
+			cfg.HistoryPath = tmpDir
+			jobs[i].cfg = &cfg
+		}
+	}
+
+	migrated := make([]string, 0, len(jobs))
+	for _, j := range jobs {
+		from := filepath.Join(env.Cfg.HistoryPath, history.GetName(protocol, fromID, j.cfg.TargetPath))
+		if _, err := os.Stat(from); err != nil {
+			log.Info("No history to migrate", zap.String("target", j.cfg.TargetPath))
+			continue
+		}
+		to := filepath.Join(j.cfg.HistoryPath, history.GetName(protocol, toID, j.cfg.TargetPath))
+		if err := migrateJob(ctx, j, from, to, fromID, toID, protocol, dev, env, log); err != nil {
+			if len(j.name) == 0 {
+				return err
+			}
+			return fmt.Errorf("channel '%s': %w", j.name, err)
+		}
+		migrated = append(migrated, filepath.Base(from))
+	}
+
+	// let user know about histories we did not touch, they are not part of current configuration
+	entries, err := os.ReadDir(env.Cfg.HistoryPath)
+	if err != nil {
+		return fmt.Errorf("unable to read history directory '%s': %w", env.Cfg.HistoryPath, err)
+	}
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".db" || slices.Contains(migrated, e.Name()) {
+			continue
+		}
+		values, err := history.Identifiers(filepath.Join(env.Cfg.HistoryPath, e.Name()))
+		if err != nil || len(values) != 3 || values[0] != protocol.String() || values[1] != fromID {
+			continue
+		}
+		log.Warn("History was not migrated, target is not in configuration", zap.String("target", values[2]))
+	}
+	return nil
+}
+
+// migrateJob clones history "from" into "to" and syncs the job, both databases are locked for the duration. History
+// is cloned aside and only put in place when sync succeeds or records what it has done before being interrupted,
+// otherwise cloned last step would claim that new device already has all the books and next sync would remove them
+// locally.
+func migrateJob(ctx *cli.Context, j job, from, to, fromID, toID string, protocol common.SupportedProtocols, dev driver, env *state.LocalEnv, log *zap.Logger) error {
+	for _, p := range []string{from, to} {
+		lock, err := history.Lock(p, ctx.Duration("wait"), log)
+		if err != nil {
+			return fmt.Errorf("history database cannot be used: %w", err)
+		}
+		defer lock.Release()
+	}
+
+	tmp := to + ".tmp"
+	// leftover of the crashed run
+	if err := os.Remove(tmp); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("unable to remove history database '%s': %w", tmp, err)
+	}
+	defer os.Remove(tmp)
+
+	if err := history.CloneForDevice(from, tmp, fromID, toID, log); err != nil {
+		return fmt.Errorf("unable to migrate history for target '%s': %w", j.cfg.TargetPath, err)
+	}
+	cloned, err := historyStep(tmp, log)
+	if err != nil {
+		return fmt.Errorf("unable to read cloned history: %w", err)
+	}
+
+	j.history, j.migrated = tmp, true
+	err = runJob(ctx, j, protocol, dev, env, log)
+	if err != nil {
+		if ctx.Context.Err() == nil {
+			return err
+		}
+		// interrupted, keep history only if completed actions were recorded
+		if step, herr := historyStep(tmp, log); herr != nil || step == cloned {
+			return err
+		}
+	}
+	if rerr := os.Rename(tmp, to); rerr != nil {
+		return errors.Join(err, fmt.Errorf("unable to put migrated history in place: %w", rerr))
+	}
+	return err
+}
+
+// historyStep returns last step of history database at "path".
+func historyStep(path string, log *zap.Logger) (int64, error) {
+	hst, err := history.Connect(path, log)
+	if err != nil {
+		return 0, err
+	}
+	defer hst.Disconnect()
+	return hst.StepID(), nil
+}
+
+// detectOldDevice looks for the single device other than "current" which has history for the protocol.
+func detectOldDevice(historyPath string, protocol common.SupportedProtocols, current string) (string, error) {
+	found, err := historyDevices(historyPath, protocol, "")
+	if err != nil {
+		return "", err
+	}
+	found = slices.DeleteFunc(found, func(id string) bool { return id == current })
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("no history for other %s devices found", protocol)
+	case 1:
+		return found[0], nil
+	default:
+		return "", fmt.Errorf("history for several %s devices found (%s), specify one", protocol, strings.Join(found, ", "))
+	}
+}
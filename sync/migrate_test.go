@@ -0,0 +1,163 @@
+package sync
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+
+	"sync2kindle/common"
+	"sync2kindle/history"
+	"sync2kindle/objects"
+)
+
+func TestCheckTargets(t *testing.T) {
+	cases := []struct {
+		protocol             common.SupportedProtocols
+		oldTarget, newTarget string
+		ok                   bool
+	}{
+		{common.ProtocolMTP, "documents/mybooks", "documents/fiction/", true},
+		{common.ProtocolUSB, "documents/mybooks", "documents/mybooks", false},
+		{common.ProtocolUSB, "documents/mybooks", "documents/mybooks/fiction", false},
+		{common.ProtocolUSB, "documents/mybooks", "documents", false},
+		{common.ProtocolUSB, "documents/mybooks", "/documents/fiction", false},
+		{common.ProtocolUSB, "documents/mybooks", "system/thumbnails", false},
+		{common.ProtocolMTP, "documents/mybooks", "me@kindle.com", false},
+		{common.ProtocolMail, "me@kindle.com", "other@kindle.com", true},
+		{common.ProtocolMail, "me@kindle.com", "documents/fiction", false},
+	}
+	for i, c := range cases {
+		_, got, err := checkTargets(c.protocol, c.oldTarget, c.newTarget)
+		if (err == nil) != c.ok {
+			t.Fatalf("Case %d: unexpected result: %v", i, err)
+		}
+		if err == nil && c.protocol != common.ProtocolMail && got != "documents/fiction" {
+			t.Fatalf("Case %d: target is not cleaned: %s", i, got)
+		}
+	}
+}
+
+func TestPrepareMigrateActions(t *testing.T) {
+	log := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+
+	hst := objects.ObjectInfoSet{
+		"01":           {Name: "01", Dir: true, FullPath: "D:/test/out/01"},
+		"01/a.azw3":    {Name: "a.azw3", File: true, FullPath: "D:/test/out/01/a.azw3", DevicePath: "documents/mybooks/01/a.azw3"},
+		"01/a.apnx":    {Name: "a.apnx", File: true, FullPath: "D:/test/out/01/a.apnx"},
+		"b.azw3":       {Name: "b.azw3", File: true, FullPath: "D:/test/out/b.azw3"},
+		"c.pdf":        {Name: "c.pdf", File: true, FullPath: "D:/test/out/c.pdf", DevicePath: "documents/pdfs/c.pdf"},
+		"removed.azw3": {Name: "removed.azw3", File: true, FullPath: "D:/test/out/removed.azw3"},
+	}
+	dev := &testMoveActor{testActor: testActor{name: "device", set: objects.ObjectInfoSet{
+		"documents":                       {Name: "documents", Dir: true, FullPath: "documents"},
+		"documents/mybooks":               {Name: "mybooks", Dir: true, FullPath: "documents/mybooks"},
+		"documents/mybooks/01":            {Name: "01", Dir: true, FullPath: "documents/mybooks/01"},
+		"documents/mybooks/01/a.azw3":     {Name: "a.azw3", File: true, FullPath: "documents/mybooks/01/a.azw3"},
+		"documents/mybooks/01/a.apnx":     {Name: "a.apnx", File: true, FullPath: "documents/mybooks/01/a.apnx"},
+		"documents/mybooks/b.azw3":        {Name: "b.azw3", File: true, FullPath: "documents/mybooks/b.azw3"},
+		"documents/mybooks/b.sdr":         {Name: "b.sdr", Dir: true, FullPath: "documents/mybooks/b.sdr"},
+		"documents/mybooks/b.sdr/b.azw3f": {Name: "b.azw3f", File: true, FullPath: "documents/mybooks/b.sdr/b.azw3f"},
+		"documents/pdfs":                  {Name: "pdfs", Dir: true, FullPath: "documents/pdfs"},
+		"documents/pdfs/c.pdf":            {Name: "c.pdf", File: true, FullPath: "documents/pdfs/c.pdf"},
+	}}}
+
+	actions, err := prepareMigrateActions(hst, dev.set, "documents/mybooks", "documents/fiction", dev, log)
+	if err != nil {
+		t.Fatalf("Failed to prepare actions: %v", err)
+	}
+	for _, action := range actions {
+		if err := action.run(context.Background(), false, log); err != nil {
+			t.Fatalf("Action failed: %v", err)
+		}
+	}
+	// a.azw3, a.apnx, b.azw3 and b.sdr are moved, "fiction" and "fiction/01" are created, "mybooks/01" and "mybooks" are removed
+	if dev.moves != 4 || dev.directories != 2 || dev.deletions != 2 {
+		t.Fatalf("Expected 4 moves, 2 directories and 2 deletions, got %d, %d, %d", dev.moves, dev.directories, dev.deletions)
+	}
+	for _, p := range []string{"documents/fiction/01/a.apnx", "documents/fiction/b.sdr/b.azw3f", "documents/pdfs/c.pdf"} {
+		if dev.set.Find(p) == nil {
+			t.Fatalf("Expected '%s' on device", p)
+		}
+	}
+
+	if _, err := prepareMigrateActions(hst, dev.set, "documents/fiction", "documents/other", &testActor{name: "device"}, log); err == nil {
+		t.Fatalf("Expected error for driver which cannot move objects")
+	}
+}
+
+func TestDetectOldDevice(t *testing.T) {
+	log := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	dir := t.TempDir()
+
+	create := func(protocol common.SupportedProtocols, id, target string) {
+		t.Helper()
+		if err := history.Create(filepath.Join(dir, history.GetName(protocol, id, target)), log, protocol.String(), id, target); err != nil {
+			t.Fatalf("Unable to create history: %v", err)
+		}
+	}
+
+	if _, err := detectOldDevice(dir, common.ProtocolMTP, "NEW"); err == nil {
+		t.Fatalf("Expected error without history")
+	}
+	create(common.ProtocolMTP, "OLD", "documents/mybooks")
+	create(common.ProtocolMTP, "OLD", "fonts")
+	create(common.ProtocolMTP, "NEW", "documents/mybooks")
+	create(common.ProtocolUSB, "SN", "documents/mybooks")
+	if id, err := detectOldDevice(dir, common.ProtocolMTP, "NEW"); err != nil || id != "OLD" {
+		t.Fatalf("Expected 'OLD', got '%s': %v", id, err)
+	}
+	create(common.ProtocolMTP, "OTHER", "documents/mybooks")
+	if _, err := detectOldDevice(dir, common.ProtocolMTP, "NEW"); err == nil {
+		t.Fatalf("Expected error with several candidates")
+	}
+}
+
+func TestRecordMovedBooks(t *testing.T) {
+	log := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+
+	hstOIS := objects.ObjectInfoSet{
+		"a.azw3": {Name: "a.azw3", File: true, PersistentID: "ha"},
+		"b.azw3": {Name: "b.azw3", File: true, PersistentID: "hb", DevicePath: "documents/mybooks/b.azw3"},
+		"c.pdf":  {Name: "c.pdf", File: true, PersistentID: "hc", DevicePath: "documents/pdfs/c.pdf"},
+	}
+	// "a" was moved before migration was interrupted, "b" was not
+	dstOIS := objects.ObjectInfoSet{
+		"documents/fiction/a.azw3": {Name: "a.azw3", File: true, FullPath: "documents/fiction/a.azw3"},
+		"documents/mybooks/b.azw3": {Name: "b.azw3", File: true, FullPath: "documents/mybooks/b.azw3"},
+		"documents/pdfs/c.pdf":     {Name: "c.pdf", File: true, FullPath: "documents/pdfs/c.pdf"},
+	}
+	moved := movedBooks(hstOIS, dstOIS, "documents/mybooks", "documents/fiction")
+	if len(moved) != 1 || moved["a.azw3"] != "documents/fiction/a.azw3" {
+		t.Fatalf("Expected only 'a.azw3' to be moved, got %v", moved)
+	}
+
+	p := filepath.Join(t.TempDir(), history.GetName(common.ProtocolMTP, "SN", "documents/mybooks"))
+	if err := history.Create(p, log, common.ProtocolMTP.String(), "SN", "documents/mybooks"); err != nil {
+		t.Fatalf("Unable to create history: %v", err)
+	}
+	hst, err := history.Connect(p, log)
+	if err != nil {
+		t.Fatalf("Unable to open history: %v", err)
+	}
+	err = hst.SaveObjectInfos("/src", "documents/mybooks", hstOIS)
+	hst.Disconnect()
+	if err != nil {
+		t.Fatalf("Unable to save step: %v", err)
+	}
+
+	if err := history.RecordMoves(p, moved, log); err != nil {
+		t.Fatalf("Unable to record moves: %v", err)
+	}
+	ois, err := history.Latest(p)
+	if err != nil {
+		t.Fatalf("Unable to read history: %v", err)
+	}
+	for key, want := range map[string]string{"a.azw3": "documents/fiction/a.azw3", "b.azw3": "documents/mybooks/b.azw3", "c.pdf": "documents/pdfs/c.pdf"} {
+		if obj := ois.Find(key); obj == nil || obj.DevicePath != want {
+			t.Errorf("Book '%s': expected device path '%s', got %v", key, want, obj)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"sync2kindle/common"
+	"sync2kindle/config"
+	"sync2kindle/history"
+	"sync2kindle/objects"
+)
+
+// errOffline is returned by offline device for any attempt to change it.
+var errOffline = errors.New("device is not connected, offline planning only")
+
+// offlineDevice stands in for the device which is not connected. Device content is assumed to be what the last sync
+// recorded in history (see assumedDeviceObjects), so it could only be used for planning.
+type offlineDevice struct {
+	id string
+}
+
+func (d *offlineDevice) Name() string {
+	return "offline-device"
+}
+
+func (d *offlineDevice) UniqueID() string {
+	return d.id
+}
+
+func (d *offlineDevice) MkDir(context.Context, *objects.ObjectInfo) error {
+	return errOffline
+}
+
+func (d *offlineDevice) Remove(context.Context, *objects.ObjectInfo) error {
+	return errOffline
+}
+
+func (d *offlineDevice) Copy(context.Context, *objects.ObjectInfo) error {
+	return errOffline
+}
+
+// GetObjectInfos always returns empty set, history is used instead.
+func (d *offlineDevice) GetObjectInfos(context.Context) (objects.ObjectInfoSet, error) {
+	return objects.New(), nil
+}
+
+func (d *offlineDevice) Disconnect() {}
+
+// connectOffline creates offline device for the configured device serial or for the only device which has history
+// for the protocol and target. For e-mail delivery device is identified by sender address.
+func connectOffline(protocol common.SupportedProtocols, cfg *config.Config) (driver, error) {
+	if protocol == common.ProtocolMail {
+		return &offlineDevice{id: cfg.Smtp.From}, nil
+	}
+	if len(cfg.DeviceSerial) > 0 {
+		return &offlineDevice{id: cfg.DeviceSerial}, nil
+	}
+	found, err := historyDevices(cfg.HistoryPath, protocol, cfg.TargetPath)
+	if err != nil {
+		return nil, err
+	}
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("no history for %s devices with target '%s' found, nothing to plan against", protocol, cfg.TargetPath)
+	case 1:
+		return &offlineDevice{id: found[0]}, nil
+	default:
+		return nil, fmt.Errorf("history for several %s devices found (%s), specify one with 'device_serial'", protocol, strings.Join(found, ", "))
+	}
+}
+
+// historyDevices returns IDs of devices which have history for the protocol, when "target" is not empty only
+// histories for this target are considered.
+func historyDevices(historyPath string, protocol common.SupportedProtocols, target string) ([]string, error) {
+	entries, err := os.ReadDir(historyPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read history directory '%s': %w", historyPath, err)
+	}
+	var found []string
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".db" {
+			continue
+		}
+		values, err := history.Identifiers(filepath.Join(historyPath, e.Name()))
+		if err != nil || len(values) != 3 || values[0] != protocol.String() || (len(target) > 0 && values[2] != target) {
+			continue
+		}
+		if !slices.Contains(found, values[1]) {
+			found = append(found, values[1])
+		}
+	}
+	return found, nil
+}
+
+// assumedDeviceObjects reconstructs device objects from history: books at their recorded device paths together with
+// page indexes, thumbnails and all parent folders. Anything not sent by sync is unknown.
+func assumedDeviceObjects(cfg *config.Config, hstOIS objects.ObjectInfoSet) objects.ObjectInfoSet {
+	dst := objects.New()
+	add := func(p string, o *objects.ObjectInfo) {
+		for dir := path.Dir(p); dir != "." && dir != "/" && dst.Find(dir) == nil; dir = path.Dir(dir) {
+			dst.Add(dir, &objects.ObjectInfo{Name: path.Base(dir), Dir: true, FullPath: dir, OIS: dst})
+		}
+		c := *o
+		c.FullPath, c.OIS = p, dst
+		dst.Add(p, &c)
+	}
+
+	add(common.ThumbnailFolder, &objects.ObjectInfo{Name: path.Base(common.ThumbnailFolder), Dir: true})
+	for key, hobj := range hstOIS {
+		if hobj.Dir || !slices.Contains(cfg.BookExtensions, filepath.Ext(hobj.Name)) {
+			continue
+		}
+		devPath := recordedDevicePath(cfg, key, hobj)
+		add(devPath, hobj)
+
+		supplementals := getSupplementalArtifactsPaths(devPath)
+		for i, p := range getSupplementalArtifactsPaths(key) {
+			if sobj := hstOIS.Find(p); sobj != nil {
+				add(supplementals[i], sobj)
+			}
+		}
+		if len(hobj.ThumbName) > 0 {
+			add(path.Join(common.ThumbnailFolder, hobj.ThumbName), &objects.ObjectInfo{Name: hobj.ThumbName, File: true, ThumbName: hobj.ThumbName})
+		}
+	}
+	return dst
+}
@@ -6,7 +6,7 @@
 // 1 | - - - | nothing                 | ignore                      | - - -
 // 2 | - - + | manually added (D)      | ignore                      | - - +
 // 3 | + - - | manually added (L)      | add to device (sync)        | + + +
-// 4 | + - + | error (H)               | ignore                      | + + +
+// 4 | + - + | unknown (H)             | verify, adopt or re-send    | + + +
 // 5 | - + - | manually removed (L,D)  | ignore                      | - + -
 // 6 | - + + | manually removed (L)    | remove from device (sync)   | - - -
 // 7 | + + - | manually removed (D)    | remove from local (sync)    | - - -
@@ -17,13 +17,27 @@
 // Additional caveat are books which have been synced to device and then changed locally (updated)
 // This is possibly case #8 and we specifically handle it as part of case #3
 //
+// Case #4 happens when history was lost or rebuilt or when device already has some of our books. Device
+// copy is compared with local book (size first, then content hash if driver could calculate it) and either
+// adopted when identical or sent again (as part of case #3) when different.
+//
+// Before case #7 is handled, books missing from the device are matched against books found on the device
+// in places unknown to history (case #2). When book was moved or renamed on the device (same name and size,
+// or same content hash if driver could calculate it) the move is mirrored locally instead of removing the book.
+//
+// Books sent from outside of the source (command "send" with "manage" flag) are recorded in history, but do not
+// take part in any of the cases above: sync leaves them on the device and carries them over to every history step.
+//
 // There is a special case (CLI switch "ignore-device-removals") which makes sync fully one
 // directional (ignore case #7) - from local to device, otherwise by default we try to handle most
-// useful day to day usage scenario.
+// useful day to day usage scenario. Content channels could additionally ignore case #6, making
+// synchronization purely additive.
 package sync
 
 import (
+	"context"
 	"fmt"
+	"maps"
 	"os"
 	"path"
 	"path/filepath"
@@ -37,131 +51,252 @@ import (
 	"sync2kindle/common"
 	"sync2kindle/config"
 	"sync2kindle/objects"
+	"sync2kindle/thumbs"
 )
 
-type action func(bool, *zap.Logger) error
+// action is a single prepared operation. Books are keys of local books action belongs to, so progress could be
+// recorded in history when sync is interrupted.
+type action struct {
+	books []string
+	run   func(context.Context, bool, *zap.Logger) error
+}
 
 type driver interface {
 	Name() string
 	UniqueID() string
-	MkDir(*objects.ObjectInfo) error
-	Remove(*objects.ObjectInfo) error
-	Copy(*objects.ObjectInfo) error
-	GetObjectInfos() (objects.ObjectInfoSet, error)
+	MkDir(context.Context, *objects.ObjectInfo) error
+	Remove(context.Context, *objects.ObjectInfo) error
+	Copy(context.Context, *objects.ObjectInfo) error
+	GetObjectInfos(context.Context) (objects.ObjectInfoSet, error)
 	Disconnect()
 }
 
-func PrepareActions(srcActor, dstActor, hstActor driver, cfg *config.Config, ignoreDeviceRemovals, email bool, logParent *zap.Logger) ([]action, objects.ObjectInfoSet, error) {
+// hasher is implemented by drivers which could calculate content hash of the object, so it could be compared
+// with local book persistent ID.
+type hasher interface {
+	Hash(context.Context, *objects.ObjectInfo) (string, error)
+}
+
+// thumbnailer is implemented by drivers which could extract thumbnail from the book, returning its name or empty string
+// when book has none.
+type thumbnailer interface {
+	Thumbnail(context.Context, *objects.ObjectInfo) string
+}
+
+// modeler is implemented by drivers which know model name of the connected device.
+type modeler interface {
+	Model() string
+}
+
+// mover is implemented by drivers which could move (rename) objects in place, source path is expected in
+// "ObjectName" and destination path in "FullPath".
+type mover interface {
+	Move(context.Context, *objects.ObjectInfo) error
+}
+
+// Options controls how differences between local source, history and device are treated.
+type Options struct {
+	IgnoreDeviceRemovals bool // books removed from device are not removed locally (case #7)
+	IgnoreLocalRemovals  bool // books removed locally are not removed from device (case #6)
+	EMail                bool // device content is not accessible, history is used instead
+	Offline              bool // device is not connected, its content is assumed from history
+
+	only   *selection // books to synchronize, everything when nil
+	shared *thumbRefs // thumbnails referenced by other histories of the device
+}
+
+// PrepareActions compares local source, history and device, returning actions which bring device up to date along with
+// local and device objects they were planned against.
+func PrepareActions(ctx context.Context, srcActor, dstActor, hstActor driver, cfg *config.Config, opts Options, logParent *zap.Logger) ([]action, objects.ObjectInfoSet, objects.ObjectInfoSet, error) {
 	log := logParent.Named("prepare")
 
+	sel := opts.only
+
 	// Local file system
 
 	start := time.Now()
-	srcOIS, err := srcActor.GetObjectInfos()
+	srcOIS, err := srcActor.GetObjectInfos(ctx)
 	if err != nil {
-		return nil, nil, fmt.Errorf("unable to get source files: %w", err)
+		return nil, nil, nil, fmt.Errorf("unable to get source files: %w", err)
 	}
 	log.Debug("Local artifacts (all)", zap.Duration("elapsed", time.Since(start)), zap.Int("count", len(srcOIS)), zap.Any("Infos", srcOIS))
 
 	localBooks := srcOIS.
 		SubsetByPath(cfg.SourcePath).
 		SubsetByFunc(func(k string, v *objects.ObjectInfo) bool {
-			return !v.Dir && slices.Contains(cfg.BookExtensions, filepath.Ext(v.Name))
+			return !v.Dir && slices.Contains(cfg.BookExtensions, filepath.Ext(v.Name)) && sel.has(k)
 		})
 	if len(localBooks) == 0 {
-		return nil, nil, fmt.Errorf("no books in the source path: %w", common.ErrNoFiles)
+		if sel != nil {
+			return nil, nil, nil, fmt.Errorf("no books selected in the source path: %w", common.ErrNoFiles)
+		}
+		return nil, nil, nil, fmt.Errorf("no books in the source path: %w", common.ErrNoFiles)
 	}
 	log.Debug("Local artifacts (filtered)", zap.Int("count", len(localBooks)), zap.Any("Infos", localBooks))
 
 	// history
 
 	start = time.Now()
-	hstOIS, err := hstActor.GetObjectInfos()
+	hstOIS, err := hstActor.GetObjectInfos(ctx)
 	if err != nil {
-		return nil, nil, fmt.Errorf("history objects cannot be read: %w", err)
+		return nil, nil, nil, fmt.Errorf("history objects cannot be read: %w", err)
 	}
 	log.Debug("History artifacts (all)", zap.Duration("elapsed", time.Since(start)), zap.Int("count", len(hstOIS)), zap.Any("Infos", hstOIS))
 
-	historyBooks := hstOIS.
+	// books sent with "send --manage" are not ours to synchronize, they are only kept away from device books
+	external := hstOIS.SubsetByFunc(func(_ string, v *objects.ObjectInfo) bool { return v.External })
+	allHistoryBooks := hstOIS.
 		SubsetByFunc(func(k string, v *objects.ObjectInfo) bool {
-			return !v.Dir && slices.Contains(cfg.BookExtensions, filepath.Ext(v.Name))
+			return !v.Dir && !v.External && slices.Contains(cfg.BookExtensions, filepath.Ext(v.Name))
 		})
+	// books outside of selection are of no interest, as if they were not there
+	historyBooks := allHistoryBooks.SubsetByFunc(func(k string, _ *objects.ObjectInfo) bool { return sel.has(k) })
 	log.Debug("History artifacts (filtered)", zap.Int("count", len(historyBooks)), zap.Any("Infos", historyBooks))
 
 	// target device
 
 	start = time.Now()
-	dstOIS, err := dstActor.GetObjectInfos()
+	dstOIS, err := dstActor.GetObjectInfos(ctx)
 	if err != nil {
-		return nil, nil, fmt.Errorf("unable to get files on the device: %w", err)
+		return nil, nil, nil, fmt.Errorf("unable to get files on the device: %w", err)
 	}
-	if email {
+	switch {
+	case opts.EMail:
 		// e-mail driver always returns empty set
 		dstOIS = hstOIS.Clone()
+	case opts.Offline:
+		// so does offline device, books sent by the last sync are assumed to be where history says they are
+		dstOIS = assumedDeviceObjects(cfg, hstOIS)
 	}
 	log.Debug("Device artifacts (all)", zap.Duration("elapsed", time.Since(start)), zap.Int("count", len(dstOIS)), zap.Any("Infos", dstOIS))
 
+	rt, err := newRouter(cfg)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
 	targetExists := dstOIS.Find(cfg.TargetPath) != nil
 	thumbsAvailable := dstOIS.Find(common.ThumbnailFolder) != nil
 
-	deviceBooks := dstOIS
-	if targetExists {
-		deviceBooks = dstOIS.
-			SubsetByPath(cfg.TargetPath).
-			SubsetByFunc(func(k string, v *objects.ObjectInfo) bool {
-				return !v.Dir && slices.Contains(cfg.BookExtensions, filepath.Ext(v.Name))
-			})
+	// several targets could share the same device and books could be routed to different folders, so device
+	// books are mapped back to their local paths, anything we cannot map is of no interest to us
+	deviceBooks := objects.New()
+	if opts.EMail {
+		// history is our device view, it is not rooted at target
+		deviceBooks = dstOIS.Subtract(external)
+	} else {
+		sent := make(map[string]bool, len(external))
+		for _, v := range external {
+			sent[v.DevicePath] = true
+		}
+		for k, v := range dstOIS {
+			if v.Dir || sent[k] || !slices.Contains(cfg.BookExtensions, filepath.Ext(v.Name)) {
+				continue
+			}
+			if key, ok := rt.toLocal(k); ok {
+				deviceBooks[key] = v
+			}
+		}
 		log.Debug("Device artifacts (filtered)", zap.Int("count", len(deviceBooks)), zap.Any("Infos", deviceBooks))
 	}
 
+	// device books outside of selection are only of interest when looking for books moved on the device
+	allDeviceBooks := deviceBooks
+	if sel != nil {
+		deviceBooks = deviceBooks.SubsetByFunc(func(k string, _ *objects.ObjectInfo) bool { return sel.has(k) })
+	}
+
+	// books which were synced to a different place on the device (routing rules have changed since last sync),
+	// they are still present on the device and should be moved to their new location
+	rerouted := objects.New()
+	if !opts.EMail {
+		for key, hobj := range historyBooks {
+			was := recordedDevicePath(cfg, key, hobj)
+			if was == rt.devicePath(key) {
+				continue
+			}
+			if dobj := dstOIS.Find(was); dobj != nil && !dobj.Dir {
+				if _, exists := deviceBooks[key]; !exists {
+					deviceBooks[key] = dobj
+				}
+				rerouted[key] = dobj
+			}
+		}
+		if len(rerouted) > 0 {
+			log.Debug("Device artifacts (rerouted)", zap.Int("count", len(rerouted)), zap.Any("Infos", rerouted))
+		}
+	}
+
 	log.Debug("Device state", zap.Bool("destination exists", targetExists), zap.Bool("thumbnails available", thumbsAvailable))
 
 	var deviceThumbs objects.ObjectInfoSet
 	if thumbsAvailable {
-		var dirs = []string{}
-		deviceThumbs = dstOIS.
-			SubsetByPath(common.ThumbnailFolder).
-			SubsetByFunc(func(k string, v *objects.ObjectInfo) bool {
-				// loose all subdirectories
-				if v.Dir {
-					dirs = append(dirs, k)
-					return false
-				}
-				return true
-			}).
-			SubsetByFunc(func(k string, v *objects.ObjectInfo) bool {
-				// loose all thumbs in subdirectories too - do not know what to do with them
-				for _, d := range dirs {
-					if strings.HasPrefix(k, d) {
-						return false
-					}
-				}
-				return true
-			}).
-			SubsetByFunc(func(k string, v *objects.ObjectInfo) bool {
-				return slices.Contains(cfg.ThumbExtensions, filepath.Ext(v.Name))
-			})
+		deviceThumbs = getDeviceThumbs(dstOIS, cfg.ThumbExtensions)
 		log.Debug("Device thumbnails (filtered)", zap.Int("count", len(deviceThumbs)), zap.Any("Infos", deviceThumbs))
 	}
 
+	// thumbnails are only extracted for books which are being sent, for books sent before they are known from history
+	for key, obj := range localBooks {
+		if hobj, exists := allHistoryBooks[key]; exists && hobj.PersistentID == obj.PersistentID {
+			obj.ThumbName = hobj.ThumbName
+		}
+	}
+
+	// thumbnail could be shared by several books on the device (the same book in different folders or targets), it is
+	// only removed together with the last book using it
+	outside := allHistoryBooks.Subtract(historyBooks)
+
 	// Analyze the situation and prepare actions
 
 	var actions []action
 
+	// case #7 (moves) --------------------------------------------------------
+	// books were moved or renamed on device since last sync, mirror this locally
+
+	moved := objects.New()
+	if _, ok := srcActor.(mover); ok && !opts.IgnoreDeviceRemovals && !opts.EMail {
+		missing := historyBooks.Subtract(deviceBooks).Intersect(localBooks)
+		candidates := allDeviceBooks.Subtract(allHistoryBooks).Subtract(localBooks)
+		for _, key := range slices.Sorted(maps.Keys(missing)) {
+			newKey := findMovedBook(ctx, historyBooks[key], candidates, dstActor, log)
+			if len(newKey) == 0 {
+				continue
+			}
+			log.Info("Book was moved on device, moving it locally", zap.String("from", key), zap.String("to", newKey))
+			delete(candidates, newKey)
+
+			obj := localBooks[key]
+			first := len(actions)
+			actions = makeMoveActions(actions, obj, path.Join(cfg.SourcePath, newKey), cfg.SourcePath, cfg.SourcePath, srcOIS, srcActor, log)
+			supplementals := getSupplementalArtifactsPaths(path.Join(cfg.SourcePath, newKey))
+			for i, p := range getSupplementalArtifactsPaths(obj.FullPath) {
+				if sobj := srcOIS.Find(p); sobj != nil {
+					actions = makeMoveActions(actions, sobj, supplementals[i], cfg.SourcePath, cfg.SourcePath, srcOIS, srcActor, log)
+				}
+			}
+			tagActions(actions[first:], key, newKey)
+			delete(localBooks, key)
+			localBooks[newKey] = srcOIS.Find(path.Join(cfg.SourcePath, newKey))
+			moved[newKey] = localBooks[newKey]
+		}
+	}
+
 	// case #7 ----------------------------------------------------------------
 	// books were manually removed from device since last sync
 
 	objs := historyBooks.Subtract(deviceBooks).Intersect(localBooks)
-	if len(objs) > 0 && !ignoreDeviceRemovals && !email {
+	if len(objs) > 0 && !opts.IgnoreDeviceRemovals && !opts.EMail {
 		log.Debug("Removed from device", zap.Int("count", len(objs)), zap.Any("Infos", objs))
-		for _, obj := range objs {
+		remaining := localBooks.Subtract(objs)
+		for key, obj := range objs {
+			first := len(actions)
 			actions = makeRemoveActions(actions, obj, cfg.SourcePath, srcOIS, srcActor, log)
 			for _, p := range getSupplementalArtifactsPaths(obj.FullPath) {
 				if sobj := srcOIS.Find(p); sobj != nil {
 					actions = makeRemoveActions(actions, sobj, cfg.SourcePath, srcOIS, srcActor, log)
 				}
 			}
-			if thumbsAvailable && len(obj.ThumbName) > 0 {
+			if thumbsAvailable && len(obj.ThumbName) > 0 && !thumbOwned(obj.ThumbName, opts.shared, remaining, external, outside) {
 				thumb := deviceThumbs.Find(obj.ThumbName)
 				if thumb != nil {
 					actions = append(actions, makeAction(dstActor, "Remove", thumb, log))
@@ -169,6 +304,7 @@ func PrepareActions(srcActor, dstActor, hstActor driver, cfg *config.Config, ign
 					deviceThumbs.Delete(obj.ThumbName)
 				}
 			}
+			tagActions(actions[first:], key)
 		}
 		localBooks = localBooks.Subtract(objs)
 	}
@@ -177,12 +313,13 @@ func PrepareActions(srcActor, dstActor, hstActor driver, cfg *config.Config, ign
 	// books were manually removed from local storage since last sync
 
 	objs = deviceBooks.Subtract(localBooks).Intersect(historyBooks)
-	if len(objs) > 0 && !email {
+	if len(objs) > 0 && !opts.IgnoreLocalRemovals && !opts.EMail {
 		log.Debug("Removed locally", zap.Int("count", len(objs)), zap.Any("Infos", objs))
 
 		// Kindle has a habit of creating additional directories and files, leave them untouched, only
 		// remove files we are aware of, try not to touch anything else.
 		for key, obj := range objs {
+			first := len(actions)
 			actions = append(actions, makeAction(dstActor, "Remove", obj, log))
 			dstOIS.Delete(obj.FullPath)
 			for _, p := range getSupplementalArtifactsPaths(obj.FullPath) {
@@ -193,7 +330,7 @@ func PrepareActions(srcActor, dstActor, hstActor driver, cfg *config.Config, ign
 			}
 			if thumbsAvailable {
 				hobj := historyBooks.Find(key)
-				if hobj != nil && len(hobj.ThumbName) > 0 {
+				if hobj != nil && len(hobj.ThumbName) > 0 && !thumbOwned(hobj.ThumbName, opts.shared, localBooks, external, outside) {
 					thumb := deviceThumbs.Find(hobj.ThumbName)
 					if thumb != nil {
 						actions = append(actions, makeAction(dstActor, "Remove", thumb, log))
@@ -204,10 +341,29 @@ func PrepareActions(srcActor, dstActor, hstActor driver, cfg *config.Config, ign
 			}
 			// NOTE: we do rely on one's ability to remove all local artifacts, so -
 			// local leftovers in this case are not considered here
+			tagActions(actions[first:], key)
 		}
 		deviceBooks = deviceBooks.Subtract(objs)
 	}
 
+	// case #4 ----------------------------------------------------------------
+	// books are present locally and on device, but not in history
+
+	mismatched := objects.New()
+	objs = localBooks.Intersect(deviceBooks).Subtract(historyBooks).Subtract(moved)
+	if len(objs) > 0 && !opts.EMail {
+		log.Debug("Unknown to history", zap.Int("count", len(objs)), zap.Any("Infos", objs))
+		for key, obj := range objs {
+			if reason := verifyDeviceBook(ctx, obj, deviceBooks[key], dstActor, log); len(reason) > 0 {
+				log.Info("Device book differs, sending it again", zap.String("book", key), zap.String("reason", reason))
+				mismatched[key] = obj
+			} else if thumbsAvailable {
+				// adopted book becomes ours together with its thumbnail
+				lookupThumbnail(ctx, srcActor, obj)
+			}
+		}
+	}
+
 	// case #3 ----------------------------------------------------------------
 	// books were manually added to local storage or have been changed locally since last sync
 
@@ -218,54 +374,253 @@ func PrepareActions(srcActor, dstActor, hstActor driver, cfg *config.Config, ign
 		log.Debug("Local artifacts (changed)", zap.Int("count", len(changedLocalBooks)), zap.Any("Infos", changedLocalBooks))
 	}
 
-	objs = localBooks.Subtract(deviceBooks).Union(changedLocalBooks)
+	objs = localBooks.Subtract(deviceBooks).Union(changedLocalBooks).Union(mismatched).Union(rerouted.Intersect(localBooks))
 	if len(objs) > 0 {
 		log.Debug("Added or changed locally", zap.Int("count", len(objs)), zap.Any("Infos", objs))
 
-		for _, obj := range objs {
-			actions = makeCopyActions(actions, obj, cfg.SourcePath, cfg.TargetPath, dstOIS, dstActor, email, log)
-
-			if email {
+		for key, obj := range objs {
+			first := len(actions)
+			if opts.EMail {
+				actions = makeCopyActions(actions, obj, "", key, dstOIS, dstActor, true, log)
+				tagActions(actions[first:], key)
 				continue // no thumbnails or page indexes for e-mail
 			}
 
-			for _, p := range getSupplementalArtifactsPaths(obj.FullPath) {
-				if sobj := srcOIS.Find(p); sobj != nil {
-					actions = makeCopyActions(actions, sobj, cfg.SourcePath, cfg.TargetPath, dstOIS, dstActor, false, log)
+			if old := rerouted.Find(key); old != nil {
+				// book is moving, do not leave anything behind
+				if dstOIS.Find(old.FullPath) != nil {
+					actions = append(actions, makeAction(dstActor, "Remove", old, log))
+					dstOIS.Delete(old.FullPath)
 				}
-			}
-			if thumbsAvailable && len(obj.ThumbName) > 0 {
-				from := path.Join(cfg.Thumbnails.Dir, obj.ThumbName)   // old path, where to copy from
-				to := path.Join(common.ThumbnailFolder, obj.ThumbName) // new path, where to copy to
-
-				fi, err := os.Stat(from)
-				if err != nil {
-					log.Debug("Unable to stat thumbnail, skipping", zap.Any("Info", obj))
-					continue
+				for _, p := range getSupplementalArtifactsPaths(old.FullPath) {
+					if sobj := dstOIS.Find(p); sobj != nil {
+						actions = append(actions, makeAction(dstActor, "Remove", sobj, log))
+						dstOIS.Delete(sobj.FullPath)
+					}
 				}
+			}
 
-				oldThumb := deviceThumbs.Find(obj.ThumbName)
-				if oldThumb != nil {
-					actions = append(actions, makeAction(dstActor, "Remove", oldThumb, log))
-					dstOIS.Delete(oldThumb.FullPath)
-					deviceThumbs.Delete(oldThumb.ThumbName)
-				}
-				thumb := &objects.ObjectInfo{
-					Name:       obj.ThumbName,
-					File:       true,
-					Modified:   obj.Modified,
-					ObjSize:    fi.Size(),
-					FullPath:   to,
-					ObjectName: from,
-					OIS:        dstOIS,
+			if thumbsAvailable {
+				lookupThumbnail(ctx, srcActor, obj)
+			}
+			actions = makeSendActions(actions, key, obj, srcOIS, dstOIS, deviceThumbs, rt, cfg, dstActor, log)
+			tagActions(actions[first:], key)
+		}
+	}
+
+	// thumbnails -------------------------------------------------------------
+	// books already on the device get new thumbnails when their covers were changed locally, and get their
+	// thumbnails back when firmware has purged them
+
+	if thumbsAvailable && !opts.EMail {
+		inPlace := localBooks.Intersect(deviceBooks).Subtract(objs)
+		changedCovers := inPlace.DiffByFunc(historyBooks, func(a, b *objects.ObjectInfo) bool {
+			return a.CoverID == b.CoverID
+		})
+		for key, obj := range changedCovers {
+			log.Info("Book cover has changed, sending new thumbnail", zap.String("book", key))
+			if lookupThumbnail(ctx, srcActor, obj); len(obj.ThumbName) == 0 {
+				continue
+			}
+			first := len(actions)
+			actions = makeThumbActions(actions, obj, dstOIS, deviceThumbs, cfg, dstActor, log)
+			tagActions(actions[first:], key)
+		}
+		if !opts.Offline {
+			actions = makeThumbRepairActions(ctx, actions, inPlace.Subtract(changedCovers), dstOIS, deviceThumbs, cfg, srcActor, dstActor, log)
+		}
+	}
+
+	// remember where books are on the device
+	if !opts.EMail {
+		for key, obj := range localBooks {
+			obj.DevicePath = rt.devicePath(key)
+		}
+	}
+	return actions, srcOIS, dstOIS, nil
+}
+
+// getDeviceThumbs returns thumbnails on the device keyed by thumbnail name, thumbnails in subfolders are ignored.
+func getDeviceThumbs(dstOIS objects.ObjectInfoSet, extensions []string) objects.ObjectInfoSet {
+	var dirs = []string{}
+	return dstOIS.
+		SubsetByPath(common.ThumbnailFolder).
+		SubsetByFunc(func(k string, v *objects.ObjectInfo) bool {
+			// loose all subdirectories
+			if v.Dir {
+				dirs = append(dirs, k)
+				return false
+			}
+			return true
+		}).
+		SubsetByFunc(func(k string, v *objects.ObjectInfo) bool {
+			// loose all thumbs in subdirectories too - do not know what to do with them
+			for _, d := range dirs {
+				if strings.HasPrefix(k, d) {
+					return false
 				}
-				actions = append(actions, makeAction(dstActor, "Copy", thumb, log))
-				deviceThumbs.Add(to, thumb)
-				dstOIS.Add(to, thumb)
 			}
+			return true
+		}).
+		SubsetByFunc(func(k string, v *objects.ObjectInfo) bool {
+			return slices.Contains(extensions, filepath.Ext(v.Name))
+		})
+}
+
+// makeSendActions creates actions to send local book "obj" (with "key" relative to the source) to the device
+// together with its page index files and thumbnail. Thumbnail is only sent when "deviceThumbs" is available.
+func makeSendActions(actions []action, key string, obj *objects.ObjectInfo, srcOIS, dstOIS, deviceThumbs objects.ObjectInfoSet, rt *router, cfg *config.Config, dstActor driver, log *zap.Logger) []action {
+	root, to := rt.toDevice(key)
+	actions = makeCopyActions(actions, obj, root, to, dstOIS, dstActor, false, log)
+
+	supplementals := getSupplementalArtifactsPaths(to)
+	for i, p := range getSupplementalArtifactsPaths(obj.FullPath) {
+		if sobj := srcOIS.Find(p); sobj != nil {
+			actions = makeCopyActions(actions, sobj, root, supplementals[i], dstOIS, dstActor, false, log)
 		}
 	}
-	return actions, srcOIS, nil
+	if deviceThumbs != nil && len(obj.ThumbName) > 0 {
+		actions = makeThumbActions(actions, obj, dstOIS, deviceThumbs, cfg, dstActor, log)
+	}
+	return actions
+}
+
+// makeThumbActions creates actions to put cached thumbnail of the book "obj" on the device, replacing the one which is
+// already there.
+func makeThumbActions(actions []action, obj *objects.ObjectInfo, dstOIS, deviceThumbs objects.ObjectInfoSet, cfg *config.Config, dstActor driver, log *zap.Logger) []action {
+	from := cachedThumbPath(cfg, obj)                      // old path, where to copy from
+	to := path.Join(common.ThumbnailFolder, obj.ThumbName) // new path, where to copy to
+
+	fi, err := os.Stat(from)
+	if err != nil {
+		log.Debug("Unable to stat thumbnail, skipping", zap.Any("Info", obj))
+		return actions
+	}
+
+	oldThumb := deviceThumbs.Find(obj.ThumbName)
+	if oldThumb != nil {
+		actions = append(actions, makeAction(dstActor, "Remove", oldThumb, log))
+		dstOIS.Delete(oldThumb.FullPath)
+		deviceThumbs.Delete(obj.ThumbName)
+	}
+	thumb := &objects.ObjectInfo{
+		Name:       obj.ThumbName,
+		File:       true,
+		Modified:   obj.Modified,
+		ObjSize:    fi.Size(),
+		FullPath:   to,
+		ObjectName: from,
+		OIS:        dstOIS,
+	}
+	actions = append(actions, makeAction(dstActor, "Copy", thumb, log))
+	deviceThumbs.Add(obj.ThumbName, thumb)
+	dstOIS.Add(to, thumb)
+	return actions
+}
+
+// cachedThumbPath returns location of the book thumbnail in thumbnail cache.
+func cachedThumbPath(cfg *config.Config, obj *objects.ObjectInfo) string {
+	return thumbs.CachePath(cfg.Thumbnails.Dir, thumbs.CacheKey(obj.PersistentID, obj.CoverID), obj.ThumbName)
+}
+
+// lookupThumbnail sets thumbnail name of the book when source driver could extract it.
+func lookupThumbnail(ctx context.Context, actor driver, obj *objects.ObjectInfo) {
+	if t, ok := actor.(thumbnailer); ok {
+		obj.ThumbName = t.Thumbnail(ctx, obj)
+	}
+}
+
+// verifyDeviceBook compares local book with its device copy, returning reason for the difference or empty string when
+// device copy could be adopted. Sizes are compared first, content is only hashed when driver supports it.
+func verifyDeviceBook(ctx context.Context, local, device *objects.ObjectInfo, actor driver, log *zap.Logger) string {
+	if local.ObjSize != device.ObjSize {
+		return fmt.Sprintf("size mismatch: local %d, device %d", local.ObjSize, device.ObjSize)
+	}
+	h, ok := actor.(hasher)
+	if !ok {
+		log.Info("Device book adopted", zap.String("book", device.FullPath), zap.String("verified by", "size"))
+		return ""
+	}
+	hash, err := h.Hash(ctx, device)
+	if err != nil {
+		return fmt.Sprintf("unable to hash device copy: %v", err)
+	}
+	if hash != local.PersistentID {
+		return "content mismatch"
+	}
+	log.Info("Device book adopted", zap.String("book", device.FullPath), zap.String("verified by", "content"))
+	return ""
+}
+
+// findMovedBook looks for the history book among device books unknown to history, returning key of the
+// matching device book or empty string. Name and size are compared first, content is only hashed when
+// driver supports it and only for books of the same size.
+func findMovedBook(ctx context.Context, hobj *objects.ObjectInfo, candidates objects.ObjectInfoSet, actor driver, log *zap.Logger) string {
+	h, canHash := actor.(hasher)
+	for _, key := range slices.Sorted(maps.Keys(candidates)) {
+		dobj := candidates[key]
+		if dobj.ObjSize != hobj.ObjSize {
+			continue
+		}
+		if dobj.Name == hobj.Name {
+			return key
+		}
+		if !canHash {
+			continue
+		}
+		hash, err := h.Hash(ctx, dobj)
+		if err != nil {
+			log.Warn("Unable to hash device book, skipping", zap.String("book", dobj.FullPath), zap.Error(err))
+			continue
+		}
+		if hash == hobj.PersistentID {
+			return key
+		}
+	}
+	return ""
+}
+
+// makeMoveActions creates actions to move "obj" to "to", creating necessary folders starting from "dstRoot" and
+// removing folders left empty after the move all the way up to the "srcRoot" (not inclusive).
+func makeMoveActions(actions []action, obj *objects.ObjectInfo, to, srcRoot, dstRoot string, set objects.ObjectInfoSet, actor driver, log *zap.Logger) []action {
+	relDir := "."
+	if rel, ok := cutRoot(path.Dir(to), dstRoot); ok {
+		relDir = rel
+	}
+	actions = makeCreateDirActions(actions, relDir, dstRoot, set, actor, log)
+
+	from := obj.FullPath
+	moved := *obj
+	moved.Name = path.Base(to)
+	moved.FullPath = to
+	set.Delete(from)
+	set.Add(to, &moved)
+	if obj.Dir {
+		// directory is moved with everything in it
+		children := set.SubsetByFunc(func(k string, _ *objects.ObjectInfo) bool {
+			_, ok := cutRoot(k, from)
+			return ok
+		})
+		for k, v := range children {
+			rel, _ := cutRoot(k, from)
+			set.Delete(k)
+			set.Add(path.Join(to, rel), v)
+		}
+	}
+
+	o := &objects.ObjectInfo{
+		Name:       moved.Name,
+		Dir:        obj.Dir,
+		File:       obj.File,
+		ObjSize:    obj.ObjSize,
+		FullPath:   to,   // new path, where to move to
+		ObjectName: from, // original path, where to move from
+		Oid:        obj.Oid,
+		OIS:        set,
+	}
+	actions = append(actions, makeAction(actor, "Move", o, log))
+
+	return makeRemoveDirActions(actions, path.Dir(from), srcRoot, set, actor, log)
 }
 
 // getSupplementalArtifactsPaths returns a list of names of some additional artifacts (page index files and such)
@@ -284,13 +639,13 @@ func getSupplementalArtifactsPaths(fullPath string) []string {
 	}
 }
 
-func makeAction(actor driver, action string, obj *objects.ObjectInfo, log *zap.Logger) action {
+func makeAction(actor driver, name string, obj *objects.ObjectInfo, log *zap.Logger) action {
 	if obj == nil {
 		panic("making action with nil object")
 	}
 
 	v := reflect.ValueOf(actor)
-	method := v.MethodByName(action)
+	method := v.MethodByName(name)
 	if !method.IsValid() {
 		panic("making action driver method not found")
 	}
@@ -301,20 +656,29 @@ func makeAction(actor driver, action string, obj *objects.ObjectInfo, log *zap.L
 	}
 
 	log.Debug("Making action",
-		zap.String("action", action), zap.String("actor", actor.Name()), zap.String("subject", subjectName), zap.String("object", obj.FullPath))
+		zap.String("action", name), zap.String("actor", actor.Name()), zap.String("subject", subjectName), zap.String("object", obj.FullPath))
 
-	return func(dryRun bool, log *zap.Logger) error {
-		log.Named(actor.Name()).Info("Executing", zap.String("action", action), zap.String(subjectName, obj.FullPath))
+	return action{run: func(ctx context.Context, dryRun bool, log *zap.Logger) error {
+		log.Named(actor.Name()).Info("Executing", zap.String("action", name), zap.String(subjectName, obj.FullPath))
 
 		if dryRun {
 			return nil
 		}
 
-		res := method.Call([]reflect.Value{reflect.ValueOf(obj)})
+		res := method.Call([]reflect.Value{reflect.ValueOf(ctx), reflect.ValueOf(obj)})
 		if len(res) > 0 && !res[0].IsNil() {
 			return res[0].Interface().(error)
 		}
 		return nil
+	}}
+}
+
+// tagActions marks actions as belonging to the books, actions already belonging to some books are not changed.
+func tagActions(actions []action, books ...string) {
+	for i := range actions {
+		if len(actions[i].books) == 0 {
+			actions[i].books = books
+		}
 	}
 }
 
@@ -349,27 +713,24 @@ func makeRemoveDirActions(actions []action, dir, root string, src objects.Object
 	return makeRemoveDirActions(actions, filepath.ToSlash(filepath.Dir(dir)), root, src, actor, log)
 }
 
-// makeCopyActions creates actions to copy files from the source "obj.FullPath" to the device, making
-// sure that all necessary "parent" folders on the device are created first. Part of the source path relative to
-// "rootSrc" will be created on the device relative to "rootDst" if necessary.
-func makeCopyActions(actions []action, obj *objects.ObjectInfo, rootSrc, rootDst string, dst objects.ObjectInfoSet, actor driver, email bool, log *zap.Logger) []action {
-	var dstPath string
+// makeCopyActions creates actions to copy files from the source "obj.FullPath" to the device "dstPath", making
+// sure that all necessary "parent" folders on the device are created first. Part of the destination path relative
+// to "root" will be created on the device if necessary.
+func makeCopyActions(actions []action, obj *objects.ObjectInfo, root, dstPath string, dst objects.ObjectInfoSet, actor driver, email bool, log *zap.Logger) []action {
 	if !email {
-		// we need to re-root every path from source to destination
-		relPath := strings.TrimPrefix(obj.FullPath, rootSrc+"/")
-		actions = makeCreateDirActions(actions, path.Dir(relPath), rootDst, dst, actor, log)
-		dstPath = path.Join(rootDst, relPath)
+		relDir := "."
+		if rel, ok := cutRoot(path.Dir(dstPath), root); ok {
+			relDir = rel
+		}
+		actions = makeCreateDirActions(actions, relDir, root, dst, actor, log)
 
 		// If we do not remove files on device before copying updates Windows Explorer gets really confused.
 		if prevObj := dst.Find(dstPath); prevObj != nil && !prevObj.Dir {
 			actions = append(actions, makeAction(actor, "Remove", prevObj, log))
 			dst.Delete(dstPath)
 		}
-
-	} else {
-		// there is no need to re-root anything for e-mail, this is only used for diagnostics
-		dstPath = strings.TrimPrefix(obj.FullPath, rootSrc+"/")
 	}
+	// NOTE: there is no need to re-root anything for e-mail, path is only used for diagnostics
 
 	o := &objects.ObjectInfo{
 		Name:         obj.Name,
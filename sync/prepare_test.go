@@ -1,6 +1,7 @@
 package sync
 
 import (
+	"context"
 	"encoding/json"
 	"testing"
 
@@ -108,22 +109,22 @@ func (ta *testActor) UniqueID() string {
 	return "sn-" + ta.name
 }
 
-func (ta *testActor) MkDir(_ *objects.ObjectInfo) error {
+func (ta *testActor) MkDir(_ context.Context, _ *objects.ObjectInfo) error {
 	ta.directories++
 	return nil
 }
 
-func (ta *testActor) Remove(_ *objects.ObjectInfo) error {
+func (ta *testActor) Remove(_ context.Context, _ *objects.ObjectInfo) error {
 	ta.deletions++
 	return nil
 }
 
-func (ta *testActor) Copy(*objects.ObjectInfo) error {
+func (ta *testActor) Copy(context.Context, *objects.ObjectInfo) error {
 	ta.additions++
 	return nil
 }
 
-func (ta *testActor) GetObjectInfos() (objects.ObjectInfoSet, error) {
+func (ta *testActor) GetObjectInfos(context.Context) (objects.ObjectInfoSet, error) {
 	return ta.set, nil
 }
 
@@ -166,12 +167,12 @@ func TestPrepareActions(t *testing.T) {
 		if err != nil {
 			t.Fatalf("Failed to unmarshal history object info set: %v", err)
 		}
-		actions, _, err := PrepareActions(src, dst, hst, cfg, false, false, log)
+		actions, _, _, err := PrepareActions(context.Background(), src, dst, hst, cfg, Options{}, log)
 		if err != nil {
 			t.Fatalf("Failed to prepare actions: %v", err)
 		}
 		for _, action := range actions {
-			if err := action(false, log); err != nil {
+			if err := action.run(context.Background(), false, log); err != nil {
 				t.Fatalf("Action failed: %v", err)
 			}
 		}
@@ -188,3 +189,184 @@ func TestPrepareActions(t *testing.T) {
 			dst.directories+src.directories, dst.additions+src.additions, dst.deletions+src.deletions)
 	}
 }
+
+type testHashActor struct {
+	testActor
+	hashes map[string]string
+}
+
+func (ta *testHashActor) Hash(_ context.Context, obj *objects.ObjectInfo) (string, error) {
+	return ta.hashes[obj.FullPath], nil
+}
+
+func TestPrepareActionsUnknownToHistory(t *testing.T) {
+	cfg, err := config.LoadConfiguration("")
+	if err != nil {
+		t.Fatalf("Failed to load configuration: %v", err)
+	}
+	cfg.SourcePath = `D:/test/out`
+	cfg.TargetPath = `documents/test`
+
+	log := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+
+	src := &testActor{name: "local", set: objects.ObjectInfoSet{
+		"D:/test/out":         {Name: "out", Dir: true, FullPath: "D:/test/out"},
+		"D:/test/out/01.azw3": {Name: "01.azw3", File: true, PersistentID: "01", ObjSize: 100, FullPath: "D:/test/out/01.azw3"},
+		"D:/test/out/02.azw3": {Name: "02.azw3", File: true, PersistentID: "02", ObjSize: 100, FullPath: "D:/test/out/02.azw3"},
+		"D:/test/out/03.azw3": {Name: "03.azw3", File: true, PersistentID: "03", ObjSize: 100, FullPath: "D:/test/out/03.azw3"},
+	}}
+	hst := &testActor{name: "history", set: objects.ObjectInfoSet{}}
+	devSet := objects.ObjectInfoSet{
+		"documents":              {Name: "documents", Dir: true, FullPath: "documents"},
+		"documents/test":         {Name: "test", Dir: true, FullPath: "documents/test"},
+		"documents/test/01.azw3": {Name: "01.azw3", File: true, ObjSize: 100, FullPath: "documents/test/01.azw3"},
+		"documents/test/02.azw3": {Name: "02.azw3", File: true, ObjSize: 100, FullPath: "documents/test/02.azw3"},
+		"documents/test/03.azw3": {Name: "03.azw3", File: true, ObjSize: 50, FullPath: "documents/test/03.azw3"},
+	}
+
+	// size only: 03 differs
+	dst := &testActor{name: "device", set: devSet}
+	actions, _, _, err := PrepareActions(context.Background(), src, dst, hst, cfg, Options{}, log)
+	if err != nil {
+		t.Fatalf("Failed to prepare actions: %v", err)
+	}
+	for _, action := range actions {
+		if err := action.run(context.Background(), false, log); err != nil {
+			t.Fatalf("Action failed: %v", err)
+		}
+	}
+	if dst.deletions != 1 || dst.additions != 1 {
+		t.Fatalf("Expected 1 deletion and 1 addition on device, got %d, %d", dst.deletions, dst.additions)
+	}
+
+	// content hash: 02 and 03 differ
+	hdst := &testHashActor{testActor: testActor{name: "device", set: devSet}, hashes: map[string]string{
+		"documents/test/01.azw3": "01",
+		"documents/test/02.azw3": "changed",
+	}}
+	actions, _, _, err = PrepareActions(context.Background(), src, hdst, hst, cfg, Options{}, log)
+	if err != nil {
+		t.Fatalf("Failed to prepare actions: %v", err)
+	}
+	for _, action := range actions {
+		if err := action.run(context.Background(), false, log); err != nil {
+			t.Fatalf("Action failed: %v", err)
+		}
+	}
+	if hdst.deletions != 2 || hdst.additions != 2 || src.deletions != 0 {
+		t.Fatalf("Expected 2 deletions and 2 additions on device, got %d, %d", hdst.deletions, hdst.additions)
+	}
+}
+
+type testMoveActor struct {
+	testActor
+	moves int
+}
+
+func (ta *testMoveActor) Move(context.Context, *objects.ObjectInfo) error {
+	ta.moves++
+	return nil
+}
+
+func TestPrepareActionsMovedOnDevice(t *testing.T) {
+	cfg, err := config.LoadConfiguration("")
+	if err != nil {
+		t.Fatalf("Failed to load configuration: %v", err)
+	}
+	cfg.SourcePath = `D:/test/out`
+	cfg.TargetPath = `documents/test`
+
+	log := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+
+	src := &testMoveActor{testActor: testActor{name: "local", set: objects.ObjectInfoSet{
+		"D:/test/out":           {Name: "out", Dir: true, FullPath: "D:/test/out"},
+		"D:/test/out/01":        {Name: "01", Dir: true, FullPath: "D:/test/out/01"},
+		"D:/test/out/01/a.azw3": {Name: "a.azw3", File: true, PersistentID: "a", ObjSize: 100, FullPath: "D:/test/out/01/a.azw3"},
+		"D:/test/out/b.azw3":    {Name: "b.azw3", File: true, PersistentID: "b", ObjSize: 200, FullPath: "D:/test/out/b.azw3"},
+		"D:/test/out/c.azw3":    {Name: "c.azw3", File: true, PersistentID: "c", ObjSize: 300, FullPath: "D:/test/out/c.azw3"},
+	}}}
+	hst := &testActor{name: "history", set: objects.ObjectInfoSet{
+		"01/a.azw3": {Name: "a.azw3", File: true, PersistentID: "a", ObjSize: 100, FullPath: "D:/test/out/01/a.azw3"},
+		"b.azw3":    {Name: "b.azw3", File: true, PersistentID: "b", ObjSize: 200, FullPath: "D:/test/out/b.azw3"},
+		"c.azw3":    {Name: "c.azw3", File: true, PersistentID: "c", ObjSize: 300, FullPath: "D:/test/out/c.azw3"},
+	}}
+	dst := &testHashActor{testActor: testActor{name: "device", set: objects.ObjectInfoSet{
+		"documents":                 {Name: "documents", Dir: true, FullPath: "documents"},
+		"documents/test":            {Name: "test", Dir: true, FullPath: "documents/test"},
+		"documents/test/new":        {Name: "new", Dir: true, FullPath: "documents/test/new"},
+		"documents/test/new/a.azw3": {Name: "a.azw3", File: true, ObjSize: 100, FullPath: "documents/test/new/a.azw3"},
+		"documents/test/b2.azw3":    {Name: "b2.azw3", File: true, ObjSize: 200, FullPath: "documents/test/b2.azw3"},
+	}}, hashes: map[string]string{
+		"documents/test/b2.azw3": "b",
+	}}
+
+	actions, local, _, err := PrepareActions(context.Background(), src, dst, hst, cfg, Options{}, log)
+	if err != nil {
+		t.Fatalf("Failed to prepare actions: %v", err)
+	}
+	for _, action := range actions {
+		if err := action.run(context.Background(), false, log); err != nil {
+			t.Fatalf("Action failed: %v", err)
+		}
+	}
+	// "c.azw3" was removed from device, "01" directory is left empty after the move
+	if src.moves != 2 || src.deletions != 2 || src.directories != 1 {
+		t.Fatalf("Expected 2 local moves, 2 deletions and 1 directory, got %d, %d, %d", src.moves, src.deletions, src.directories)
+	}
+	if dst.deletions != 0 || dst.additions != 0 {
+		t.Fatalf("Expected no device changes, got %d deletions and %d additions", dst.deletions, dst.additions)
+	}
+	for _, p := range []string{"D:/test/out/new/a.azw3", "D:/test/out/b2.azw3"} {
+		if local.Find(p) == nil {
+			t.Fatalf("Moved book '%s' is not in the local set", p)
+		}
+	}
+	if local.Find("D:/test/out/01") != nil {
+		t.Fatalf("Empty local directory was not removed")
+	}
+}
+
+func TestPrepareActionsOffline(t *testing.T) {
+	cfg, err := config.LoadConfiguration("")
+	if err != nil {
+		t.Fatalf("Failed to load configuration: %v", err)
+	}
+	cfg.SourcePath = `D:/test/out`
+	cfg.TargetPath = `documents/test`
+
+	log := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+
+	src := &testActor{name: "local", set: objects.ObjectInfoSet{
+		"D:/test/out":           {Name: "out", Dir: true, FullPath: "D:/test/out"},
+		"D:/test/out/01":        {Name: "01", Dir: true, FullPath: "D:/test/out/01"},
+		"D:/test/out/01/a.azw3": {Name: "a.azw3", File: true, PersistentID: "a", ObjSize: 100, FullPath: "D:/test/out/01/a.azw3"},
+		"D:/test/out/c.azw3":    {Name: "c.azw3", File: true, PersistentID: "c", ObjSize: 300, FullPath: "D:/test/out/c.azw3"},
+		"D:/test/out/d.azw3":    {Name: "d.azw3", File: true, PersistentID: "d2", ObjSize: 400, FullPath: "D:/test/out/d.azw3"},
+	}}
+	hst := &testActor{name: "history", set: objects.ObjectInfoSet{
+		"01/a.azw3": {Name: "a.azw3", File: true, PersistentID: "a", ObjSize: 100, FullPath: "D:/test/out/01/a.azw3", DevicePath: "documents/other/01/a.azw3"},
+		"b.azw3":    {Name: "b.azw3", File: true, PersistentID: "b", ObjSize: 200, FullPath: "D:/test/out/b.azw3"},
+		"b.apnx":    {Name: "b.apnx", File: true, ObjSize: 10, FullPath: "D:/test/out/b.apnx"},
+		"d.azw3":    {Name: "d.azw3", File: true, PersistentID: "d", ObjSize: 400, FullPath: "D:/test/out/d.azw3"},
+	}}
+	// offline device knows nothing, history is the device
+	dst := &testActor{name: "device", set: objects.New()}
+
+	// "a.azw3" was routed to "documents/other" by rules which are gone now
+	actions, _, _, err := PrepareActions(context.Background(), src, dst, hst, cfg, Options{Offline: true}, log)
+	if err != nil {
+		t.Fatalf("Failed to prepare actions: %v", err)
+	}
+	for _, action := range actions {
+		if err := action.run(context.Background(), false, log); err != nil {
+			t.Fatalf("Action failed: %v", err)
+		}
+	}
+	// removed locally: "b.azw3" with page index, rerouted: "a.azw3", changed: old "d.azw3"
+	if dst.deletions != 4 || dst.additions != 3 || dst.directories != 1 {
+		t.Fatalf("Expected 4 device deletions, 3 additions and 1 directory, got %d, %d, %d", dst.deletions, dst.additions, dst.directories)
+	}
+	if src.deletions != 0 {
+		t.Fatalf("Expected no local deletions, got %d", src.deletions)
+	}
+}
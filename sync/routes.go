@@ -0,0 +1,125 @@
+package sync
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"sync2kindle/config"
+	"sync2kindle/objects"
+)
+
+// route sends books matching pattern (relative to the source) to its own folder on the device.
+type route struct {
+	pattern []string // pattern split into path elements
+	prefix  string   // literal leading directories of the pattern, not reproduced on the device
+	target  string
+}
+
+// router maps books between local source and device using configured routing rules. Books which do not
+// match any rule go to the target keeping their relative layout.
+type router struct {
+	target string
+	routes []route
+}
+
+func newRouter(cfg *config.Config) (*router, error) {
+	r := &router{target: cfg.TargetPath}
+	for _, rc := range cfg.Routes {
+		p := strings.Trim(rc.Pattern, "/")
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("bad routing pattern '%s': %w", rc.Pattern, err)
+		}
+		rt := route{target: rc.TargetPath}
+		if !strings.Contains(p, "/") {
+			// pattern without directories matches file name at any depth
+			rt.pattern = []string{"**", p}
+		} else {
+			rt.pattern = strings.Split(p, "/")
+			var prefix []string
+			for _, elem := range rt.pattern[:len(rt.pattern)-1] {
+				if strings.ContainsAny(elem, `*?[\`) {
+					break
+				}
+				prefix = append(prefix, elem)
+			}
+			rt.prefix = strings.Join(prefix, "/")
+		}
+		r.routes = append(r.routes, rt)
+	}
+	return r, nil
+}
+
+// toDevice returns root folder and full device path for the book with given path relative to the source.
+func (r *router) toDevice(rel string) (string, string) {
+	for _, rt := range r.routes {
+		if matchElems(rt.pattern, strings.Split(rel, "/")) {
+			if len(rt.prefix) > 0 {
+				rel = strings.TrimPrefix(rel, rt.prefix+"/")
+			}
+			return rt.target, path.Join(rt.target, rel)
+		}
+	}
+	return r.target, path.Join(r.target, rel)
+}
+
+// devicePath returns full device path for the book with given path relative to the source.
+func (r *router) devicePath(rel string) string {
+	_, p := r.toDevice(rel)
+	return p
+}
+
+// toLocal maps device path back to the path relative to the source. Since the same device folder could be
+// reached by different rules, mapping is only accepted when the book would be routed to the very same place.
+func (r *router) toLocal(devPath string) (string, bool) {
+	for _, rt := range r.routes {
+		if rel, ok := cutRoot(devPath, rt.target); ok {
+			if len(rt.prefix) > 0 {
+				rel = path.Join(rt.prefix, rel)
+			}
+			if r.devicePath(rel) == devPath {
+				return rel, true
+			}
+		}
+	}
+	if rel, ok := cutRoot(devPath, r.target); ok && r.devicePath(rel) == devPath {
+		return rel, true
+	}
+	return "", false
+}
+
+// recordedDevicePath returns device path where history book was sent.
+func recordedDevicePath(cfg *config.Config, key string, hobj *objects.ObjectInfo) string {
+	if len(hobj.DevicePath) == 0 {
+		// history from before routing rules were introduced
+		return path.Join(cfg.TargetPath, key)
+	}
+	return hobj.DevicePath
+}
+
+func cutRoot(p, root string) (string, bool) {
+	rel, ok := strings.CutPrefix(p, root+"/")
+	return rel, ok && len(rel) > 0
+}
+
+// matchElems matches path elements against pattern elements, "**" matches any number of elements.
+func matchElems(pattern, elems []string) bool {
+	if len(pattern) == 0 {
+		return len(elems) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(elems); i++ {
+			if matchElems(pattern[1:], elems[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(elems) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pattern[0], elems[0]); !ok {
+		return false
+	}
+	return matchElems(pattern[1:], elems[1:])
+}
@@ -0,0 +1,129 @@
+package sync
+
+import (
+	"context"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+
+	"sync2kindle/config"
+	"sync2kindle/objects"
+)
+
+func TestRouter(t *testing.T) {
+	cfg := &config.Config{
+		TargetPath: "documents/mybooks",
+		Routes: []config.RouteConfig{
+			{Pattern: "*.pdf", TargetPath: "documents/pdfs"},
+			{Pattern: "manga/**", TargetPath: "documents/manga"},
+		},
+	}
+	rt, err := newRouter(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create router: %v", err)
+	}
+
+	for _, c := range []struct{ rel, root, dev string }{
+		{"01.azw3", "documents/mybooks", "documents/mybooks/01.azw3"},
+		{"scifi/01.azw3", "documents/mybooks", "documents/mybooks/scifi/01.azw3"},
+		{"01.pdf", "documents/pdfs", "documents/pdfs/01.pdf"},
+		{"scifi/01.pdf", "documents/pdfs", "documents/pdfs/scifi/01.pdf"},
+		{"manga/01.azw3", "documents/manga", "documents/manga/01.azw3"},
+		{"manga/series/01.azw3", "documents/manga", "documents/manga/series/01.azw3"},
+	} {
+		root, dev := rt.toDevice(c.rel)
+		if root != c.root || dev != c.dev {
+			t.Fatalf("'%s' routed to '%s' ('%s'), expected '%s' ('%s')", c.rel, dev, root, c.dev, c.root)
+		}
+		rel, ok := rt.toLocal(dev)
+		if !ok || rel != c.rel {
+			t.Fatalf("'%s' mapped back to '%s' (%t), expected '%s'", dev, rel, ok, c.rel)
+		}
+	}
+
+	for _, dev := range []string{
+		"documents/mybooks/01.pdf", // would be routed elsewhere
+		"documents/mybooks/manga/01.azw3",
+		"documents/pdfs/01.azw3",
+		"documents/other/01.azw3",
+		"documents/mybooks",
+	} {
+		if rel, ok := rt.toLocal(dev); ok {
+			t.Fatalf("'%s' unexpectedly mapped back to '%s'", dev, rel)
+		}
+	}
+
+	cfg.Routes = []config.RouteConfig{{Pattern: "[", TargetPath: "documents/bad"}}
+	if _, err := newRouter(cfg); err == nil {
+		t.Fatal("Bad pattern accepted")
+	}
+}
+
+func TestRecordedDevicePath(t *testing.T) {
+	cfg := &config.Config{TargetPath: "documents/mybooks"}
+	for _, c := range []struct {
+		hobj *objects.ObjectInfo
+		dev  string
+	}{
+		{&objects.ObjectInfo{Name: "01.pdf", DevicePath: "documents/pdfs/01.pdf"}, "documents/pdfs/01.pdf"},
+		// history from before routing rules were introduced
+		{&objects.ObjectInfo{Name: "01.pdf"}, "documents/mybooks/scifi/01.pdf"},
+	} {
+		if dev := recordedDevicePath(cfg, "scifi/01.pdf", c.hobj); dev != c.dev {
+			t.Fatalf("Expected '%s', got '%s'", c.dev, dev)
+		}
+	}
+}
+
+func TestPrepareActionsRerouted(t *testing.T) {
+	cfg, err := config.LoadConfiguration("")
+	if err != nil {
+		t.Fatalf("Failed to load configuration: %v", err)
+	}
+	cfg.SourcePath = `D:/test/out`
+	cfg.TargetPath = `documents/test`
+	cfg.Routes = []config.RouteConfig{{Pattern: "*.pdf", TargetPath: "documents/pdfs"}}
+
+	log := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+
+	src := &testActor{name: "local", set: objects.ObjectInfoSet{
+		"D:/test/out":        {Name: "out", Dir: true, FullPath: "D:/test/out"},
+		"D:/test/out/01.pdf": {Name: "01.pdf", File: true, PersistentID: "01", FullPath: "D:/test/out/01.pdf"},
+		"D:/test/out/02.pdf": {Name: "02.pdf", File: true, PersistentID: "02", FullPath: "D:/test/out/02.pdf"},
+	}}
+	hst := &testActor{name: "history", set: objects.ObjectInfoSet{
+		// old history without device path
+		"01.pdf": {Name: "01.pdf", File: true, PersistentID: "01", FullPath: "D:/test/out/01.pdf"},
+		// already routed
+		"02.pdf": {Name: "02.pdf", File: true, PersistentID: "02", FullPath: "D:/test/out/02.pdf", DevicePath: "documents/pdfs/02.pdf"},
+	}}
+	dst := &testActor{name: "device", set: objects.ObjectInfoSet{
+		"documents":                {Name: "documents", Dir: true, FullPath: "documents"},
+		"documents/test":           {Name: "test", Dir: true, FullPath: "documents/test"},
+		"documents/test/01.pdf":    {Name: "01.pdf", File: true, FullPath: "documents/test/01.pdf"},
+		"documents/test/01.apnx":   {Name: "01.apnx", File: true, FullPath: "documents/test/01.apnx"},
+		"documents/pdfs":           {Name: "pdfs", Dir: true, FullPath: "documents/pdfs"},
+		"documents/pdfs/02.pdf":    {Name: "02.pdf", File: true, FullPath: "documents/pdfs/02.pdf"},
+		"documents/pdfs/other.pdf": {Name: "other.pdf", File: true, FullPath: "documents/pdfs/other.pdf"},
+	}}
+
+	actions, local, _, err := PrepareActions(context.Background(), src, dst, hst, cfg, Options{}, log)
+	if err != nil {
+		t.Fatalf("Failed to prepare actions: %v", err)
+	}
+	for _, action := range actions {
+		if err := action.run(context.Background(), false, log); err != nil {
+			t.Fatalf("Action failed: %v", err)
+		}
+	}
+	if src.deletions != 0 {
+		t.Fatalf("Expected no local deletions, got %d", src.deletions)
+	}
+	if dst.deletions != 2 || dst.additions != 1 || dst.directories != 0 {
+		t.Fatalf("Expected 2 deletions and 1 addition on device, got %d, %d (%d directories)", dst.deletions, dst.additions, dst.directories)
+	}
+	if p := local.Find("D:/test/out/01.pdf").DevicePath; p != "documents/pdfs/01.pdf" {
+		t.Fatalf("Unexpected device path recorded: %s", p)
+	}
+}
@@ -1,10 +1,13 @@
 package sync
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 
@@ -17,7 +20,9 @@ import (
 	"sync2kindle/history"
 	"sync2kindle/mail"
 	"sync2kindle/mtp"
+	"sync2kindle/objects"
 	"sync2kindle/state"
+	"sync2kindle/thumbs"
 	"sync2kindle/usbms"
 )
 
@@ -69,39 +74,215 @@ func Sync(ctx *cli.Context, protocol common.SupportedProtocols) error {
 			zap.Duration("elapsed", time.Since(start)))
 	}(time.Now())
 
-	// Source: local file system
+	jobs := prepareJobs(env.Cfg, protocol, ctx.Bool("ignore-device-removals"), log)
+	if only := ctx.StringSlice("only"); len(only) > 0 {
+		sel, err := newSelection(only, env.Cfg.BookExtensions)
+		if err != nil {
+			return err
+		}
+		if len(jobs) > 1 {
+			log.Info("Only selected books are synchronized, content channels are skipped", zap.Strings("only", only))
+		}
+		jobs = jobs[:1]
+		jobs[0].opts.only = sel
+	}
+
+	// Target: device, single session for all jobs
+
+	lock, err := lockDevice(ctx, protocol, env.Cfg, log)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	var dev driver
+	if ctx.Bool("offline") {
+		log.Warn("Offline planning, device is assumed to hold what the last sync has sent, books removed from the device since then cannot be known")
+		for i := range jobs {
+			jobs[i].opts.Offline = true
+		}
+		dev, err = connectOffline(protocol, env.Cfg)
+	} else {
+		dev, err = connectDevice(ctx, protocol, devicePaths(jobs), env)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to connect to device: %w", err)
+	}
+	defer dev.Disconnect()
 
 	// do not look at thumbnails if e-mail delivery is requested
-	var thumbsCfg *config.ThumbnailsConfig
 	if protocol != common.ProtocolMail {
-		thumbDir, err := os.MkdirTemp("", "s2k-t-")
-		if err != nil {
-			return fmt.Errorf("unable to create temporary directory: %w", err)
+		if err := prepareThumbsDir(env, dev, jobs, log); err != nil {
+			return err
+		}
+	}
+
+	for _, j := range jobs {
+		if err := runJob(ctx, j, protocol, dev, env, log); err != nil {
+			if len(j.name) == 0 {
+				return err
+			}
+			return fmt.Errorf("channel '%s': %w", j.name, err)
+		}
+	}
+	if protocol != common.ProtocolMail && !ctx.Bool("dry-run") && !ctx.Bool("offline") {
+		if err := evictThumbs(env.Cfg, log); err != nil {
+			log.Warn("Unable to evict cached thumbnails", zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// prepareThumbsDir selects thumbnail profile for the connected device and points configuration of all jobs to the
+// persistent thumbnail cache kept with history, thumbnails of the books are extracted there lazily.
+func prepareThumbsDir(env *state.LocalEnv, dev driver, jobs []job, log *zap.Logger) error {
+	params := &env.Cfg.Thumbnails
+	params.Color = thumbsColor(params.Profile, dev, log)
+
+	thumbDir := thumbs.CacheDir(thumbsCacheRoot(env.Cfg), params)
+	if err := os.MkdirAll(thumbDir, 0755); err != nil {
+		return fmt.Errorf("unable to create thumbnail cache directory: %w", err)
+	}
+	params.Dir = thumbDir
+	env.Rpt.Store("thumbs", thumbDir)
+
+	// content channels have their own copies of configuration
+	for _, j := range jobs {
+		j.cfg.Thumbnails.Color, j.cfg.Thumbnails.Dir = params.Color, params.Dir
+	}
+	return nil
+}
+
+// thumbsColor reports whether thumbnails should keep colors. With "auto" profile it depends on the model of connected
+// device, grayscale is used when device does not report its model.
+func thumbsColor(profile string, dev driver, log *zap.Logger) bool {
+	switch profile {
+	case config.ProfileColor:
+		return true
+	case config.ProfileMono:
+		return false
+	}
+	m, ok := dev.(modeler)
+	if !ok || len(m.Model()) == 0 {
+		log.Debug("Device model is unknown, using grayscale thumbnails")
+		return false
+	}
+	color := common.IsColorDevice(m.Model())
+	log.Info("Thumbnail profile selected", zap.String("model", m.Model()), zap.Bool("color", color))
+	return color
+}
+
+// thumbsCacheRoot returns location of the thumbnail cache.
+func thumbsCacheRoot(cfg *config.Config) string {
+	return filepath.Join(cfg.HistoryPath, "thumbnails")
+}
+
+// job is a single synchronization unit: either main source/target pair from configuration or one of
+// the additional content channels. Each job has its own history database.
+type job struct {
+	name   string // empty for the main books job
+	cfg    *config.Config
+	thumbs bool
+	opts   Options
+
+	history  string // history database when it is not at its usual place
+	migrated bool   // history was cloned from replaced device, new device has none of the books it knows about
+}
+
+func prepareJobs(cfg *config.Config, protocol common.SupportedProtocols, ignoreDeviceRemovals bool, log *zap.Logger) []job {
+	jobs := []job{{
+		cfg:    cfg,
+		thumbs: protocol != common.ProtocolMail,
+		opts: Options{
+			IgnoreDeviceRemovals: ignoreDeviceRemovals,
+			EMail:                protocol == common.ProtocolMail,
+		},
+	}}
+	if protocol == common.ProtocolMail {
+		if len(cfg.Channels) > 0 {
+			log.Warn("Content channels are not supported by e-mail delivery, ignoring", zap.Int("channels", len(cfg.Channels)))
+		}
+		return jobs
+	}
+	for _, ch := range cfg.Channels {
+		chCfg := *cfg
+		chCfg.SourcePath = ch.SourcePath
+		chCfg.TargetPath = ch.TargetPath
+		chCfg.BookExtensions = ch.Extensions
+		chCfg.Routes = nil
+		if len(cfg.Library) > 0 {
+			chCfg.Library = cfg.ChannelLibraryID(&ch)
 		}
-		env.Cfg.Thumbnails.Dir = thumbDir
-		env.Rpt.Store("thumbs", thumbDir)
+		jobs = append(jobs, job{
+			name:   ch.Name,
+			cfg:    &chCfg,
+			thumbs: ch.Thumbnails,
+			opts: Options{
+				IgnoreDeviceRemovals: ignoreDeviceRemovals || ch.Removals == config.RemovalsKeepLocal || ch.Removals == config.RemovalsKeepAll,
+				IgnoreLocalRemovals:  ch.Removals == config.RemovalsKeepAll,
+			},
+		})
+	}
+	return jobs
+}
+
+func runJob(ctx *cli.Context, j job, protocol common.SupportedProtocols, dev driver, env *state.LocalEnv, log *zap.Logger) error {
+	if len(j.name) > 0 {
+		log = log.With(zap.String("channel", j.name))
+		log.Info("Channel sync starting",
+			zap.String("source", j.cfg.SourcePath),
+			zap.String("target", j.cfg.TargetPath),
+		)
+	}
+
+	// Source: local file system
+
+	var thumbsCfg *config.ThumbnailsConfig
+	if j.thumbs {
 		// indicate that thumbs need to be processed
-		thumbsCfg = &env.Cfg.Thumbnails
+		thumbsCfg = &j.cfg.Thumbnails
 	}
 
-	src, err := files.Connect(env.Cfg.SourcePath, "", thumbsCfg, log)
+	src, err := files.Connect(j.cfg.SourcePath, "", thumbsCfg, log)
 	if err != nil {
 		return fmt.Errorf("bad source path: %w", err)
 	}
 	defer src.Disconnect()
 
-	// Target: device
-
-	dev, err := connectDevice(ctx, protocol, env)
-	if err != nil {
-		return fmt.Errorf("unable to connect to device: %w", err)
+	sel := j.opts.only
+	if sel != nil {
+		// do not waste time hashing what was not selected
+		src.Filter(func(key string, dir bool) bool {
+			rel, ok := cutRoot(key, j.cfg.SourcePath)
+			if !ok {
+				return true
+			}
+			if dir {
+				return sel.mayContain(rel)
+			}
+			return sel.has(rel)
+		})
 	}
-	defer dev.Disconnect()
 
 	// History: local DB
 
+	rptDir := "history"
+	if len(j.name) > 0 {
+		rptDir = path.Join(rptDir, j.name)
+	}
+
 	historyExists := true
-	historyPath := filepath.Join(env.Cfg.HistoryPath, history.GetName(protocol, dev.UniqueID(), env.Cfg.TargetPath))
+	historyPath := j.history
+	if len(historyPath) == 0 {
+		historyPath = filepath.Join(j.cfg.HistoryPath, history.GetName(protocol, dev.UniqueID(), j.cfg.TargetPath))
+	}
+
+	lock, err := history.Lock(historyPath, ctx.Duration("wait"), log)
+	if err != nil {
+		return fmt.Errorf("history database cannot be used: %w", err)
+	}
+	defer lock.Release()
+
 	_, err = os.Stat(historyPath)
 	if err != nil {
 		if !errors.Is(err, os.ErrNotExist) {
@@ -111,12 +292,17 @@ func Sync(ctx *cli.Context, protocol common.SupportedProtocols) error {
 	}
 	log.Debug("History database", zap.String("path", historyPath))
 
+	if !historyExists && j.opts.Offline {
+		log.Warn("No history, nothing to plan against", zap.String("target", j.cfg.TargetPath))
+		return nil
+	}
+
 	if !historyExists {
-		if err := history.Create(historyPath, log, protocol.String(), dev.UniqueID(), env.Cfg.TargetPath); err != nil {
+		if err := history.Create(historyPath, log, protocol.String(), dev.UniqueID(), j.cfg.TargetPath); err != nil {
 			return fmt.Errorf("unable to create new history database '%s': %w", historyPath, err)
 		}
 	} else {
-		env.Rpt.StoreCopy("history/original.db", historyPath)
+		env.Rpt.StoreCopy(path.Join(rptDir, "original.db"), historyPath)
 	}
 
 	hst, err := history.Connect(historyPath, log)
@@ -125,13 +311,25 @@ func Sync(ctx *cli.Context, protocol common.SupportedProtocols) error {
 	}
 	defer func() {
 		hst.Disconnect()
-		env.Rpt.Store("history/updated.db", historyPath)
+		env.Rpt.Store(path.Join(rptDir, "updated.db"), historyPath)
 	}()
+	if err := hst.SetShared(j.cfg.HistoryShared); err != nil {
+		return err
+	}
 	log.Debug("History last step", zap.Int64("stepID", hst.StepID()))
 
+	if protocol != common.ProtocolMail {
+		// thumbnails are shared with books of other targets on the device
+		refs, err := deviceThumbRefs(j.cfg.HistoryPath, dev.UniqueID(), filepath.Base(historyPath), log)
+		if err != nil {
+			return err
+		}
+		j.opts.shared = refs
+	}
+
 	// See if anything needs to be done
 
-	actions, localBooks, err := PrepareActions(src, dev, hst, env.Cfg, ctx.Bool("ignore-device-removals"), protocol == common.ProtocolMail, log)
+	actions, localBooks, deviceObjects, err := PrepareActions(ctx.Context, src, dev, hst, j.cfg, j.opts, log)
 	if err != nil {
 		return fmt.Errorf("unable to prepare sync actions: %w", err)
 	}
@@ -141,17 +339,48 @@ func Sync(ctx *cli.Context, protocol common.SupportedProtocols) error {
 
 	// do the work
 
-	dryRun := ctx.Bool("dry-run")
-	for _, action := range actions {
-		if err := action(dryRun, log); err != nil {
-			return fmt.Errorf("action failed: %w", err)
+	dryRun := ctx.Bool("dry-run") || j.opts.Offline
+	done, err := runActions(ctx.Context, actions, dryRun, log)
+	if err != nil {
+		if ctx.Context.Err() == nil || dryRun || (done == 0 && !j.migrated) {
+			return err
+		}
+		// interrupted, record what was completed so device and history stay consistent
+		prev, herr := hst.GetObjectInfos(context.WithoutCancel(ctx.Context))
+		if herr != nil {
+			return errors.Join(err, fmt.Errorf("history objects cannot be read: %w", herr))
 		}
+		base := prev
+		if j.migrated {
+			// books with pending actions are not on the new device, whatever cloned history says
+			base = objects.New()
+		}
+		ois := partialObjects(base, libraryObjects(j.cfg, localBooks), actions[done:])
+		if sel != nil {
+			ois = mergeSelection(prev, ois, sel)
+		}
+		ois = keepExternal(prev, ois, deviceObjects, j.cfg)
+		if herr := hst.SaveObjectInfos(j.cfg.LibraryID(), j.cfg.TargetPath, ois); herr != nil {
+			return errors.Join(err, fmt.Errorf("history objects cannot be saved: %w", herr))
+		}
+		log.Warn("Sync interrupted, history records completed actions only", zap.Int("done", done), zap.Int("total", len(actions)), zap.Int64("stepID", hst.StepID()))
+		return err
 	}
 
 	// Update history only if we had some actions or it is our first sync
 
 	if !dryRun && (len(actions) != 0 || hst.StepID() == 0) {
-		if err := hst.SaveObjectInfos(env.Cfg.SourcePath, env.Cfg.TargetPath, localBooks.SubsetByPath(env.Cfg.SourcePath)); err != nil {
+		prev, err := hst.GetObjectInfos(ctx.Context)
+		if err != nil {
+			return fmt.Errorf("history objects cannot be read: %w", err)
+		}
+		ois := libraryObjects(j.cfg, localBooks)
+		if sel != nil {
+			// books outside of selection stay as they were
+			ois = mergeSelection(prev, ois, sel)
+		}
+		ois = keepExternal(prev, ois, deviceObjects, j.cfg)
+		if err := hst.SaveObjectInfos(j.cfg.LibraryID(), j.cfg.TargetPath, ois); err != nil {
 			return fmt.Errorf("history objects cannot be saved: %w", err)
 		}
 		log.Debug("History next step", zap.Int64("stepID", hst.StepID()))
@@ -159,16 +388,135 @@ func Sync(ctx *cli.Context, protocol common.SupportedProtocols) error {
 	return nil
 }
 
-func connectDevice(ctx *cli.Context, protocol common.SupportedProtocols, env *state.LocalEnv) (driver, error) {
+// runActions executes actions in order until all are done or context is cancelled, returning number of completed
+// actions.
+func runActions(ctx context.Context, actions []action, dryRun bool, log *zap.Logger) (int, error) {
+	for i, a := range actions {
+		if err := ctx.Err(); err != nil {
+			return i, fmt.Errorf("sync interrupted: %w", err)
+		}
+		if err := a.run(ctx, dryRun, log); err != nil {
+			if ctx.Err() != nil {
+				return i, fmt.Errorf("action interrupted: %w", err)
+			}
+			return i, fmt.Errorf("action failed: %w", err)
+		}
+	}
+	return len(actions), nil
+}
+
+// partialObjects returns objects to be recorded in history when sync was interrupted: books with pending actions keep
+// their previous history state (or stay unknown to history), everything else is recorded as if sync was completed.
+func partialObjects(prev, next objects.ObjectInfoSet, pending []action) objects.ObjectInfoSet {
+	ois := next.Clone()
+	for _, a := range pending {
+		for _, key := range a.books {
+			if p, exists := prev[key]; exists {
+				ois[key] = p
+			} else {
+				delete(ois, key)
+			}
+		}
+	}
+	return ois
+}
+
+// libraryObjects returns local objects to be recorded in history. When library is named their paths are relative to
+// the source, so history does not depend on where library is mounted on particular computer.
+func libraryObjects(cfg *config.Config, ois objects.ObjectInfoSet) objects.ObjectInfoSet {
+	ois = ois.SubsetByPath(cfg.SourcePath)
+	if len(cfg.Library) == 0 {
+		return ois
+	}
+	rel := objects.New()
+	for k, v := range ois {
+		o := *v
+		o.FullPath = k
+		rel[k] = &o
+	}
+	return rel
+}
+
+// devicePaths returns device paths of interest for all jobs.
+func devicePaths(jobs []job) []string {
+	paths := make([]string, 0, len(jobs)+1)
+	for _, j := range jobs {
+		paths = append(paths, j.cfg.TargetPath)
+		for _, r := range j.cfg.Routes {
+			if !slices.Contains(paths, r.TargetPath) {
+				paths = append(paths, r.TargetPath)
+			}
+		}
+	}
+	return append(paths, common.ThumbnailFolder)
+}
+
+// lockDevice prevents other processes from syncing the same device while lock is held. Lock is taken before device is
+// connected, so it is keyed by configured device serial number or by protocol alone when serial is not specified. Lock
+// file is kept in history directory next to history locks, so it works across computers sharing history.
+func lockDevice(ctx *cli.Context, protocol common.SupportedProtocols, cfg *config.Config, log *zap.Logger) (*common.Lock, error) {
+	name := strings.TrimSuffix(history.GetName(protocol, cfg.DeviceSerial), ".db") + ".device.lock"
+	lock, err := common.AcquireLock(filepath.Join(cfg.HistoryPath, name), ctx.Duration("wait"), log)
+	if err != nil {
+		device := cfg.DeviceSerial
+		if len(device) == 0 {
+			device = protocol.String()
+		}
+		return nil, fmt.Errorf("device '%s' cannot be used: %w", device, err)
+	}
+	return lock, nil
+}
+
+// openJobHistory locks and opens existing history of the job on the device, returning its latest objects. When there
+// is no history yet nothing on the device is managed by sync and nil history is returned. Returned function releases
+// history and its lock.
+func openJobHistory(ctx *cli.Context, j job, protocol common.SupportedProtocols, dev driver, log *zap.Logger) (*history.Connection, objects.ObjectInfoSet, func(), error) {
+	historyPath := filepath.Join(j.cfg.HistoryPath, history.GetName(protocol, dev.UniqueID(), j.cfg.TargetPath))
+	lock, err := history.Lock(historyPath, ctx.Duration("wait"), log)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("history database cannot be used: %w", err)
+	}
+
+	if _, err := os.Stat(historyPath); err != nil {
+		lock.Release()
+		if errors.Is(err, os.ErrNotExist) {
+			log.Warn("No history, nothing on the device is managed by sync", zap.String("target", j.cfg.TargetPath))
+			return nil, nil, func() {}, nil
+		}
+		return nil, nil, nil, fmt.Errorf("history database '%s' cannot be accessed: %w", historyPath, err)
+	}
+
+	hst, err := history.Connect(historyPath, log)
+	if err != nil {
+		lock.Release()
+		return nil, nil, nil, fmt.Errorf("history cannot be opened: %w", err)
+	}
+	release := func() {
+		hst.Disconnect()
+		lock.Release()
+	}
+	if err := hst.SetShared(j.cfg.HistoryShared); err != nil {
+		release()
+		return nil, nil, nil, err
+	}
+	hstOIS, err := hst.GetObjectInfos(ctx.Context)
+	if err != nil {
+		release()
+		return nil, nil, nil, fmt.Errorf("history objects cannot be read: %w", err)
+	}
+	return hst, hstOIS, release, nil
+}
+
+func connectDevice(ctx *cli.Context, protocol common.SupportedProtocols, paths []string, env *state.LocalEnv) (driver, error) {
 	switch protocol {
 	case common.ProtocolUSB:
 		return usbms.Connect(
-			strings.Join([]string{env.Cfg.TargetPath, common.ThumbnailFolder}, string(filepath.ListSeparator)),
+			strings.Join(paths, string(filepath.ListSeparator)),
 			env.Cfg.DeviceSerial, ctx.Bool("unmount") && !ctx.Bool("dry-run"), env.Log.Named("sync"))
 	case common.ProtocolMTP:
 		return mtp.Connect(
-			strings.Join([]string{env.Cfg.TargetPath, common.ThumbnailFolder}, string(filepath.ListSeparator)),
-			env.Cfg.DeviceSerial, ctx.Bool("debug"), env.Log.Named("sync"))
+			strings.Join(paths, string(filepath.ListSeparator)),
+			env.Cfg.DeviceSerial, ctx.Bool("debug"), env.Cfg.Retry.MTP, env.Log.Named("sync"))
 	case common.ProtocolMail:
 		debug := ctx.Bool("debug")
 		if debug {
@@ -179,7 +527,7 @@ func connectDevice(ctx *cli.Context, protocol common.SupportedProtocols, env *st
 			env.Cfg.Smtp.Dir = mailDir
 			env.Rpt.Store("mails", mailDir)
 		}
-		return mail.Connect(env.Cfg.TargetPath, &env.Cfg.Smtp, debug, env.Log.Named("sync"))
+		return mail.Connect(env.Cfg.TargetPath, &env.Cfg.Smtp, debug, env.Cfg.Retry.Mail, env.Log.Named("sync"))
 	default:
 		return nil, fmt.Errorf("unsupported protocol requested for sync: %s", protocol)
 	}
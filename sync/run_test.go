@@ -0,0 +1,102 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+
+	"sync2kindle/common"
+	"sync2kindle/config"
+	"sync2kindle/objects"
+)
+
+func TestPrepareJobs(t *testing.T) {
+	cfg, err := config.LoadConfiguration("")
+	if err != nil {
+		t.Fatalf("Failed to load configuration: %v", err)
+	}
+	cfg.Channels = []config.ChannelConfig{
+		{Name: "fonts", SourcePath: "D:/fonts", TargetPath: "fonts", Extensions: []string{".ttf"}, Removals: config.RemovalsKeepAll},
+		{Name: "dicts", SourcePath: "D:/dicts", TargetPath: "documents/dictionaries", Extensions: []string{".mobi"}, Removals: config.RemovalsKeepLocal, Thumbnails: true},
+		{Name: "other", SourcePath: "D:/other", TargetPath: "documents/other", Extensions: []string{".pdf"}},
+	}
+
+	log := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+
+	jobs := prepareJobs(cfg, common.ProtocolUSB, false, log)
+	if len(jobs) != 4 {
+		t.Fatalf("Expected 4 jobs, got %d", len(jobs))
+	}
+	if jobs[0].cfg != cfg || !jobs[0].thumbs || jobs[0].opts != (Options{}) {
+		t.Fatalf("Unexpected main job: %+v", jobs[0])
+	}
+	if j := jobs[1]; j.cfg.TargetPath != "fonts" || j.cfg.BookExtensions[0] != ".ttf" || j.thumbs ||
+		!j.opts.IgnoreDeviceRemovals || !j.opts.IgnoreLocalRemovals {
+		t.Fatalf("Unexpected fonts job: %+v", j)
+	}
+	if j := jobs[2]; !j.thumbs || !j.opts.IgnoreDeviceRemovals || j.opts.IgnoreLocalRemovals {
+		t.Fatalf("Unexpected dictionaries job: %+v", j)
+	}
+	if j := jobs[3]; j.opts != (Options{}) {
+		t.Fatalf("Unexpected other job: %+v", j)
+	}
+	if cfg.TargetPath == jobs[1].cfg.TargetPath {
+		t.Fatal("Channel configuration changed main configuration")
+	}
+
+	jobs = prepareJobs(cfg, common.ProtocolUSB, true, log)
+	if !jobs[0].opts.IgnoreDeviceRemovals || !jobs[3].opts.IgnoreDeviceRemovals {
+		t.Fatal("Expected device removals to be ignored for all jobs")
+	}
+
+	jobs = prepareJobs(cfg, common.ProtocolMail, false, log)
+	if len(jobs) != 1 || !jobs[0].opts.EMail || jobs[0].thumbs {
+		t.Fatalf("Expected single e-mail job, got %+v", jobs)
+	}
+}
+
+func TestInterruptedActions(t *testing.T) {
+	log := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var executed int
+	run := func(context.Context, bool, *zap.Logger) error {
+		executed++
+		return nil
+	}
+	actions := []action{
+		{books: []string{"a.azw3"}, run: run},
+		{books: []string{"b.azw3"}, run: func(ctx context.Context, _ bool, _ *zap.Logger) error {
+			cancel()
+			return ctx.Err()
+		}},
+		{books: []string{"c.azw3"}, run: run},
+		{books: []string{"d.azw3"}, run: run},
+	}
+	done, err := runActions(ctx, actions, false, log)
+	if !errors.Is(err, context.Canceled) || done != 1 || executed != 1 {
+		t.Fatalf("Unexpected result: done %d, executed %d, %v", done, executed, err)
+	}
+
+	prev := objects.ObjectInfoSet{
+		"a.azw3": {Name: "a.azw3", PersistentID: "a"},
+		"b.azw3": {Name: "b.azw3", PersistentID: "b"},
+		"d.azw3": {Name: "d.azw3", PersistentID: "d"},
+	}
+	next := objects.ObjectInfoSet{
+		"a.azw3": {Name: "a.azw3", PersistentID: "a2"},
+		"b.azw3": {Name: "b.azw3", PersistentID: "b2"},
+		"c.azw3": {Name: "c.azw3", PersistentID: "c"},
+	}
+	ois := partialObjects(prev, next, actions[done:])
+	if len(ois) != 3 || ois["a.azw3"].PersistentID != "a2" || ois["b.azw3"].PersistentID != "b" || ois["d.azw3"].PersistentID != "d" {
+		t.Fatalf("Unexpected partial objects: %+v", ois)
+	}
+	if _, exists := ois["c.azw3"]; exists {
+		t.Fatal("Pending copy recorded in history")
+	}
+}
@@ -0,0 +1,122 @@
+package sync
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"sync2kindle/objects"
+)
+
+// selection restricts sync to books matching any of the patterns (relative to the source) together with their page
+// indexes. Patterns use the same syntax as routing rules, pattern without wildcards is a path of a book or a folder
+// with everything in it. Nil selection has everything.
+type selection struct {
+	patterns   [][]string // patterns split into path elements
+	extensions []string   // book extensions
+}
+
+func newSelection(patterns, extensions []string) (*selection, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	s := &selection{extensions: extensions}
+	for _, sp := range patterns {
+		p := strings.Trim(path.Clean("/"+strings.ReplaceAll(sp, `\`, "/")), "/")
+		if len(p) == 0 {
+			return nil, fmt.Errorf("bad selection '%s': empty", sp)
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("bad selection '%s': %w", sp, err)
+		}
+		switch {
+		case !strings.ContainsAny(p, `*?[`):
+			// book or folder
+			s.patterns = append(s.patterns, append(strings.Split(p, "/"), "**"))
+		case !strings.Contains(p, "/"):
+			// pattern without directories matches file name at any depth
+			s.patterns = append(s.patterns, []string{"**", p})
+		default:
+			s.patterns = append(s.patterns, strings.Split(p, "/"))
+		}
+	}
+	return s, nil
+}
+
+// has reports if object with path "rel" (relative to the source) is selected: books matching any pattern and page
+// indexes of such books.
+func (s *selection) has(rel string) bool {
+	if s == nil {
+		return true
+	}
+	if s.match(rel) {
+		return true
+	}
+	if path.Ext(rel) != ".apnx" {
+		return false
+	}
+	// page index is in the same folder as the book or in its .sdr subfolder
+	dir, base := path.Split(rel)
+	dir = strings.TrimSuffix(dir, "/")
+	base = strings.TrimSuffix(base, ".apnx")
+	if path.Base(dir) == base+".sdr" {
+		dir = path.Dir(dir)
+	}
+	return slices.ContainsFunc(s.extensions, func(ext string) bool {
+		return s.match(path.Join(dir, base+ext))
+	})
+}
+
+// mayContain reports if folder "rel" (relative to the source) could have selected objects in it.
+func (s *selection) mayContain(rel string) bool {
+	if s == nil {
+		return true
+	}
+	if book, ok := strings.CutSuffix(rel, ".sdr"); ok {
+		// could only have page index of the book next to it
+		return slices.ContainsFunc(s.extensions, func(ext string) bool {
+			return s.match(book + ext)
+		})
+	}
+	elems := strings.Split(rel, "/")
+	return slices.ContainsFunc(s.patterns, func(p []string) bool {
+		return matchPrefix(p, elems)
+	})
+}
+
+func (s *selection) match(rel string) bool {
+	elems := strings.Split(rel, "/")
+	return slices.ContainsFunc(s.patterns, func(p []string) bool {
+		return matchElems(p, elems)
+	})
+}
+
+// matchPrefix reports if path elements could be leading elements of some path matching the pattern.
+func matchPrefix(pattern, elems []string) bool {
+	if len(elems) == 0 {
+		return true
+	}
+	if len(pattern) == 0 {
+		return false
+	}
+	if pattern[0] == "**" {
+		return true
+	}
+	if ok, _ := path.Match(pattern[0], elems[0]); !ok {
+		return false
+	}
+	return matchPrefix(pattern[1:], elems[1:])
+}
+
+// mergeSelection returns objects to be recorded in history after selective sync: "next" for the selected part and
+// previous state for everything outside of selection.
+func mergeSelection(prev, next objects.ObjectInfoSet, sel *selection) objects.ObjectInfoSet {
+	ois := next.Clone()
+	for k, v := range prev {
+		if _, exists := ois[k]; !exists && !sel.has(k) {
+			ois[k] = v
+		}
+	}
+	return ois
+}
@@ -0,0 +1,145 @@
+package sync
+
+import (
+	"context"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+
+	"sync2kindle/config"
+	"sync2kindle/objects"
+)
+
+func TestSelection(t *testing.T) {
+	sel, err := newSelection([]string{"scifi/**", "*.pdf", "misc/one.azw3", "manga"}, []string{".azw3", ".pdf"})
+	if err != nil {
+		t.Fatalf("Failed to create selection: %v", err)
+	}
+
+	for _, c := range []struct {
+		rel string
+		has bool
+	}{
+		{"scifi/01.azw3", true},
+		{"scifi/series/01.azw3", true},
+		{"scifi/series/01.apnx", true},
+		{"scifi/series/01.sdr/01.apnx", true},
+		{"fantasy/01.azw3", false},
+		{"fantasy/01.apnx", true}, // could belong to selected .pdf
+		{"fantasy/01.pdf", true},
+		{"fantasy/02.sdr/02.apnx", true},
+		{"misc/one.azw3", true},
+		{"misc/one.sdr/one.apnx", true},
+		{"misc/two.azw3", false},
+		{"manga/01.azw3", true},
+		{"manga/series/01.azw3", true},
+		{"mangaka/01.azw3", false},
+	} {
+		if has := sel.has(c.rel); has != c.has {
+			t.Errorf("'%s' selected: %t, expected %t", c.rel, has, c.has)
+		}
+	}
+
+	for _, c := range []struct {
+		rel string
+		may bool
+	}{
+		{"scifi", true},
+		{"scifi/series", true},
+		{"misc", true},
+		{"misc/one.sdr", true},
+		{"misc/other", true}, // "*.pdf" could be anywhere
+	} {
+		if may := sel.mayContain(c.rel); may != c.may {
+			t.Errorf("'%s' may contain selected: %t, expected %t", c.rel, may, c.may)
+		}
+	}
+
+	sel, _ = newSelection([]string{"scifi/**", "misc/one.azw3"}, []string{".azw3"})
+	for _, c := range []struct {
+		rel string
+		may bool
+	}{
+		{"scifi/series", true},
+		{"misc", true},
+		{"misc/one.sdr", true},
+		{"misc/two.sdr", false},
+		{"misc/other", false},
+		{"fantasy", false},
+	} {
+		if may := sel.mayContain(c.rel); may != c.may {
+			t.Errorf("'%s' may contain selected: %t, expected %t", c.rel, may, c.may)
+		}
+	}
+
+	if _, err := newSelection([]string{"[a"}, nil); err == nil {
+		t.Error("Expected error for bad pattern")
+	}
+	if sel, err := newSelection(nil, nil); sel != nil || err != nil || !sel.has("any/01.azw3") {
+		t.Error("Expected empty selection to have everything")
+	}
+}
+
+func TestPrepareActionsSelected(t *testing.T) {
+	cfg, err := config.LoadConfiguration("")
+	if err != nil {
+		t.Fatalf("Failed to load configuration: %v", err)
+	}
+	cfg.SourcePath = `D:/test/out`
+	cfg.TargetPath = `documents/test`
+
+	log := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+
+	// local scan has selected part of the source only
+	src := &testActor{name: "local", set: objects.ObjectInfoSet{
+		"D:/test/out":                {Name: "out", Dir: true, FullPath: "D:/test/out"},
+		"D:/test/out/scifi":          {Name: "scifi", Dir: true, FullPath: "D:/test/out/scifi"},
+		"D:/test/out/scifi/a.azw3":   {Name: "a.azw3", File: true, PersistentID: "a", ObjSize: 100, FullPath: "D:/test/out/scifi/a.azw3"},
+		"D:/test/out/scifi/new.azw3": {Name: "new.azw3", File: true, PersistentID: "n", ObjSize: 100, FullPath: "D:/test/out/scifi/new.azw3"},
+	}}
+	hst := &testActor{name: "history", set: objects.ObjectInfoSet{
+		"scifi/a.azw3":   {Name: "a.azw3", File: true, PersistentID: "a", ObjSize: 100, FullPath: "D:/test/out/scifi/a.azw3"},
+		"scifi/b.azw3":   {Name: "b.azw3", File: true, PersistentID: "b", ObjSize: 100, FullPath: "D:/test/out/scifi/b.azw3"},
+		"fantasy/c.azw3": {Name: "c.azw3", File: true, PersistentID: "c", ObjSize: 100, FullPath: "D:/test/out/fantasy/c.azw3"},
+		"fantasy/d.azw3": {Name: "d.azw3", File: true, PersistentID: "d", ObjSize: 100, FullPath: "D:/test/out/fantasy/d.azw3"},
+	}}
+	dst := &testActor{name: "device", set: objects.ObjectInfoSet{
+		"documents":                     {Name: "documents", Dir: true, FullPath: "documents"},
+		"documents/test":                {Name: "test", Dir: true, FullPath: "documents/test"},
+		"documents/test/scifi":          {Name: "scifi", Dir: true, FullPath: "documents/test/scifi"},
+		"documents/test/scifi/a.azw3":   {Name: "a.azw3", File: true, ObjSize: 100, FullPath: "documents/test/scifi/a.azw3"},
+		"documents/test/scifi/b.azw3":   {Name: "b.azw3", File: true, ObjSize: 100, FullPath: "documents/test/scifi/b.azw3"},
+		"documents/test/fantasy":        {Name: "fantasy", Dir: true, FullPath: "documents/test/fantasy"},
+		"documents/test/fantasy/c.azw3": {Name: "c.azw3", File: true, ObjSize: 100, FullPath: "documents/test/fantasy/c.azw3"},
+	}}
+
+	sel, err := newSelection([]string{"scifi"}, cfg.BookExtensions)
+	if err != nil {
+		t.Fatalf("Failed to create selection: %v", err)
+	}
+	actions, local, _, err := PrepareActions(context.Background(), src, dst, hst, cfg, Options{only: sel}, log)
+	if err != nil {
+		t.Fatalf("Failed to prepare actions: %v", err)
+	}
+	for _, action := range actions {
+		if err := action.run(context.Background(), false, log); err != nil {
+			t.Fatalf("Action failed: %v", err)
+		}
+	}
+	// "scifi/b.azw3" removed locally, "scifi/new.azw3" added, "fantasy" books are not touched although they are not
+	// in local scan and "fantasy/d.azw3" is not on the device
+	if dst.deletions != 1 || dst.additions != 1 || src.deletions != 0 {
+		t.Fatalf("Expected 1 device deletion and 1 addition, no local deletions, got %d, %d, %d", dst.deletions, dst.additions, src.deletions)
+	}
+
+	ois := mergeSelection(hst.set, libraryObjects(cfg, local), sel)
+	for _, k := range []string{"scifi/a.azw3", "scifi/new.azw3", "fantasy/c.azw3", "fantasy/d.azw3"} {
+		if ois.Find(k) == nil {
+			t.Errorf("'%s' is not in the history step", k)
+		}
+	}
+	if ois.Find("scifi/b.azw3") != nil {
+		t.Error("'scifi/b.azw3' is still in the history step")
+	}
+}
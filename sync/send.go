@@ -0,0 +1,296 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	cli "github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+
+	"sync2kindle/common"
+	"sync2kindle/config"
+	"sync2kindle/files"
+	"sync2kindle/history"
+	"sync2kindle/objects"
+	"sync2kindle/state"
+)
+
+// RunSend delivers files from outside of the configured source to the device (or by e-mail), with "manage" flag sent
+// books are recorded in history of the configured target, so following syncs know they are there.
+func RunSend(ctx *cli.Context) error {
+	env := ctx.Generic(state.FlagName).(*state.LocalEnv)
+	log := env.Log.Named("send")
+
+	if ctx.Args().Len() == 0 {
+		return errors.New("no files to send")
+	}
+	protocol, err := common.ParseProtocol(ctx.String("to"))
+	if err != nil {
+		return err
+	}
+	var dir string
+	switch {
+	case protocol == common.ProtocolMail:
+		if !strings.Contains(env.Cfg.TargetPath, "@") {
+			return fmt.Errorf("target is invalid e-mail address: %s", env.Cfg.TargetPath)
+		}
+		if ctx.IsSet("dir") {
+			log.Warn("Device folder cannot be selected for e-mail delivery, ignoring", zap.String("dir", ctx.String("dir")))
+		}
+	case ctx.IsSet("dir"):
+		dir = strings.Trim(path.Clean("/"+filepath.ToSlash(ctx.String("dir"))), "/")
+		if len(dir) == 0 {
+			return errors.New("device folder to send files to cannot be device root")
+		}
+	default:
+		dir = env.Cfg.TargetPath
+	}
+	books, err := sendFiles(ctx.Args().Slice(), protocol, env.Cfg.BookExtensions)
+	if err != nil {
+		return err
+	}
+	manage := ctx.Bool("manage")
+
+	log.Info("Send starting", zap.Stringer("protocol", protocol), zap.String("target", env.Cfg.TargetPath), zap.String("dir", dir), zap.Int("files", len(books)), zap.Bool("manage", manage))
+	defer func(start time.Time) {
+		log.Info("Send finished", zap.Stringer("protocol", protocol), zap.Duration("elapsed", time.Since(start)))
+	}(time.Now())
+
+	// Source: files to send with their page indexes
+
+	var thumbsCfg *config.ThumbnailsConfig
+	if protocol != common.ProtocolMail {
+		// cache directory depends on the device and is selected after connecting to it
+		thumbsCfg = &env.Cfg.Thumbnails
+	}
+	paths := slices.Clone(books)
+	for _, b := range books {
+		for _, p := range getSupplementalArtifactsPaths(b) {
+			if fi, err := os.Stat(p); err == nil && fi.Mode().IsRegular() {
+				paths = append(paths, p)
+			}
+		}
+	}
+	src, err := files.Connect(strings.Join(paths, string(filepath.ListSeparator)), "", thumbsCfg, log)
+	if err != nil {
+		return fmt.Errorf("bad files to send: %w", err)
+	}
+	defer src.Disconnect()
+
+	srcOIS, err := src.GetObjectInfos(ctx.Context)
+	if err != nil {
+		return fmt.Errorf("unable to get files to send: %w", err)
+	}
+
+	// Target: device
+
+	lock, err := lockDevice(ctx, protocol, env.Cfg, log)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	dev, err := connectDevice(ctx, protocol, []string{dir, common.ThumbnailFolder}, env)
+	if err != nil {
+		return fmt.Errorf("unable to connect to device: %w", err)
+	}
+	defer dev.Disconnect()
+
+	if thumbsCfg != nil {
+		if err := prepareThumbsDir(env, dev, nil, log); err != nil {
+			return err
+		}
+	}
+
+	dstOIS, err := dev.GetObjectInfos(ctx.Context)
+	if err != nil {
+		return fmt.Errorf("unable to get files on the device: %w", err)
+	}
+
+	if thumbsCfg != nil {
+		for _, b := range books {
+			lookupThumbnail(ctx.Context, src, srcOIS[b])
+		}
+	}
+	actions, sent := prepareSendActions(books, srcOIS, dstOIS, dir, protocol == common.ProtocolMail, env.Cfg, dev, log)
+
+	dryRun := ctx.Bool("dry-run")
+	done, err := runActions(ctx.Context, actions, dryRun, log)
+	if !manage || dryRun || done == 0 {
+		return err
+	}
+	// record what was delivered even when interrupted
+	for _, a := range actions[done:] {
+		for _, key := range a.books {
+			delete(sent, key)
+		}
+	}
+	return errors.Join(err, recordSent(ctx, protocol, dev, env.Cfg, sent, log))
+}
+
+// sendFiles checks files requested to be sent and returns their absolute paths (with forward slashes).
+func sendFiles(args []string, protocol common.SupportedProtocols, extensions []string) ([]string, error) {
+	var books []string
+	for _, arg := range args {
+		p, err := filepath.Abs(arg)
+		if err != nil {
+			return nil, fmt.Errorf("bad file to send '%s': %w", arg, err)
+		}
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, fmt.Errorf("file to send cannot be accessed: %w", err)
+		}
+		if !fi.Mode().IsRegular() {
+			return nil, fmt.Errorf("'%s' is not a regular file", arg)
+		}
+		ext := filepath.Ext(p)
+		switch {
+		case protocol == common.ProtocolMail && !common.IsSupportedEMailFormat(ext):
+			return nil, fmt.Errorf("'%s' cannot be sent by e-mail, format '%s' is not supported", arg, ext)
+		case !slices.Contains(extensions, ext):
+			return nil, fmt.Errorf("'%s' is not a book, extension '%s' is not in 'book_extensions'", arg, ext)
+		}
+		p = filepath.ToSlash(p)
+		if !slices.Contains(books, p) {
+			books = append(books, p)
+		}
+	}
+	return books, nil
+}
+
+// prepareSendActions creates actions to send books to "dir" on the device (or by e-mail), returning them together
+// with objects to be recorded in history if books are managed, keyed by device path (or file name for e-mail).
+func prepareSendActions(books []string, srcOIS, dstOIS objects.ObjectInfoSet, dir string, email bool, cfg *config.Config, dstActor driver, log *zap.Logger) ([]action, objects.ObjectInfoSet) {
+	var actions []action
+	sent := objects.New()
+	if email {
+		for _, b := range books {
+			obj := srcOIS[b]
+			first := len(actions)
+			actions = makeCopyActions(actions, obj, "", obj.Name, dstOIS, dstActor, true, log)
+			tagActions(actions[first:], obj.Name)
+
+			o := *obj
+			o.External = true
+			sent[obj.Name] = &o
+		}
+		return actions, sent
+	}
+
+	// books go straight to the folder, no routing rules apply
+	sendCfg := *cfg
+	sendCfg.TargetPath, sendCfg.Routes = dir, nil
+	rt, _ := newRouter(&sendCfg)
+
+	var deviceThumbs objects.ObjectInfoSet
+	if dstOIS.Find(common.ThumbnailFolder) != nil {
+		deviceThumbs = getDeviceThumbs(dstOIS, cfg.ThumbExtensions)
+	}
+	for _, b := range books {
+		obj := srcOIS[b]
+		to := rt.devicePath(obj.Name)
+		first := len(actions)
+		actions = makeSendActions(actions, obj.Name, obj, srcOIS, dstOIS, deviceThumbs, rt, &sendCfg, dstActor, log)
+
+		o := *obj
+		o.DevicePath, o.External = to, true
+		sent[to] = &o
+		keys := []string{to}
+		supplementals := getSupplementalArtifactsPaths(to)
+		for i, p := range getSupplementalArtifactsPaths(b) {
+			if sobj := srcOIS.Find(p); sobj != nil {
+				s := *sobj
+				s.External = true
+				sent[supplementals[i]] = &s
+				keys = append(keys, supplementals[i])
+			}
+		}
+		tagActions(actions[first:], keys...)
+	}
+	return actions, sent
+}
+
+// recordSent adds sent books to the history of the configured target, creating it when necessary.
+func recordSent(ctx *cli.Context, protocol common.SupportedProtocols, dev driver, cfg *config.Config, sent objects.ObjectInfoSet, log *zap.Logger) error {
+	if len(sent) == 0 {
+		return nil
+	}
+	historyPath := filepath.Join(cfg.HistoryPath, history.GetName(protocol, dev.UniqueID(), cfg.TargetPath))
+	lock, err := history.Lock(historyPath, ctx.Duration("wait"), log)
+	if err != nil {
+		return fmt.Errorf("history database cannot be used: %w", err)
+	}
+	defer lock.Release()
+
+	if _, err := os.Stat(historyPath); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("history database '%s' cannot be accessed: %w", historyPath, err)
+		}
+		if err := history.Create(historyPath, log, protocol.String(), dev.UniqueID(), cfg.TargetPath); err != nil {
+			return fmt.Errorf("unable to create new history database '%s': %w", historyPath, err)
+		}
+	}
+	hst, err := history.Connect(historyPath, log)
+	if err != nil {
+		return fmt.Errorf("history cannot be opened: %w", err)
+	}
+	defer hst.Disconnect()
+	if err := hst.SetShared(cfg.HistoryShared); err != nil {
+		return err
+	}
+
+	prev, err := hst.GetObjectInfos(ctx.Context)
+	if err != nil {
+		return fmt.Errorf("history objects cannot be read: %w", err)
+	}
+	ois, recorded := prev.Clone(), 0
+	for k, v := range sent {
+		if p, exists := prev[k]; exists && !p.External {
+			log.Warn("Book is synchronized from the source, not recording it as sent", zap.String("book", k))
+			continue
+		}
+		ois[k] = v
+		recorded++
+	}
+	if err := hst.SaveObjectInfos(cfg.LibraryID(), cfg.TargetPath, ois); err != nil {
+		return fmt.Errorf("history objects cannot be saved: %w", err)
+	}
+	log.Info("Sent books recorded in history", zap.Int("count", recorded), zap.Int64("stepID", hst.StepID()))
+	return nil
+}
+
+// keepExternal carries books sent with "send --manage" over from the previous history step. Book is dropped when library
+// book is now recorded at the same place on the device, or when it is gone from the device. Only target folders are
+// listed on the device, so books sent elsewhere are kept as long as nothing else takes their place.
+func keepExternal(prev, ois, dstOIS objects.ObjectInfoSet, cfg *config.Config) objects.ObjectInfoSet {
+	taken := make(map[string]bool)
+	for _, v := range ois {
+		if len(v.DevicePath) > 0 {
+			taken[v.DevicePath] = true
+		}
+	}
+	roots := []string{cfg.TargetPath}
+	for _, r := range cfg.Routes {
+		roots = append(roots, r.TargetPath)
+	}
+	for k, v := range prev {
+		if _, exists := ois[k]; exists || !v.External || taken[k] {
+			continue
+		}
+		listed := slices.ContainsFunc(roots, func(root string) bool {
+			_, ok := cutRoot(k, root)
+			return ok
+		})
+		if listed && dstOIS.Find(k) == nil {
+			continue
+		}
+		ois[k] = v
+	}
+	return ois
+}
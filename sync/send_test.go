@@ -0,0 +1,162 @@
+package sync
+
+import (
+	"context"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+
+	"sync2kindle/config"
+	"sync2kindle/objects"
+)
+
+func TestPrepareSendActions(t *testing.T) {
+	cfg, err := config.LoadConfiguration("")
+	if err != nil {
+		t.Fatalf("Failed to load configuration: %v", err)
+	}
+	cfg.TargetPath = `documents/test`
+
+	log := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+
+	srcOIS := objects.ObjectInfoSet{
+		"C:/Downloads/a.pdf":        {Name: "a.pdf", File: true, PersistentID: "a", ObjSize: 100, FullPath: "C:/Downloads/a.pdf"},
+		"C:/Downloads/a.apnx":       {Name: "a.apnx", File: true, PersistentID: "ai", ObjSize: 10, FullPath: "C:/Downloads/a.apnx"},
+		"C:/Other/b.azw3":           {Name: "b.azw3", File: true, PersistentID: "b", ObjSize: 200, FullPath: "C:/Other/b.azw3"},
+		"C:/Other/b.sdr/b.apnx":     {Name: "b.apnx", File: true, PersistentID: "bi", ObjSize: 20, FullPath: "C:/Other/b.sdr/b.apnx"},
+		"C:/Other/unrelated.pdf":    {Name: "unrelated.pdf", File: true, PersistentID: "u", ObjSize: 300, FullPath: "C:/Other/unrelated.pdf"},
+		"C:/Other/unrelated.sdr/xx": {Name: "xx", File: true, ObjSize: 1, FullPath: "C:/Other/unrelated.sdr/xx"},
+	}
+	books := []string{"C:/Downloads/a.pdf", "C:/Other/b.azw3"}
+
+	dst := &testActor{name: "device", set: objects.ObjectInfoSet{
+		"documents":       {Name: "documents", Dir: true, FullPath: "documents"},
+		"documents/inbox": {Name: "inbox", Dir: true, FullPath: "documents/inbox"},
+		// previous copy is replaced
+		"documents/inbox/b.azw3": {Name: "b.azw3", File: true, ObjSize: 150, FullPath: "documents/inbox/b.azw3"},
+	}}
+	actions, sent := prepareSendActions(books, srcOIS, dst.set, "documents/inbox", false, cfg, dst, log)
+	for _, action := range actions {
+		if err := action.run(context.Background(), false, log); err != nil {
+			t.Fatalf("Action failed: %v", err)
+		}
+	}
+	if dst.deletions != 1 || dst.additions != 4 || dst.directories != 1 {
+		t.Fatalf("Expected 1 device deletion, 4 additions and 1 directory, got %d, %d, %d", dst.deletions, dst.additions, dst.directories)
+	}
+	for _, key := range []string{"documents/inbox/a.pdf", "documents/inbox/a.apnx", "documents/inbox/b.azw3", "documents/inbox/b.sdr/b.apnx"} {
+		obj, exists := sent[key]
+		if !exists || !obj.External {
+			t.Fatalf("Expected '%s' to be recorded as sent, got %v", key, sent)
+		}
+	}
+	if len(sent) != 4 || sent["documents/inbox/a.pdf"].DevicePath != "documents/inbox/a.pdf" {
+		t.Fatalf("Unexpected books recorded as sent: %v", sent)
+	}
+
+	mail := &testActor{name: "mail", set: objects.New()}
+	actions, sent = prepareSendActions(books, srcOIS, mail.set, "", true, cfg, mail, log)
+	for _, action := range actions {
+		if err := action.run(context.Background(), false, log); err != nil {
+			t.Fatalf("Action failed: %v", err)
+		}
+	}
+	if mail.additions != 2 || mail.directories != 0 {
+		t.Fatalf("Expected 2 e-mails, got %d additions and %d directories", mail.additions, mail.directories)
+	}
+	if _, exists := sent["a.pdf"]; !exists || len(sent) != 2 {
+		t.Fatalf("Unexpected books recorded as sent by e-mail: %v", sent)
+	}
+}
+
+func TestPrepareActionsExternal(t *testing.T) {
+	cfg, err := config.LoadConfiguration("")
+	if err != nil {
+		t.Fatalf("Failed to load configuration: %v", err)
+	}
+	cfg.SourcePath = `D:/test/out`
+	cfg.TargetPath = `documents/test`
+
+	log := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+
+	src := &testActor{name: "local", set: objects.ObjectInfoSet{
+		"D:/test/out":        {Name: "out", Dir: true, FullPath: "D:/test/out"},
+		"D:/test/out/a.azw3": {Name: "a.azw3", File: true, PersistentID: "a", ObjSize: 100, FullPath: "D:/test/out/a.azw3"},
+	}}
+	hst := &testActor{name: "history", set: objects.ObjectInfoSet{
+		"a.azw3": {Name: "a.azw3", File: true, PersistentID: "a", ObjSize: 100, FullPath: "D:/test/out/a.azw3", DevicePath: "documents/test/a.azw3"},
+		// sent into target and elsewhere, neither is in the source
+		"documents/test/x.pdf":  {Name: "x.pdf", File: true, PersistentID: "x", ObjSize: 300, FullPath: "C:/Downloads/x.pdf", DevicePath: "documents/test/x.pdf", External: true},
+		"documents/test/x.apnx": {Name: "x.apnx", File: true, PersistentID: "xi", ObjSize: 30, FullPath: "C:/Downloads/x.apnx", External: true},
+		"documents/inbox/y.pdf": {Name: "y.pdf", File: true, PersistentID: "y", ObjSize: 400, FullPath: "C:/Downloads/y.pdf", DevicePath: "documents/inbox/y.pdf", External: true},
+	}}
+	dst := &testActor{name: "device", set: objects.ObjectInfoSet{
+		"documents":             {Name: "documents", Dir: true, FullPath: "documents"},
+		"documents/test":        {Name: "test", Dir: true, FullPath: "documents/test"},
+		"documents/test/a.azw3": {Name: "a.azw3", File: true, ObjSize: 100, FullPath: "documents/test/a.azw3"},
+		"documents/test/x.pdf":  {Name: "x.pdf", File: true, ObjSize: 300, FullPath: "documents/test/x.pdf"},
+		"documents/test/x.apnx": {Name: "x.apnx", File: true, ObjSize: 30, FullPath: "documents/test/x.apnx"},
+	}}
+
+	for _, opts := range []Options{{}, {Offline: true}} {
+		actions, local, devOIS, err := PrepareActions(context.Background(), src, dst, hst, cfg, opts, log)
+		if err != nil {
+			t.Fatalf("Failed to prepare actions: %v", err)
+		}
+		if len(actions) != 0 {
+			t.Fatalf("Expected sent books to be left alone (offline %t), got %d actions", opts.Offline, len(actions))
+		}
+		ois := keepExternal(hst.set, libraryObjects(cfg, local), devOIS, cfg)
+		if len(ois) != 4 || !ois["documents/inbox/y.pdf"].External {
+			t.Fatalf("Expected sent books to be carried over to the next history step, got %v", ois)
+		}
+	}
+	// book sent by e-mail is not the library book with the same name
+	src.set["D:/test/out/x.pdf"] = &objects.ObjectInfo{Name: "x.pdf", File: true, PersistentID: "x", ObjSize: 300, FullPath: "D:/test/out/x.pdf"}
+	hst.set = objects.ObjectInfoSet{
+		"a.azw3": {Name: "a.azw3", File: true, PersistentID: "a", ObjSize: 100, FullPath: "D:/test/out/a.azw3"},
+		"x.pdf":  {Name: "x.pdf", File: true, PersistentID: "x", ObjSize: 300, FullPath: "C:/Downloads/x.pdf", External: true},
+	}
+	mail := &testActor{name: "mail", set: objects.New()}
+	actions, local, devOIS, err := PrepareActions(context.Background(), src, mail, hst, cfg, Options{EMail: true}, log)
+	if err != nil {
+		t.Fatalf("Failed to prepare actions: %v", err)
+	}
+	if len(actions) != 1 {
+		t.Fatalf("Expected library book to be sent, got %d actions", len(actions))
+	}
+	if ois := keepExternal(hst.set, libraryObjects(cfg, local), devOIS, cfg); ois["x.pdf"].External {
+		t.Fatalf("Expected library book to replace sent one in history, got %v", ois)
+	}
+}
+
+func TestKeepExternal(t *testing.T) {
+	cfg := &config.Config{TargetPath: "documents/test"}
+	prev := objects.ObjectInfoSet{
+		"documents/test/x.pdf": {Name: "x.pdf", File: true, PersistentID: "x", DevicePath: "documents/test/x.pdf", External: true},
+	}
+	dst := objects.ObjectInfoSet{
+		"documents/test/x.pdf": {Name: "x.pdf", File: true, FullPath: "documents/test/x.pdf"},
+	}
+
+	// library book was routed to the place of the sent one
+	ois := objects.ObjectInfoSet{
+		"x.pdf": {Name: "x.pdf", File: true, PersistentID: "x2", DevicePath: "documents/test/x.pdf"},
+	}
+	if ois := keepExternal(prev, ois, dst, cfg); len(ois) != 1 || ois["documents/test/x.pdf"] != nil {
+		t.Fatalf("Expected sent book to be replaced by library book, got %v", ois)
+	}
+
+	// sent book was removed from the device
+	if ois := keepExternal(prev, objects.New(), objects.New(), cfg); len(ois) != 0 {
+		t.Fatalf("Expected sent book gone from the device to be dropped, got %v", ois)
+	}
+	// books outside of target folders are not listed, so they stay
+	prev = objects.ObjectInfoSet{
+		"documents/inbox/y.pdf": {Name: "y.pdf", File: true, PersistentID: "y", DevicePath: "documents/inbox/y.pdf", External: true},
+	}
+	if ois := keepExternal(prev, objects.New(), objects.New(), cfg); len(ois) != 1 {
+		t.Fatalf("Expected sent book outside of target to be kept, got %v", ois)
+	}
+}
@@ -0,0 +1,115 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+
+	"go.uber.org/zap"
+
+	"sync2kindle/common"
+	"sync2kindle/config"
+	"sync2kindle/history"
+	"sync2kindle/objects"
+	"sync2kindle/thumbs"
+)
+
+// thumbRefs collects thumbnail names from histories of the device: referenced by books in the last step and recorded in
+// any step. Thumbnails are named by book ASIN and type and live in the single device folder, so the same thumbnail
+// belongs to every copy of the book in every target.
+type thumbRefs struct {
+	referenced map[string]bool
+	recorded   map[string]bool
+}
+
+// inUse reports if thumbnail is referenced by books of other histories, nil has no references.
+func (r *thumbRefs) inUse(name string) bool {
+	return r != nil && r.referenced[name]
+}
+
+// deviceThumbRefs collects thumbnail references from histories of the device in "historyPath", skipping history
+// database named "skip". Histories of both USB and MTP synchronizations are considered, it is the same device.
+func deviceThumbRefs(historyPath, id, skip string, log *zap.Logger) (*thumbRefs, error) {
+	refs := &thumbRefs{referenced: make(map[string]bool), recorded: make(map[string]bool)}
+
+	entries, err := os.ReadDir(historyPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return refs, nil
+		}
+		return nil, fmt.Errorf("unable to read history directory '%s': %w", historyPath, err)
+	}
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".db" || e.Name() == skip {
+			continue
+		}
+		p := filepath.Join(historyPath, e.Name())
+		values, err := history.Identifiers(p)
+		if err != nil || len(values) != 3 || values[1] != id || (values[0] != common.ProtocolUSB.String() && values[0] != common.ProtocolMTP.String()) {
+			continue
+		}
+		used, recorded, err := history.Thumbnails(p)
+		if err != nil {
+			// history of another target should never stop sync, at worst thumbnail it shares is sent again later
+			log.Warn("Unable to read thumbnails from history, ignoring it", zap.String("target", values[2]), zap.String("path", p), zap.Error(err))
+			continue
+		}
+		log.Debug("Thumbnails referenced by history", zap.String("target", values[2]), zap.String("protocol", values[0]), zap.Int("used", len(used)))
+		maps.Copy(refs.referenced, used)
+		maps.Copy(refs.recorded, recorded)
+	}
+	return refs, nil
+}
+
+// thumbOwned reports if thumbnail "name" is still used by any of the books in sets or by books of other histories.
+func thumbOwned(name string, refs *thumbRefs, sets ...objects.ObjectInfoSet) bool {
+	if refs.inUse(name) {
+		return true
+	}
+	for _, set := range sets {
+		for _, v := range set {
+			if v.ThumbName == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// evictThumbs removes cached thumbnails of books which are no longer managed by any device history. Histories which
+// cannot be read are skipped, so thumbnails of their books could be evicted and extracted again when needed.
+func evictThumbs(cfg *config.Config, log *zap.Logger) error {
+	entries, err := os.ReadDir(cfg.HistoryPath)
+	if err != nil {
+		return fmt.Errorf("unable to read history directory '%s': %w", cfg.HistoryPath, err)
+	}
+	keep := make(map[string]bool)
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".db" {
+			continue
+		}
+		p := filepath.Join(cfg.HistoryPath, e.Name())
+		values, err := history.Identifiers(p)
+		if err != nil || len(values) != 3 || (values[0] != common.ProtocolUSB.String() && values[0] != common.ProtocolMTP.String()) {
+			continue
+		}
+		ois, err := history.Latest(p)
+		if err != nil {
+			// thumbnails of its books could be evicted, they are extracted again when needed
+			log.Warn("Unable to read history, ignoring it", zap.String("target", values[2]), zap.String("path", p), zap.Error(err))
+			continue
+		}
+		for _, o := range ois {
+			if len(o.PersistentID) > 0 {
+				keep[thumbs.CacheKey(o.PersistentID, o.CoverID)] = true
+			}
+		}
+	}
+	evicted, err := thumbs.EvictCache(thumbsCacheRoot(cfg), keep, log)
+	if evicted > 0 {
+		log.Info("Evicted cached thumbnails", zap.Int("count", evicted))
+	}
+	return err
+}
@@ -0,0 +1,239 @@
+package sync
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+
+	"sync2kindle/common"
+	"sync2kindle/config"
+	"sync2kindle/history"
+	"sync2kindle/objects"
+	"sync2kindle/thumbs"
+)
+
+func TestDeviceThumbRefs(t *testing.T) {
+	log := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+	dir := t.TempDir()
+
+	save := func(protocol common.SupportedProtocols, id, target string, steps ...objects.ObjectInfoSet) string {
+		name := history.GetName(protocol, id, target)
+		p := filepath.Join(dir, name)
+		if err := history.Create(p, log, protocol.String(), id, target); err != nil {
+			t.Fatalf("Unable to create history: %v", err)
+		}
+		hst, err := history.Connect(p, log)
+		if err != nil {
+			t.Fatalf("Unable to open history: %v", err)
+		}
+		defer hst.Disconnect()
+		for _, ois := range steps {
+			if err := hst.SaveObjectInfos("/src", target, ois); err != nil {
+				t.Fatalf("Unable to save step: %v", err)
+			}
+		}
+		return name
+	}
+
+	current := save(common.ProtocolMTP, "SN", "documents/a", objects.ObjectInfoSet{
+		"a.azw3": {Name: "a.azw3", ThumbName: "ta.jpg"},
+	})
+	save(common.ProtocolMTP, "SN", "documents/b",
+		objects.ObjectInfoSet{"b.azw3": {Name: "b.azw3", ThumbName: "tb.jpg"}, "c.azw3": {Name: "c.azw3", ThumbName: "tc.jpg"}},
+		objects.ObjectInfoSet{"b.azw3": {Name: "b.azw3", ThumbName: "tb.jpg"}},
+	)
+	// the same device over USB
+	save(common.ProtocolUSB, "SN", "documents/c", objects.ObjectInfoSet{"d.azw3": {Name: "d.azw3", ThumbName: "td.jpg"}})
+	// other device and e-mail
+	save(common.ProtocolMTP, "OTHER", "documents/a", objects.ObjectInfoSet{"e.azw3": {Name: "e.azw3", ThumbName: "te.jpg"}})
+	save(common.ProtocolMail, "SN", "me@kindle.com", objects.ObjectInfoSet{"f.azw3": {Name: "f.azw3", ThumbName: "tf.jpg"}})
+
+	// history which cannot be read is ignored
+	broken := save(common.ProtocolMTP, "SN", "documents/broken", objects.ObjectInfoSet{"g.azw3": {Name: "g.azw3", ThumbName: "tg.jpg"}})
+	conn, err := sqlite.OpenConn(filepath.Join(dir, broken), sqlite.OpenReadWrite)
+	if err != nil {
+		t.Fatalf("Unable to open history: %v", err)
+	}
+	err = sqlitex.ExecuteScript(conn, `DROP TABLE changes;`, nil)
+	conn.Close()
+	if err != nil {
+		t.Fatalf("Unable to break history: %v", err)
+	}
+
+	refs, err := deviceThumbRefs(dir, "SN", current, log)
+	if err != nil {
+		t.Fatalf("Unable to collect thumbnail references: %v", err)
+	}
+	for name, used := range map[string]bool{"ta.jpg": false, "tb.jpg": true, "tc.jpg": false, "td.jpg": true, "te.jpg": false, "tf.jpg": false, "tg.jpg": false} {
+		if refs.inUse(name) != used {
+			t.Errorf("Thumbnail '%s': expected in use %t", name, used)
+		}
+	}
+	if !refs.recorded["tc.jpg"] || refs.recorded["ta.jpg"] {
+		t.Errorf("Unexpected recorded thumbnails: %v", refs.recorded)
+	}
+
+	refs, err = deviceThumbRefs(filepath.Join(dir, "missing"), "SN", "", log)
+	if err != nil || refs.inUse("tb.jpg") {
+		t.Fatalf("Expected no references without history, got %v, %v", refs, err)
+	}
+}
+
+func TestPrepareActionsSharedThumbs(t *testing.T) {
+	cfg, err := config.LoadConfiguration("")
+	if err != nil {
+		t.Fatalf("Failed to load configuration: %v", err)
+	}
+	cfg.SourcePath = `D:/test/out`
+	cfg.TargetPath = `documents/test`
+
+	log := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+
+	// "a" and "b" are gone locally, "c" and "d" are gone from the device
+	newSource := func() *testActor {
+		return &testActor{name: "local", set: objects.ObjectInfoSet{
+			"D:/test/out":              {Name: "out", Dir: true, FullPath: "D:/test/out"},
+			"D:/test/out/b copy.azw3":  {Name: "b copy.azw3", File: true, PersistentID: "b", ObjSize: 200, FullPath: "D:/test/out/b copy.azw3", ThumbName: "tb.jpg"},
+			"D:/test/out/c.azw3":       {Name: "c.azw3", File: true, PersistentID: "c", ObjSize: 300, FullPath: "D:/test/out/c.azw3", ThumbName: "tc.jpg"},
+			"D:/test/out/d.azw3":       {Name: "d.azw3", File: true, PersistentID: "d", ObjSize: 400, FullPath: "D:/test/out/d.azw3", ThumbName: "td.jpg"},
+			"D:/test/out/d again.azw3": {Name: "d again.azw3", File: true, PersistentID: "d", ObjSize: 400, FullPath: "D:/test/out/d again.azw3", ThumbName: "td.jpg"},
+		}}
+	}
+	hst := &testActor{name: "history", set: objects.ObjectInfoSet{
+		"a.azw3":       {Name: "a.azw3", File: true, PersistentID: "a", ObjSize: 100, ThumbName: "ta.jpg"},
+		"b.azw3":       {Name: "b.azw3", File: true, PersistentID: "b", ObjSize: 200, ThumbName: "tb.jpg"},
+		"b copy.azw3":  {Name: "b copy.azw3", File: true, PersistentID: "b", ObjSize: 200, ThumbName: "tb.jpg"},
+		"c.azw3":       {Name: "c.azw3", File: true, PersistentID: "c", ObjSize: 300, ThumbName: "tc.jpg"},
+		"d.azw3":       {Name: "d.azw3", File: true, PersistentID: "d", ObjSize: 400, ThumbName: "td.jpg"},
+		"d again.azw3": {Name: "d again.azw3", File: true, PersistentID: "d", ObjSize: 400, ThumbName: "td.jpg"},
+	}}
+	newDevice := func() *testActor {
+		return &testActor{name: "device", set: objects.ObjectInfoSet{
+			"documents":                        {Name: "documents", Dir: true, FullPath: "documents"},
+			"documents/test":                   {Name: "test", Dir: true, FullPath: "documents/test"},
+			"documents/test/a.azw3":            {Name: "a.azw3", File: true, ObjSize: 100, FullPath: "documents/test/a.azw3"},
+			"documents/test/b.azw3":            {Name: "b.azw3", File: true, ObjSize: 200, FullPath: "documents/test/b.azw3"},
+			"documents/test/b copy.azw3":       {Name: "b copy.azw3", File: true, ObjSize: 200, FullPath: "documents/test/b copy.azw3"},
+			"documents/test/d again.azw3":      {Name: "d again.azw3", File: true, ObjSize: 400, FullPath: "documents/test/d again.azw3"},
+			common.ThumbnailFolder:             {Name: "thumbnails", Dir: true, FullPath: common.ThumbnailFolder},
+			common.ThumbnailFolder + "/ta.jpg": {Name: "ta.jpg", File: true, ObjSize: 10, FullPath: common.ThumbnailFolder + "/ta.jpg"},
+			common.ThumbnailFolder + "/tb.jpg": {Name: "tb.jpg", File: true, ObjSize: 10, FullPath: common.ThumbnailFolder + "/tb.jpg"},
+			common.ThumbnailFolder + "/tc.jpg": {Name: "tc.jpg", File: true, ObjSize: 10, FullPath: common.ThumbnailFolder + "/tc.jpg"},
+			common.ThumbnailFolder + "/td.jpg": {Name: "td.jpg", File: true, ObjSize: 10, FullPath: common.ThumbnailFolder + "/td.jpg"},
+		}}
+	}
+
+	cases := []struct {
+		shared  *thumbRefs
+		removed []string
+	}{
+		// "tb" and "td" are used by other copies of the same books
+		{shared: nil, removed: []string{"ta.jpg", "tc.jpg"}},
+		// "ta" and "tc" are used by books of other targets
+		{shared: &thumbRefs{referenced: map[string]bool{"ta.jpg": true, "tc.jpg": true}}, removed: nil},
+	}
+	for i, c := range cases {
+		src, dst := newSource(), newDevice()
+		actions, _, _, err := PrepareActions(context.Background(), src, dst, hst, cfg, Options{shared: c.shared}, log)
+		if err != nil {
+			t.Fatalf("Case %d: failed to prepare actions: %v", i, err)
+		}
+		for _, action := range actions {
+			if err := action.run(context.Background(), true, log); err != nil {
+				t.Fatalf("Case %d: action failed: %v", i, err)
+			}
+		}
+		for _, name := range []string{"ta.jpg", "tb.jpg", "tc.jpg", "td.jpg"} {
+			p := common.ThumbnailFolder + "/" + name
+			if wantRemoved, removed := slices.Contains(c.removed, name), dst.set.Find(p) == nil; wantRemoved != removed {
+				t.Errorf("Case %d: thumbnail '%s' expected removed %t, got %t", i, name, wantRemoved, removed)
+			}
+		}
+	}
+}
+
+func TestEvictThumbs(t *testing.T) {
+	log := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+
+	cfg, err := config.LoadConfiguration("")
+	if err != nil {
+		t.Fatalf("Failed to load configuration: %v", err)
+	}
+	cfg.HistoryPath = t.TempDir()
+
+	name := history.GetName(common.ProtocolUSB, "SN", "documents/a")
+	p := filepath.Join(cfg.HistoryPath, name)
+	if err := history.Create(p, log, common.ProtocolUSB.String(), "SN", "documents/a"); err != nil {
+		t.Fatalf("Unable to create history: %v", err)
+	}
+	hst, err := history.Connect(p, log)
+	if err != nil {
+		t.Fatalf("Unable to open history: %v", err)
+	}
+	err = hst.SaveObjectInfos("/src", "documents/a", objects.ObjectInfoSet{"a.azw3": {Name: "a.azw3", PersistentID: "ha", ThumbName: "ta.jpg"}})
+	hst.Disconnect()
+	if err != nil {
+		t.Fatalf("Unable to save step: %v", err)
+	}
+
+	// "hb" is not managed, "hc" is not managed but was just extracted
+	dir := thumbs.CacheDir(thumbsCacheRoot(cfg), &cfg.Thumbnails)
+	old := time.Now().Add(-48 * time.Hour)
+	for _, hash := range []string{"ha", "hb", "hc"} {
+		entry := filepath.Join(dir, hash)
+		if err := os.MkdirAll(entry, 0755); err != nil {
+			t.Fatalf("Unable to create cache entry: %v", err)
+		}
+		if hash != "hc" {
+			if err := os.Chtimes(entry, old, old); err != nil {
+				t.Fatalf("Unable to age cache entry: %v", err)
+			}
+		}
+	}
+
+	if err := evictThumbs(cfg, log); err != nil {
+		t.Fatalf("Unable to evict thumbnails: %v", err)
+	}
+	for hash, kept := range map[string]bool{"ha": true, "hb": false, "hc": true} {
+		if _, err := os.Stat(filepath.Join(dir, hash)); (err == nil) != kept {
+			t.Errorf("Cache entry '%s': expected kept %t", hash, kept)
+		}
+	}
+}
+
+type testModelActor struct {
+	testActor
+	model string
+}
+
+func (a *testModelActor) Model() string { return a.model }
+
+func TestThumbsColor(t *testing.T) {
+	log := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+
+	cases := []struct {
+		profile string
+		dev     driver
+		color   bool
+	}{
+		{profile: config.ProfileAuto, dev: &testModelActor{model: "Kindle Colorsoft"}, color: true},
+		{profile: config.ProfileAuto, dev: &testModelActor{model: "Kindle Paperwhite"}, color: false},
+		{profile: config.ProfileAuto, dev: &testActor{}, color: false},
+		{profile: "", dev: &testModelActor{model: "KINDLE COLORSOFT SIGNATURE EDITION"}, color: true},
+		{profile: config.ProfileMono, dev: &testModelActor{model: "Kindle Colorsoft"}, color: false},
+		{profile: config.ProfileColor, dev: &testActor{}, color: true},
+	}
+	for i, c := range cases {
+		if color := thumbsColor(c.profile, c.dev, log); color != c.color {
+			t.Errorf("Case %d: expected color %t, got %t", i, c.color, color)
+		}
+	}
+}
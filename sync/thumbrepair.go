@@ -0,0 +1,172 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"time"
+
+	cli "github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+
+	"sync2kindle/common"
+	"sync2kindle/config"
+	"sync2kindle/files"
+	"sync2kindle/objects"
+	"sync2kindle/state"
+)
+
+// RunThumbsRepair sends again thumbnails of books sync has put on the device (for target and content channels from
+// configuration) when they are missing from the device or differ from the ones extracted from the books.
+func RunThumbsRepair(ctx *cli.Context) error {
+	env := ctx.Generic(state.FlagName).(*state.LocalEnv)
+	log := env.Log.Named("thumbs")
+
+	protocol, err := common.ParseProtocol(ctx.String("protocol"))
+	if err != nil {
+		return err
+	}
+	if protocol == common.ProtocolMail {
+		return errors.New("thumbnails are not used with e-mail delivery, nothing to repair")
+	}
+
+	log.Info("Thumbnails repair starting", zap.Stringer("protocol", protocol), zap.String("source", env.Cfg.SourcePath), zap.String("target", env.Cfg.TargetPath))
+	defer func(start time.Time) {
+		log.Info("Thumbnails repair finished", zap.Stringer("protocol", protocol), zap.Duration("elapsed", time.Since(start)))
+	}(time.Now())
+
+	jobs := prepareJobs(env.Cfg, protocol, false, log)
+
+	lock, err := lockDevice(ctx, protocol, env.Cfg, log)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	dev, err := connectDevice(ctx, protocol, devicePaths(jobs), env)
+	if err != nil {
+		return fmt.Errorf("unable to connect to device: %w", err)
+	}
+	defer dev.Disconnect()
+
+	if err := prepareThumbsDir(env, dev, jobs, log); err != nil {
+		return err
+	}
+
+	dstOIS, err := dev.GetObjectInfos(ctx.Context)
+	if err != nil {
+		return fmt.Errorf("unable to get files on the device: %w", err)
+	}
+	if dstOIS.Find(common.ThumbnailFolder) == nil {
+		log.Warn("Device has no thumbnails folder, nothing to repair")
+		return nil
+	}
+	deviceThumbs := getDeviceThumbs(dstOIS, env.Cfg.ThumbExtensions)
+
+	var repaired int
+	for _, j := range jobs {
+		if !j.thumbs {
+			continue
+		}
+		n, err := repairJobThumbs(ctx, j, protocol, dev, dstOIS, deviceThumbs, log)
+		repaired += n
+		if err != nil {
+			if len(j.name) == 0 {
+				return err
+			}
+			return fmt.Errorf("channel '%s': %w", j.name, err)
+		}
+	}
+	log.Info("Thumbnails repaired", zap.Int("count", repaired), zap.Bool("dry-run", ctx.Bool("dry-run")))
+	return nil
+}
+
+func repairJobThumbs(ctx *cli.Context, j job, protocol common.SupportedProtocols, dev driver, dstOIS, deviceThumbs objects.ObjectInfoSet, log *zap.Logger) (int, error) {
+	if len(j.name) > 0 {
+		log = log.With(zap.String("channel", j.name))
+	}
+
+	hst, hstOIS, release, err := openJobHistory(ctx, j, protocol, dev, log)
+	if err != nil || hst == nil {
+		return 0, err
+	}
+	defer release()
+
+	src, err := files.Connect(j.cfg.SourcePath, "", &j.cfg.Thumbnails, log)
+	if err != nil {
+		return 0, fmt.Errorf("bad source path: %w", err)
+	}
+	defer src.Disconnect()
+
+	srcOIS, err := src.GetObjectInfos(ctx.Context)
+	if err != nil {
+		return 0, fmt.Errorf("unable to get source files: %w", err)
+	}
+	local := srcOIS.SubsetByPath(j.cfg.SourcePath)
+
+	// only books which are on the device and are still the ones which were sent
+	books := objects.New()
+	for key, hobj := range hstOIS {
+		if hobj.Dir || hobj.External || !slices.Contains(j.cfg.BookExtensions, path.Ext(hobj.Name)) {
+			continue
+		}
+		if dstOIS.Find(recordedDevicePath(j.cfg, key, hobj)) == nil {
+			continue
+		}
+		if lobj := local.Find(key); lobj != nil && lobj.PersistentID == hobj.PersistentID {
+			lobj.ThumbName = hobj.ThumbName
+			books[key] = lobj
+		}
+	}
+
+	actions := makeThumbRepairActions(ctx.Context, nil, books, dstOIS, deviceThumbs, j.cfg, src, dev, log)
+	done, err := runActions(ctx.Context, actions, ctx.Bool("dry-run"), log)
+
+	repaired := make(map[string]bool)
+	for _, a := range actions[:done] {
+		for _, key := range a.books {
+			repaired[key] = true
+		}
+	}
+	if err != nil {
+		return len(repaired), fmt.Errorf("unable to repair thumbnails: %w", err)
+	}
+	return len(repaired), nil
+}
+
+// makeThumbRepairActions creates actions to send again thumbnails of the books which are already on the device, but
+// have their thumbnails missing or different from the ones extracted from the books. Thumbnails are extracted when
+// they are not in cache yet, books sent without thumbnail are looked at again too.
+func makeThumbRepairActions(ctx context.Context, actions []action, books, dstOIS, deviceThumbs objects.ObjectInfoSet, cfg *config.Config, srcActor, dstActor driver, log *zap.Logger) []action {
+	for _, key := range slices.Sorted(maps.Keys(books)) {
+		obj := books[key]
+		fi, err := os.Stat(cachedThumbPath(cfg, obj))
+		if len(obj.ThumbName) == 0 || err != nil {
+			if lookupThumbnail(ctx, srcActor, obj); len(obj.ThumbName) == 0 {
+				continue
+			}
+			if fi, err = os.Stat(cachedThumbPath(cfg, obj)); err != nil {
+				continue
+			}
+		}
+
+		var reason string
+		switch thumb := deviceThumbs.Find(obj.ThumbName); {
+		case thumb == nil:
+			reason = "missing"
+		case thumb.ObjSize != fi.Size():
+			reason = fmt.Sprintf("size mismatch: extracted %d, device %d", fi.Size(), thumb.ObjSize)
+		default:
+			continue
+		}
+		log.Info("Device thumbnail is broken, sending it again", zap.String("book", key), zap.String("thumbnail", obj.ThumbName), zap.String("reason", reason))
+		first := len(actions)
+		actions = makeThumbActions(actions, obj, dstOIS, deviceThumbs, cfg, dstActor, log)
+		tagActions(actions[first:], key)
+	}
+	return actions
+}
@@ -0,0 +1,142 @@
+package sync
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+
+	"sync2kindle/common"
+	"sync2kindle/config"
+	"sync2kindle/objects"
+	"sync2kindle/thumbs"
+)
+
+func TestPrepareActionsThumbRepair(t *testing.T) {
+	cfg, err := config.LoadConfiguration("")
+	if err != nil {
+		t.Fatalf("Failed to load configuration: %v", err)
+	}
+	cfg.SourcePath = `D:/test/out`
+	cfg.TargetPath = `documents/test`
+	cfg.Thumbnails.Dir = t.TempDir()
+
+	log := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+
+	// cached thumbnails of all books are 10 bytes, "d" has nothing in cache
+	for _, b := range []string{"a", "b", "c"} {
+		p := thumbs.CachePath(cfg.Thumbnails.Dir, b, "t"+b+".jpg")
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("Unable to create cache entry: %v", err)
+		}
+		if err := os.WriteFile(p, make([]byte, 10), 0644); err != nil {
+			t.Fatalf("Unable to write cached thumbnail: %v", err)
+		}
+	}
+
+	src := &testActor{name: "local", set: objects.ObjectInfoSet{
+		"D:/test/out":        {Name: "out", Dir: true, FullPath: "D:/test/out"},
+		"D:/test/out/a.azw3": {Name: "a.azw3", File: true, PersistentID: "a", ObjSize: 100, FullPath: "D:/test/out/a.azw3"},
+		"D:/test/out/b.azw3": {Name: "b.azw3", File: true, PersistentID: "b", ObjSize: 200, FullPath: "D:/test/out/b.azw3"},
+		"D:/test/out/c.azw3": {Name: "c.azw3", File: true, PersistentID: "c", ObjSize: 300, FullPath: "D:/test/out/c.azw3"},
+		"D:/test/out/d.azw3": {Name: "d.azw3", File: true, PersistentID: "d", ObjSize: 400, FullPath: "D:/test/out/d.azw3"},
+	}}
+	hst := &testActor{name: "history", set: objects.ObjectInfoSet{
+		"a.azw3": {Name: "a.azw3", File: true, PersistentID: "a", ObjSize: 100, ThumbName: "ta.jpg"},
+		"b.azw3": {Name: "b.azw3", File: true, PersistentID: "b", ObjSize: 200, ThumbName: "tb.jpg"},
+		"c.azw3": {Name: "c.azw3", File: true, PersistentID: "c", ObjSize: 300, ThumbName: "tc.jpg"},
+		"d.azw3": {Name: "d.azw3", File: true, PersistentID: "d", ObjSize: 400, ThumbName: "td.jpg"},
+	}}
+	// "ta" was purged, "tb" is of different size, "tc" is fine, "td" cannot be checked
+	dst := &testActor{name: "device", set: objects.ObjectInfoSet{
+		"documents":                        {Name: "documents", Dir: true, FullPath: "documents"},
+		"documents/test":                   {Name: "test", Dir: true, FullPath: "documents/test"},
+		"documents/test/a.azw3":            {Name: "a.azw3", File: true, ObjSize: 100, FullPath: "documents/test/a.azw3"},
+		"documents/test/b.azw3":            {Name: "b.azw3", File: true, ObjSize: 200, FullPath: "documents/test/b.azw3"},
+		"documents/test/c.azw3":            {Name: "c.azw3", File: true, ObjSize: 300, FullPath: "documents/test/c.azw3"},
+		"documents/test/d.azw3":            {Name: "d.azw3", File: true, ObjSize: 400, FullPath: "documents/test/d.azw3"},
+		common.ThumbnailFolder:             {Name: "thumbnails", Dir: true, FullPath: common.ThumbnailFolder},
+		common.ThumbnailFolder + "/tb.jpg": {Name: "tb.jpg", File: true, ObjSize: 5, FullPath: common.ThumbnailFolder + "/tb.jpg"},
+		common.ThumbnailFolder + "/tc.jpg": {Name: "tc.jpg", File: true, ObjSize: 10, FullPath: common.ThumbnailFolder + "/tc.jpg"},
+	}}
+
+	actions, _, _, err := PrepareActions(context.Background(), src, dst, hst, cfg, Options{}, log)
+	if err != nil {
+		t.Fatalf("Failed to prepare actions: %v", err)
+	}
+	for _, action := range actions {
+		if err := action.run(context.Background(), false, log); err != nil {
+			t.Fatalf("Action failed: %v", err)
+		}
+	}
+	if dst.additions != 2 || dst.deletions != 1 {
+		t.Errorf("Expected 2 thumbnails sent and 1 removed, got %d and %d", dst.additions, dst.deletions)
+	}
+	for name, size := range map[string]int64{"ta.jpg": 10, "tb.jpg": 10, "tc.jpg": 10} {
+		if thumb := dst.set.Find(common.ThumbnailFolder + "/" + name); thumb == nil || thumb.ObjSize != size {
+			t.Errorf("Thumbnail '%s': expected on the device with size %d, got %v", name, size, thumb)
+		}
+	}
+	if dst.set.Find(common.ThumbnailFolder+"/td.jpg") != nil {
+		t.Errorf("Thumbnail 'td.jpg' is not expected on the device")
+	}
+}
+
+func TestPrepareActionsCoverChanged(t *testing.T) {
+	cfg, err := config.LoadConfiguration("")
+	if err != nil {
+		t.Fatalf("Failed to load configuration: %v", err)
+	}
+	cfg.SourcePath = `D:/test/out`
+	cfg.TargetPath = `documents/test`
+	cfg.Thumbnails.Dir = t.TempDir()
+
+	log := zaptest.NewLogger(t, zaptest.Level(zap.WarnLevel))
+
+	// thumbnail made of the new cover
+	p := thumbs.CachePath(cfg.Thumbnails.Dir, thumbs.CacheKey("a", "new"), "ta.jpg")
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatalf("Unable to create cache entry: %v", err)
+	}
+	if err := os.WriteFile(p, make([]byte, 20), 0644); err != nil {
+		t.Fatalf("Unable to write cached thumbnail: %v", err)
+	}
+
+	src := &testActor{name: "local", set: objects.ObjectInfoSet{
+		"D:/test/out":        {Name: "out", Dir: true, FullPath: "D:/test/out"},
+		"D:/test/out/a.azw3": {Name: "a.azw3", File: true, PersistentID: "a", CoverID: "new", ObjSize: 100, FullPath: "D:/test/out/a.azw3"},
+	}}
+	hst := &testActor{name: "history", set: objects.ObjectInfoSet{
+		"a.azw3": {Name: "a.azw3", File: true, PersistentID: "a", CoverID: "old", ObjSize: 100, ThumbName: "ta.jpg"},
+	}}
+	dst := &testActor{name: "device", set: objects.ObjectInfoSet{
+		"documents":                        {Name: "documents", Dir: true, FullPath: "documents"},
+		"documents/test":                   {Name: "test", Dir: true, FullPath: "documents/test"},
+		"documents/test/a.azw3":            {Name: "a.azw3", File: true, ObjSize: 100, FullPath: "documents/test/a.azw3"},
+		common.ThumbnailFolder:             {Name: "thumbnails", Dir: true, FullPath: common.ThumbnailFolder},
+		common.ThumbnailFolder + "/ta.jpg": {Name: "ta.jpg", File: true, ObjSize: 10, FullPath: common.ThumbnailFolder + "/ta.jpg"},
+	}}
+
+	actions, ois, _, err := PrepareActions(context.Background(), src, dst, hst, cfg, Options{}, log)
+	if err != nil {
+		t.Fatalf("Failed to prepare actions: %v", err)
+	}
+	for _, action := range actions {
+		if err := action.run(context.Background(), false, log); err != nil {
+			t.Fatalf("Action failed: %v", err)
+		}
+	}
+	// only thumbnail is replaced, book stays
+	if dst.additions != 1 || dst.deletions != 1 {
+		t.Errorf("Expected thumbnail to be replaced, got %d additions and %d deletions", dst.additions, dst.deletions)
+	}
+	if thumb := dst.set.Find(common.ThumbnailFolder + "/ta.jpg"); thumb == nil || thumb.ObjSize != 20 {
+		t.Errorf("Expected new thumbnail on the device, got %v", thumb)
+	}
+	if obj := ois.Find("D:/test/out/a.azw3"); obj == nil || obj.CoverID != "new" {
+		t.Errorf("Expected new cover to be recorded, got %v", obj)
+	}
+}
@@ -0,0 +1,294 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"path"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	cli "github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+
+	"sync2kindle/common"
+	"sync2kindle/config"
+	"sync2kindle/files"
+	"sync2kindle/objects"
+	"sync2kindle/state"
+)
+
+// Findings verify reports.
+const (
+	findingMissing    = "missing"    // book is not on the device
+	findingTruncated  = "truncated"  // device copy is shorter than what was sent
+	findingCorrupted  = "corrupted"  // device copy content differs from what was sent
+	findingUnreadable = "unreadable" // device copy content cannot be read
+)
+
+// finding is a single book which device copy does not match history. Book could only be repaired when local book
+// is the same one which was sent.
+type finding struct {
+	channel    string
+	kind       string
+	key        string // history key, relative to the source
+	path       string // device path
+	detail     string
+	repairable bool
+	repaired   bool
+}
+
+// RunVerify reads every book sync has sent to the device and compares its content with hash recorded in history for
+// target and content channels from configuration, with "repair" flag broken books are sent again.
+func RunVerify(ctx *cli.Context) error {
+	env := ctx.Generic(state.FlagName).(*state.LocalEnv)
+	log := env.Log.Named("verify")
+
+	protocol, err := common.ParseProtocol(ctx.String("protocol"))
+	if err != nil {
+		return err
+	}
+	if protocol == common.ProtocolMail {
+		return errors.New("device content is not accessible with e-mail delivery, nothing to verify")
+	}
+	repair := ctx.Bool("repair")
+
+	log.Info("Verify starting", zap.Stringer("protocol", protocol), zap.String("source", env.Cfg.SourcePath), zap.String("target", env.Cfg.TargetPath), zap.Bool("repair", repair))
+	defer func(start time.Time) {
+		log.Info("Verify finished", zap.Stringer("protocol", protocol), zap.Duration("elapsed", time.Since(start)))
+	}(time.Now())
+
+	jobs := prepareJobs(env.Cfg, protocol, false, log)
+
+	lock, err := lockDevice(ctx, protocol, env.Cfg, log)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	dev, err := connectDevice(ctx, protocol, devicePaths(jobs), env)
+	if err != nil {
+		return fmt.Errorf("unable to connect to device: %w", err)
+	}
+	defer dev.Disconnect()
+
+	h, ok := dev.(hasher)
+	if !ok {
+		return fmt.Errorf("device driver '%s' cannot read book content", dev.Name())
+	}
+
+	if repair {
+		// thumbnails are sent again with repaired books
+		if err := prepareThumbsDir(env, dev, jobs, log); err != nil {
+			return err
+		}
+	}
+
+	dstOIS, err := dev.GetObjectInfos(ctx.Context)
+	if err != nil {
+		return fmt.Errorf("unable to get files on the device: %w", err)
+	}
+
+	var deviceThumbs objects.ObjectInfoSet
+	if dstOIS.Find(common.ThumbnailFolder) != nil {
+		deviceThumbs = getDeviceThumbs(dstOIS, env.Cfg.ThumbExtensions)
+	}
+
+	var (
+		findings []finding
+		checked  int
+	)
+	for _, j := range jobs {
+		jf, n, err := verifyJob(ctx, j, protocol, dev, h, dstOIS, deviceThumbs, repair, log)
+		checked += n
+		if err != nil {
+			if len(j.name) == 0 {
+				return err
+			}
+			return fmt.Errorf("channel '%s': %w", j.name, err)
+		}
+		findings = append(findings, jf...)
+	}
+	return printFindings(ctx.App.Writer, findings, checked, repair)
+}
+
+func verifyJob(ctx *cli.Context, j job, protocol common.SupportedProtocols, dev driver, h hasher, dstOIS, deviceThumbs objects.ObjectInfoSet, repair bool, log *zap.Logger) ([]finding, int, error) {
+	if len(j.name) > 0 {
+		log = log.With(zap.String("channel", j.name))
+	}
+
+	hst, hstOIS, release, err := openJobHistory(ctx, j, protocol, dev, log)
+	if err != nil || hst == nil {
+		return nil, 0, err
+	}
+	defer release()
+
+	historyBooks := hstOIS.SubsetByFunc(func(_ string, v *objects.ObjectInfo) bool {
+		return !v.Dir && slices.Contains(j.cfg.BookExtensions, path.Ext(v.Name))
+	})
+
+	findings, checked := verifyBooks(ctx.Context, j.cfg, historyBooks, dstOIS, h, log)
+	if err := ctx.Context.Err(); err != nil {
+		return nil, checked, fmt.Errorf("verification interrupted: %w", err)
+	}
+	for i := range findings {
+		findings[i].channel = j.name
+	}
+	if len(findings) == 0 {
+		return nil, checked, nil
+	}
+
+	var thumbsCfg *config.ThumbnailsConfig
+	if repair && j.thumbs {
+		thumbsCfg = &j.cfg.Thumbnails
+	} else {
+		deviceThumbs = nil
+	}
+	src, err := files.Connect(j.cfg.SourcePath, "", thumbsCfg, log)
+	if err != nil {
+		return nil, checked, fmt.Errorf("bad source path: %w", err)
+	}
+	defer src.Disconnect()
+
+	srcOIS, err := src.GetObjectInfos(ctx.Context)
+	if err != nil {
+		return nil, checked, fmt.Errorf("unable to get source files: %w", err)
+	}
+	rt, err := newRouter(j.cfg)
+	if err != nil {
+		return nil, checked, err
+	}
+	local := srcOIS.SubsetByPath(j.cfg.SourcePath)
+
+	for i := range findings {
+		f := &findings[i]
+		if f.kind == findingMissing {
+			continue
+		}
+		lobj := local.Find(f.key)
+		switch {
+		case lobj == nil:
+			f.detail += ", local book is gone"
+			continue
+		case lobj.PersistentID != historyBooks[f.key].PersistentID:
+			f.detail += ", local book has changed since it was sent"
+			continue
+		case rt.devicePath(f.key) != f.path:
+			f.detail += ", routing rules have changed since it was sent"
+			continue
+		}
+		f.repairable = true
+		if !repair {
+			continue
+		}
+
+		log.Info("Repairing", zap.String("book", f.key), zap.String("problem", f.kind))
+		if deviceThumbs != nil {
+			lookupThumbnail(ctx.Context, src, lobj)
+		}
+		actions := makeSendActions(nil, f.key, lobj, srcOIS, dstOIS, deviceThumbs, rt, j.cfg, dev, log)
+		if _, err := runActions(ctx.Context, actions, false, log); err != nil {
+			if ctx.Context.Err() != nil {
+				return nil, checked, fmt.Errorf("repair interrupted: %w", err)
+			}
+			log.Warn("Unable to repair", zap.String("book", f.key), zap.Error(err))
+			continue
+		}
+		f.repaired = true
+	}
+	return findings, checked, nil
+}
+
+// verifyBooks compares device copies of history books with what was sent, sizes are compared first and content is
+// only hashed when sizes match. Books without recorded content hash are not checked. Returns findings and number of
+// books checked, stops early when context is done.
+func verifyBooks(ctx context.Context, cfg *config.Config, historyBooks, dstOIS objects.ObjectInfoSet, h hasher, log *zap.Logger) ([]finding, int) {
+	var (
+		findings []finding
+		checked  int
+	)
+	for _, key := range slices.Sorted(maps.Keys(historyBooks)) {
+		if ctx.Err() != nil {
+			break
+		}
+		hobj := historyBooks[key]
+		devPath := recordedDevicePath(cfg, key, hobj)
+
+		dobj := dstOIS.Find(devPath)
+		if dobj == nil || dobj.Dir {
+			findings = append(findings, finding{kind: findingMissing, key: key, path: devPath, detail: "not on the device"})
+			continue
+		}
+		if len(hobj.PersistentID) == 0 {
+			log.Debug("No content hash in history, skipping", zap.String("book", key))
+			continue
+		}
+
+		f := finding{key: key, path: devPath}
+		switch {
+		case dobj.ObjSize < hobj.ObjSize:
+			f.kind, f.detail = findingTruncated, fmt.Sprintf("device copy has %d bytes, %d were sent", dobj.ObjSize, hobj.ObjSize)
+		case dobj.ObjSize != hobj.ObjSize:
+			f.kind, f.detail = findingCorrupted, fmt.Sprintf("device copy has %d bytes, %d were sent", dobj.ObjSize, hobj.ObjSize)
+		default:
+			hash, err := h.Hash(ctx, dobj)
+			switch {
+			case err != nil && ctx.Err() != nil:
+				return findings, checked
+			case err != nil:
+				f.kind, f.detail = findingUnreadable, err.Error()
+			case hash != hobj.PersistentID:
+				f.kind, f.detail = findingCorrupted, "device copy content differs from what was sent"
+			default:
+				log.Debug("Book verified", zap.String("book", key))
+				checked++
+				continue
+			}
+		}
+		checked++
+		findings = append(findings, f)
+	}
+	return findings, checked
+}
+
+func printFindings(out io.Writer, findings []finding, checked int, repair bool) error {
+	if len(findings) == 0 {
+		fmt.Fprintf(out, "%d books verified, no problems found\n", checked)
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHANNEL\tPROBLEM\tPATH\tDETAILS\tREPAIR")
+	var repairable, repaired int
+	for _, f := range findings {
+		channel, status := f.channel, "-"
+		if len(channel) == 0 {
+			channel = "-"
+		}
+		if f.repairable {
+			repairable++
+			switch {
+			case !repair:
+				status = "available"
+			case f.repaired:
+				repaired++
+				status = "repaired"
+			default:
+				status = "failed"
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", channel, f.kind, f.path, f.detail, status)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if repair {
+		fmt.Fprintf(out, "%d books verified, %d problems found, %d repaired\n", checked, len(findings), repaired)
+	} else {
+		fmt.Fprintf(out, "%d books verified, %d problems found, %d could be repaired with --repair\n", checked, len(findings), repairable)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package sync
+
+import (
+	"context"
+	"testing"
+
+	"go.uber.org/zap/zaptest"
+
+	"sync2kindle/config"
+	"sync2kindle/objects"
+)
+
+func TestVerifyBooks(t *testing.T) {
+	cfg := &config.Config{TargetPath: "documents/mybooks", BookExtensions: []string{".azw3"}}
+
+	book := func(name, id string, size int64) *objects.ObjectInfo {
+		return &objects.ObjectInfo{Name: name, File: true, PersistentID: id, ObjSize: size}
+	}
+	hst := objects.ObjectInfoSet{
+		"a.azw3":     book("a.azw3", "a", 10),
+		"b.azw3":     book("b.azw3", "b", 10),
+		"c.azw3":     book("c.azw3", "c", 10),
+		"d.azw3":     book("d.azw3", "d", 10),
+		"e.azw3":     book("e.azw3", "e", 10),
+		"f.azw3":     book("f.azw3", "", 10),
+		"pdf/g.azw3": book("g.azw3", "g", 10),
+	}
+	hst["pdf/g.azw3"].DevicePath = "documents/pdfs/g.azw3"
+	dst := objects.ObjectInfoSet{
+		"documents/mybooks/a.azw3": book("a.azw3", "", 10),
+		"documents/mybooks/b.azw3": book("b.azw3", "", 4),
+		"documents/mybooks/c.azw3": book("c.azw3", "", 12),
+		"documents/mybooks/d.azw3": book("d.azw3", "", 10),
+		"documents/mybooks/f.azw3": book("f.azw3", "", 10),
+		"documents/pdfs/g.azw3":    book("g.azw3", "", 10),
+	}
+	for k, v := range dst {
+		v.FullPath = k
+	}
+	h := &testHashActor{testActor: testActor{name: "device", set: dst}, hashes: map[string]string{
+		"documents/mybooks/a.azw3": "a",
+		"documents/mybooks/d.azw3": "broken",
+		"documents/pdfs/g.azw3":    "g",
+	}}
+
+	findings, checked := verifyBooks(context.Background(), cfg, hst, dst, h, zaptest.NewLogger(t))
+	if checked != 5 {
+		t.Errorf("Expected 5 books checked, got %d", checked)
+	}
+	expected := []struct{ kind, path string }{
+		{findingTruncated, "documents/mybooks/b.azw3"},
+		{findingCorrupted, "documents/mybooks/c.azw3"},
+		{findingCorrupted, "documents/mybooks/d.azw3"},
+		{findingMissing, "documents/mybooks/e.azw3"},
+	}
+	if len(findings) != len(expected) {
+		t.Fatalf("Expected %d findings, got %d: %+v", len(expected), len(findings), findings)
+	}
+	for i, e := range expected {
+		if findings[i].kind != e.kind || findings[i].path != e.path {
+			t.Errorf("Finding %d: expected %s '%s', got %s '%s'", i, e.kind, e.path, findings[i].kind, findings[i].path)
+		}
+	}
+}
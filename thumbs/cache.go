@@ -0,0 +1,133 @@
+package thumbs
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"sync2kindle/config"
+)
+
+// Thumbnail cache keeps extracted thumbnails between runs. Every thumbnail size and processing (profile and tuning
+// options) has its own directory under the cache root, where every book has an entry (directory named by book content
+// hash and content hash of its user supplied cover if any) with its thumbnail in it. Empty entry remembers that book
+// has no thumbnail, so it is not parsed again.
+
+// entryMinAge protects entries which could have just been created by another run from eviction.
+const entryMinAge = 24 * time.Hour
+
+// CacheDir returns cache directory for the thumbnail size and processing, so thumbnails produced with different
+// settings never mix.
+func CacheDir(root string, params *config.ThumbnailsConfig) string {
+	profile := config.ProfileMono
+	if params.Color {
+		profile = config.ProfileColor
+	}
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%g/%g/%g/%t", params.Gamma, params.Contrast, params.Sharpen, params.Dither)
+	return filepath.Join(root, fmt.Sprintf("%dx%d-%s-%08x", params.Width, params.Height, profile, h.Sum32()))
+}
+
+// CacheKey returns name of the cache entry for the book with content "hash" and user supplied cover with content
+// "cover", which could be empty.
+func CacheKey(hash, cover string) string {
+	if len(cover) == 0 {
+		return hash
+	}
+	return hash + "-" + cover
+}
+
+// CachePath returns path of the cached thumbnail "name" for the cache entry "key".
+func CachePath(dir, key, name string) string {
+	return filepath.Join(dir, key, name)
+}
+
+// CachedThumbnail returns name of the thumbnail for the book "fname" with cache entry "key". Thumbnail is extracted
+// into cache directory "params.Dir" only when it is not there yet, empty name is returned when book has no thumbnail
+// or it could not be extracted. Only the former is remembered, extraction is attempted again next time.
+func CachedThumbnail(fname, key string, params *config.ThumbnailsConfig, log *zap.Logger) string {
+	entry := filepath.Join(params.Dir, key)
+	if files, err := os.ReadDir(entry); err == nil {
+		// entry is in use, keep it from being evicted
+		now := time.Now()
+		_ = os.Chtimes(entry, now, now)
+		for _, f := range files {
+			if !f.IsDir() {
+				log.Debug("Thumbnail found in cache", zap.String("file", fname), zap.String("thumbnail", f.Name()))
+				return f.Name()
+			}
+		}
+		return ""
+	}
+
+	// extract into temporary entry, so incomplete entries never become visible
+	tmp, err := os.MkdirTemp(params.Dir, key+".tmp-")
+	if err != nil {
+		log.Warn("Unable to create thumbnail cache entry", zap.String("file", fname), zap.Error(err))
+		return ""
+	}
+	defer os.RemoveAll(tmp)
+
+	p := *params
+	p.Dir = tmp
+	name, err := ExtractThumbnail(fname, &p, log)
+	if err != nil {
+		// failure could be temporary, only books which have no thumbnail are remembered
+		log.Warn("Unable to extract thumbnail", zap.String("file", fname), zap.Error(err))
+		return ""
+	}
+	if err := os.Rename(tmp, entry); err != nil {
+		if _, serr := os.Stat(entry); serr != nil {
+			log.Warn("Unable to store thumbnail in cache", zap.String("file", fname), zap.Error(err))
+			return ""
+		}
+		// created by another run in the meantime
+	}
+	return name
+}
+
+// EvictCache removes cache entries (of every thumbnail size) which are not in "keep" set of entry keys.
+// Recent entries are left alone, they could belong to books which are being sent right now.
+func EvictCache(root string, keep map[string]bool, log *zap.Logger) (int, error) {
+	sizes, err := os.ReadDir(root)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("unable to read thumbnail cache '%s': %w", root, err)
+	}
+	cutoff := time.Now().Add(-entryMinAge)
+
+	var evicted int
+	for _, s := range sizes {
+		if !s.IsDir() {
+			continue
+		}
+		dir := filepath.Join(root, s.Name())
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return evicted, fmt.Errorf("unable to read thumbnail cache '%s': %w", dir, err)
+		}
+		for _, e := range entries {
+			key, _, _ := strings.Cut(e.Name(), ".tmp-")
+			if keep[key] && key == e.Name() {
+				continue
+			}
+			if fi, err := e.Info(); err != nil || fi.ModTime().After(cutoff) {
+				continue
+			}
+			if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+				log.Warn("Unable to remove thumbnail cache entry", zap.String("entry", e.Name()), zap.Error(err))
+				continue
+			}
+			evicted++
+		}
+	}
+	return evicted, nil
+}
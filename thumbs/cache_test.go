@@ -0,0 +1,56 @@
+package thumbs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+
+	"sync2kindle/config"
+)
+
+func TestCachedThumbnailFailure(t *testing.T) {
+	log := zaptest.NewLogger(t, zaptest.Level(zap.ErrorLevel))
+	dir := t.TempDir()
+	params := &config.ThumbnailsConfig{Width: 330, Height: 470, Dir: filepath.Join(dir, "cache")}
+	if err := os.MkdirAll(params.Dir, 0755); err != nil {
+		t.Fatalf("Unable to create cache directory: %v", err)
+	}
+
+	// book which cannot be read is not remembered
+	if name := CachedThumbnail(filepath.Join(dir, "missing.azw3"), "a", params, log); len(name) > 0 {
+		t.Fatalf("Unexpected thumbnail '%s'", name)
+	}
+	if _, err := os.Stat(filepath.Join(params.Dir, "a")); !os.IsNotExist(err) {
+		t.Fatalf("Failed extraction is cached: %v", err)
+	}
+
+	// book which cannot have thumbnail is
+	fname := filepath.Join(dir, "book.pdf")
+	if err := os.WriteFile(fname, []byte("%PDF-1.4"), 0644); err != nil {
+		t.Fatalf("Unable to write book: %v", err)
+	}
+	if name := CachedThumbnail(fname, "b", params, log); len(name) > 0 {
+		t.Fatalf("Unexpected thumbnail '%s'", name)
+	}
+	if fi, err := os.Stat(filepath.Join(params.Dir, "b")); err != nil || !fi.IsDir() {
+		t.Fatalf("Book without thumbnail is not cached: %v", err)
+	}
+
+	// so is book which cannot be parsed
+	fname = filepath.Join(dir, "broken.azw3")
+	if err := os.WriteFile(fname, []byte("not a book"), 0644); err != nil {
+		t.Fatalf("Unable to write book: %v", err)
+	}
+	if name := CachedThumbnail(fname, "c", params, log); len(name) > 0 {
+		t.Fatalf("Unexpected thumbnail '%s'", name)
+	}
+	if fi, err := os.Stat(filepath.Join(params.Dir, "c")); err != nil || !fi.IsDir() {
+		t.Fatalf("Book which cannot be parsed is not cached: %v", err)
+	}
+	if entries, _ := os.ReadDir(params.Dir); len(entries) != 2 {
+		t.Fatalf("Expected two cache entries, got %d", len(entries))
+	}
+}
@@ -0,0 +1,49 @@
+package thumbs
+
+import (
+	"image"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// coverExtensions lists image formats accepted as user supplied covers.
+var coverExtensions = []string{".jpg", ".jpeg", ".png"}
+
+// coversFolder is folder next to the books where user supplied covers could be kept named after the books.
+const coversFolder = "covers"
+
+// Supported reports if thumbnail could be extracted from the book "fname".
+func Supported(fname string) bool {
+	return slices.Contains([]string{".mobi", ".azw3", ".kfx"}, filepath.Ext(fname))
+}
+
+// CoverOverride returns path of user supplied cover image for the book "fname" or empty string if there is none.
+// Image is looked for next to the book ("book.cover.png", "book.jpg") and in "covers" folder next to the book
+// ("covers/book.jpg"), first one found wins.
+func CoverOverride(fname string) string {
+	if !Supported(fname) {
+		return ""
+	}
+	dir, base := filepath.Dir(fname), strings.TrimSuffix(filepath.Base(fname), filepath.Ext(fname))
+	for _, name := range []string{
+		filepath.Join(dir, base+".cover"),
+		filepath.Join(dir, base),
+		filepath.Join(dir, coversFolder, base),
+	} {
+		for _, ext := range coverExtensions {
+			if fi, err := os.Stat(name + ext); err == nil && fi.Mode().IsRegular() {
+				return name + ext
+			}
+		}
+	}
+	return ""
+}
+
+// loadCover decodes user supplied cover image respecting its orientation.
+func loadCover(fname string) (image.Image, error) {
+	return imaging.Open(fname, imaging.AutoOrientation(true))
+}
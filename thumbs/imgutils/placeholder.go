@@ -0,0 +1,145 @@
+package imgutils
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"strings"
+	"unicode"
+)
+
+// Placeholder cover layout.
+const (
+	titleChars     = 12 // title font is scaled to fit that many characters in the line
+	titleMaxLines  = 5
+	authorMaxLines = 2
+)
+
+var (
+	paper = color.Gray{Y: 0xf0}
+	ink   = color.Gray{Y: 0x20}
+)
+
+// Placeholder draws plain cover of "w" by "h" pixels with book title and author, so books without cover image do not
+// look like blank tiles. Characters the embedded font does not have are transliterated or left out, "fallback" (file
+// name) replaces title nothing of which could be drawn. Nil is returned when neither could be drawn.
+func Placeholder(title, author, fallback string, w, h int) image.Image {
+	margin := max(w/16, 2)
+	inner := w - 4*margin
+	titleScale := max(inner/(glyphAdvance*titleChars), 1)
+	authorScale := max(titleScale*2/3, 1)
+
+	titleLines := wrapText(title, inner/(glyphAdvance*titleScale), titleMaxLines)
+	if len(titleLines) == 0 {
+		titleLines = wrapText(fallback, inner/(glyphAdvance*titleScale), titleMaxLines)
+	}
+	if len(titleLines) == 0 {
+		return nil
+	}
+
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	draw.Draw(img, img.Bounds(), &image.Uniform{C: paper}, image.Point{}, draw.Src)
+
+	border := max(w/100, 1)
+	for i := range border {
+		drawRect(img, image.Rect(margin+i, margin+i, w-margin-i, h-margin-i))
+	}
+
+	y := h / 4
+	for _, line := range titleLines {
+		drawText(img, line, y, titleScale)
+		y += lineAdvance * titleScale
+	}
+	lines := wrapText(author, inner/(glyphAdvance*authorScale), authorMaxLines)
+	y = h - 2*margin - len(lines)*lineAdvance*authorScale
+	for _, line := range lines {
+		drawText(img, line, y, authorScale)
+		y += lineAdvance * authorScale
+	}
+	return img
+}
+
+// wrapText splits text into lines of at most "width" characters breaking it on spaces, text which does not fit into
+// "lines" is cut off with ellipsis.
+func wrapText(text string, width, lines int) []string {
+	if width <= 0 {
+		return nil
+	}
+	text = drawable(text)
+
+	var (
+		result []string
+		line   []rune
+	)
+	for _, word := range strings.Fields(text) {
+		w := []rune(word)
+		if len(line) > 0 && len(line)+1+len(w) > width {
+			result = append(result, string(line))
+			line = nil
+		}
+		if len(line) > 0 {
+			line = append(line, ' ')
+		}
+		line = append(line, w...)
+		for len(line) > width {
+			// word longer than the line
+			result = append(result, string(line[:width]))
+			line = line[width:]
+		}
+	}
+	if len(line) > 0 {
+		result = append(result, string(line))
+	}
+	if len(result) > lines {
+		result = result[:lines]
+		last := []rune(result[lines-1])
+		result[lines-1] = strings.TrimSpace(string(last[:min(len(last), max(width-3, 0))])) + "..."
+	}
+	return result
+}
+
+// drawable returns text in capitals, characters font does not have are transliterated or left out.
+func drawable(text string) string {
+	var b strings.Builder
+	for _, r := range text {
+		r = unicode.ToUpper(r)
+		if _, ok := glyphs[r]; ok {
+			b.WriteRune(r)
+		} else if unicode.IsSpace(r) {
+			b.WriteByte(' ')
+		} else {
+			b.WriteString(transliterations[r])
+		}
+	}
+	return b.String()
+}
+
+// drawText draws single line of text centered horizontally with its top at "y".
+func drawText(img *image.Gray, text string, y, scale int) {
+	runes := []rune(text)
+	x := (img.Bounds().Dx() - (len(runes)*glyphAdvance-1)*scale) / 2
+	for _, r := range runes {
+		g := glyphs[r]
+		for row, bits := range g {
+			for col := range glyphWidth {
+				if bits&(1<<(glyphWidth-1-col)) != 0 {
+					px := image.Rect(x+col*scale, y+row*scale, x+(col+1)*scale, y+(row+1)*scale)
+					draw.Draw(img, px, &image.Uniform{C: ink}, image.Point{}, draw.Src)
+				}
+			}
+		}
+		x += glyphAdvance * scale
+	}
+}
+
+// drawRect draws one pixel wide outline of the rectangle.
+func drawRect(img *image.Gray, r image.Rectangle) {
+	for x := r.Min.X; x < r.Max.X; x++ {
+		img.SetGray(x, r.Min.Y, ink)
+		img.SetGray(x, r.Max.Y-1, ink)
+	}
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		img.SetGray(r.Min.X, y, ink)
+		img.SetGray(r.Max.X-1, y, ink)
+	}
+}
@@ -0,0 +1,75 @@
+package imgutils
+
+import (
+	"image"
+	"slices"
+	"testing"
+)
+
+func TestWrapText(t *testing.T) {
+	cases := []struct {
+		text         string
+		width, lines int
+		expected     []string
+	}{
+		{"The Hobbit", 12, 5, []string{"THE HOBBIT"}},
+		{"There and Back Again", 10, 5, []string{"THERE AND", "BACK AGAIN"}},
+		{"  spaced\tout\ntitle ", 20, 5, []string{"SPACED OUT TITLE"}},
+		{"Supercalifragilistic", 8, 5, []string{"SUPERCAL", "IFRAGILI", "STIC"}},
+		{"one two three four", 5, 2, []string{"ONE", "TW..."}},
+		{"Война и мир", 20, 5, []string{"VOYNA I MIR"}},
+		{"Žluťoučký kůň", 20, 5, []string{"ZLUTOUCKY KUN"}},
+		{"Straße — «Odyssey»", 20, 5, []string{`STRASSE - "ODYSSEY"`}},
+		{"Ἰλιάς", 20, 5, []string{"LIAS"}},
+		{"三体", 20, 5, nil},
+		{"", 20, 5, nil},
+		{"anything", 0, 5, nil},
+	}
+	for i, c := range cases {
+		if got := wrapText(c.text, c.width, c.lines); !slices.Equal(got, c.expected) {
+			t.Errorf("Case %d: expected %q, got %q", i, c.expected, got)
+		}
+	}
+}
+
+func TestPlaceholder(t *testing.T) {
+	const w, h = 330, 470
+
+	img := Placeholder("The Hobbit", "J. R. R. Tolkien", "hobbit", w, h)
+	if img == nil {
+		t.Fatal("Placeholder was not drawn")
+	}
+	if b := img.Bounds(); b.Dx() != w || b.Dy() != h {
+		t.Fatalf("Expected %dx%d image, got %v", w, h, b)
+	}
+	gray, ok := img.(*image.Gray)
+	if !ok {
+		t.Fatalf("Expected grayscale image, got %T", img)
+	}
+	// title is drawn in the upper part, author at the bottom, both inside the frame
+	inked := func(r image.Rectangle) (n int) {
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				if gray.GrayAt(x, y) == ink {
+					n++
+				}
+			}
+		}
+		return n
+	}
+	margin := w / 16
+	if inked(image.Rect(margin+5, h/4, w-margin-5, h/2)) == 0 {
+		t.Error("Title is not drawn")
+	}
+	if inked(image.Rect(margin+5, h*3/4, w-margin-5, h-margin-5)) == 0 {
+		t.Error("Author is not drawn")
+	}
+
+	// title which cannot be drawn is replaced with file name
+	if img := Placeholder("三体", "刘慈欣", "three-body", w, h); img == nil {
+		t.Error("Placeholder with file name was not drawn")
+	}
+	if img := Placeholder("三体", "刘慈欣", "三体", w, h); img != nil {
+		t.Error("Placeholder without anything to draw is expected to be skipped")
+	}
+}
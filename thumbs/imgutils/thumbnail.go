@@ -0,0 +1,97 @@
+package imgutils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// einkLevels is number of gray shades e-ink screen could show.
+const einkLevels = 16
+
+// Pipeline describes how cover image is turned into thumbnail for the device screen.
+type Pipeline struct {
+	Width, Height int
+	Color         bool    // keep colors, only makes sense for devices with color screen
+	Gamma         float64 // gamma correction, less than 1 darkens image, 0 or 1 leaves it as is
+	Contrast      float64 // contrast change in percents (-100..100), 0 leaves it as is
+	Sharpen       float64 // sigma of sharpening, 0 disables it
+	Dither        bool    // dither grayscale image to the shades of e-ink screen
+}
+
+// MakeThumbnail scales cover image to fit requested size, processes it for the device screen and encodes it as JPEG
+// Kindle would accept.
+func MakeThumbnail(img image.Image, p *Pipeline) ([]byte, error) {
+	imgthumb := imaging.Thumbnail(img, p.Width, p.Height, imaging.Lanczos)
+	if imgthumb == nil {
+		return nil, errors.New("unable to resize cover")
+	}
+	return Encode(imgthumb, p)
+}
+
+// Encode processes image for the device screen and encodes it as JPEG Kindle would accept, image is not resized.
+func Encode(img image.Image, p *Pipeline) ([]byte, error) {
+	var buf = new(bytes.Buffer)
+	if err := imaging.Encode(buf, process(img, p), imaging.JPEG, imaging.JPEGQuality(75)); err != nil {
+		return nil, fmt.Errorf("unable to encode produced thumbnail: %w", err)
+	}
+	buf, _ = SetJpegDPI(buf, DpiPxPerInch, 300, 300)
+	return buf.Bytes(), nil
+}
+
+// process applies tone corrections and sharpening, unless colors are kept image is converted to grayscale first.
+func process(img image.Image, p *Pipeline) image.Image {
+	if !p.Color {
+		img = imaging.Grayscale(img)
+	}
+	if p.Gamma > 0 && p.Gamma != 1 {
+		img = imaging.AdjustGamma(img, p.Gamma)
+	}
+	if p.Contrast != 0 {
+		img = imaging.AdjustContrast(img, p.Contrast)
+	}
+	if p.Sharpen > 0 {
+		img = imaging.Sharpen(img, p.Sharpen)
+	}
+	if p.Color {
+		return img
+	}
+
+	b := img.Bounds()
+	gray := image.NewGray(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(gray, gray.Bounds(), img, b.Min, draw.Src)
+	if p.Dither {
+		dither(gray, einkLevels)
+	}
+	return gray
+}
+
+// dither reduces grayscale image to "levels" shades using Floyd-Steinberg error diffusion.
+func dither(img *image.Gray, levels int) {
+	b := img.Bounds()
+	step := 255 / float64(levels-1)
+
+	// accumulated errors for current and next rows, padded on both sides
+	cur, next := make([]float64, b.Dx()+2), make([]float64, b.Dx()+2)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := range b.Dx() {
+			i := img.PixOffset(b.Min.X+x, y)
+			v := float64(img.Pix[i]) + cur[x+1]
+			q := min(max(math.Round(v/step)*step, 0), 255)
+			img.Pix[i] = uint8(q)
+
+			e := v - q
+			cur[x+2] += e * 7 / 16
+			next[x] += e * 3 / 16
+			next[x+1] += e * 5 / 16
+			next[x+2] += e * 1 / 16
+		}
+		cur, next = next, cur
+		clear(next)
+	}
+}
@@ -0,0 +1,117 @@
+package imgutils
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// gradient returns image with horizontal gray ramp, red channel is stronger in color variant.
+func gradient(w, h int, colored bool) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := range w {
+			v := uint8(x * 255 / (w - 1))
+			c := color.RGBA{R: v, G: v, B: v, A: 0xff}
+			if colored {
+				c.R, c.B = 0xff, 0
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestProcess(t *testing.T) {
+	cases := []struct {
+		name    string
+		p       Pipeline
+		colored bool
+		gray    bool // result is *image.Gray
+		levels  int  // maximum number of distinct shades, 0 - not checked
+	}{
+		{name: "mono", p: Pipeline{}, gray: true},
+		{name: "mono of color", p: Pipeline{}, colored: true, gray: true},
+		{name: "color", p: Pipeline{Color: true}, colored: true},
+		{name: "dither", p: Pipeline{Dither: true}, gray: true, levels: einkLevels},
+		{name: "tuned dither", p: Pipeline{Gamma: 0.9, Contrast: 10, Sharpen: 0.5, Dither: true}, gray: true, levels: einkLevels},
+	}
+	for _, c := range cases {
+		out := process(gradient(64, 8, c.colored), &c.p)
+		if b := out.Bounds(); b.Dx() != 64 || b.Dy() != 8 {
+			t.Errorf("%s: unexpected size %v", c.name, b)
+			continue
+		}
+		gray, isGray := out.(*image.Gray)
+		if isGray != c.gray {
+			t.Errorf("%s: expected grayscale %t, got %T", c.name, c.gray, out)
+			continue
+		}
+		if !isGray {
+			// colors are kept
+			if r, _, b, _ := out.At(0, 0).RGBA(); r>>8 < 0xf0 || b>>8 > 0x10 {
+				t.Errorf("%s: colors are not kept: r=%d b=%d", c.name, r>>8, b>>8)
+			}
+			continue
+		}
+		if c.levels == 0 {
+			continue
+		}
+		shades := make(map[uint8]bool)
+		for _, v := range gray.Pix {
+			if v%(255/(einkLevels-1)) != 0 {
+				t.Errorf("%s: shade %d is not one of %d levels", c.name, v, einkLevels)
+				break
+			}
+			shades[v] = true
+		}
+		if len(shades) > c.levels {
+			t.Errorf("%s: expected at most %d shades, got %d", c.name, c.levels, len(shades))
+		}
+	}
+}
+
+func TestProcessNeutral(t *testing.T) {
+	src := gradient(64, 8, false)
+	for _, p := range []Pipeline{{}, {Gamma: 1}, {Gamma: 1, Contrast: 0, Sharpen: 0}} {
+		out, ok := process(src, &p).(*image.Gray)
+		if !ok {
+			t.Fatalf("Expected grayscale image for %+v", p)
+		}
+		for x := range 64 {
+			want := uint8(x * 255 / 63)
+			if got := out.GrayAt(x, 0).Y; got != want {
+				t.Fatalf("Pipeline %+v: pixel %d changed from %d to %d", p, x, want, got)
+			}
+		}
+	}
+}
+
+func TestMakeThumbnail(t *testing.T) {
+	cases := []struct {
+		p    Pipeline
+		gray bool
+	}{
+		{p: Pipeline{Width: 33, Height: 47, Gamma: 0.9, Contrast: 10, Sharpen: 0.5}, gray: true},
+		{p: Pipeline{Width: 33, Height: 47, Dither: true}, gray: true},
+		{p: Pipeline{Width: 33, Height: 47, Color: true}, gray: false},
+	}
+	for i, c := range cases {
+		data, err := MakeThumbnail(gradient(66, 94, true), &c.p)
+		if err != nil {
+			t.Fatalf("Case %d: unable to make thumbnail: %v", i, err)
+		}
+		img, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Case %d: thumbnail is not JPEG: %v", i, err)
+		}
+		if b := img.Bounds(); b.Dx() != 33 || b.Dy() != 47 {
+			t.Errorf("Case %d: unexpected thumbnail size %v", i, b)
+		}
+		if _, gray := img.(*image.Gray); gray != c.gray {
+			t.Errorf("Case %d: expected grayscale JPEG %t, got %T", i, c.gray, img)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package imgutils
+
+// Transliterations of capital letters (and some punctuation) the placeholder font does not have, so titles in other
+// European scripts are still readable. Empty replacement leaves character out.
+
+var transliterations = func() map[rune]string {
+	m := map[rune]string{
+		// Latin
+		'Æ': "AE", 'Ð': "D", 'Ø': "O", 'Þ': "TH", 'ß': "SS", 'ẞ': "SS", 'Đ': "D", 'Ħ': "H", 'Ł': "L", 'Ŀ': "L",
+		'Ŋ': "N", 'Œ': "OE", 'Ŧ': "T",
+		// Cyrillic
+		'А': "A", 'Б': "B", 'В': "V", 'Г': "G", 'Д': "D", 'Е': "E", 'Ё': "E", 'Ж': "ZH", 'З': "Z", 'И': "I",
+		'Й': "Y", 'К': "K", 'Л': "L", 'М': "M", 'Н': "N", 'О': "O", 'П': "P", 'Р': "R", 'С': "S", 'Т': "T",
+		'У': "U", 'Ф': "F", 'Х': "KH", 'Ц': "TS", 'Ч': "CH", 'Ш': "SH", 'Щ': "SHCH", 'Ъ': "", 'Ы': "Y", 'Ь': "",
+		'Э': "E", 'Ю': "YU", 'Я': "YA", 'Є': "YE", 'І': "I", 'Ї': "YI", 'Ґ': "G", 'Ў': "U", 'Ђ': "DJ", 'Ј': "J",
+		'Љ': "LJ", 'Њ': "NJ", 'Ћ': "C", 'Џ': "DZ", 'Ѓ': "GJ", 'Ќ': "KJ", 'Ѕ': "DZ",
+		// Greek
+		'Α': "A", 'Β': "V", 'Γ': "G", 'Δ': "D", 'Ε': "E", 'Ζ': "Z", 'Η': "I", 'Θ': "TH", 'Ι': "I", 'Κ': "K",
+		'Λ': "L", 'Μ': "M", 'Ν': "N", 'Ξ': "X", 'Ο': "O", 'Π': "P", 'Ρ': "R", 'Σ': "S", 'Τ': "T", 'Υ': "Y",
+		'Φ': "F", 'Χ': "CH", 'Ψ': "PS", 'Ω': "O", 'Ά': "A", 'Έ': "E", 'Ή': "I", 'Ί': "I", 'Ό': "O", 'Ύ': "Y",
+		'Ώ': "O", 'Ϊ': "I", 'Ϋ': "Y",
+		// punctuation
+		'‘': "'", '’': "'", '‚': ",", '“': `"`, '”': `"`, '„': `"`, '«': `"`, '»': `"`, '–': "-", '—': "-",
+		'…': "...",
+	}
+	// Latin letters with diacritics are replaced with the letter at the same position
+	from, to := []rune("ÀÁÂÃÄÅÇÈÉÊËÌÍÎÏÑÒÓÔÕÖÙÚÛÜÝĀĂĄĆĈĊČĎĒĔĖĘĚĜĞĠĢĤĨĪĬĮİĴĶĹĻĽŃŅŇŌŎŐŔŖŘŚŜŞŠŢŤŨŪŬŮŰŲŴŶŸŹŻŽ"),
+		"AAAAAACEEEEIIIINOOOOOUUUUYAAACCCCDEEEEEGGGGHIIIIIJKLLLNNNOOORRRSSSSTTUUUUUUWYYZZZ"
+	for i, r := range from {
+		m[r] = to[i : i+1]
+	}
+	return m
+}()
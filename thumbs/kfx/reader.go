@@ -13,19 +13,22 @@ import (
 	"os"
 	"path/filepath"
 	"slices"
+	"strings"
 	"time"
 
-	"github.com/disintegration/imaging"
 	"go.uber.org/zap"
 
 	"sync2kindle/thumbs/imgutils"
 )
 
 type Reader struct {
-	width, height int
-	fname         string
+	pipe  *imgutils.Pipeline
+	fname string
+	cover image.Image // user supplied cover, replaces the one in the book
 	//
 	asin, cdetype, assetID, bookID string
+	title                          string
+	authors                        []string
 	thumbnail                      []byte
 }
 
@@ -36,12 +39,12 @@ func (r *Reader) String() string {
 	return fmt.Sprintf("asin: %s, cdetype: %s, asset_id: %s, book_id: %s", r.asin, r.cdetype, r.assetID, r.bookID)
 }
 
-func NewReader(fname string, w, h int, log *zap.Logger) (*Reader, error) {
+func NewReader(fname string, pipe *imgutils.Pipeline, cover image.Image, log *zap.Logger) (*Reader, error) {
 	var r *Reader
 
 	l := log.Named("kfx-reader")
 	l.Debug("KFX parse starting",
-		zap.String("fname", fname), zap.Int("width", w), zap.Int("height", h))
+		zap.String("fname", fname), zap.Int("width", pipe.Width), zap.Int("height", pipe.Height))
 	defer func(start time.Time) {
 		l.Debug("KFX parse finished", zap.Stringer("metadata", r), zap.Duration("elapsed", time.Since(start)))
 	}(time.Now())
@@ -51,7 +54,7 @@ func NewReader(fname string, w, h int, log *zap.Logger) (*Reader, error) {
 		return nil, err
 	}
 
-	r = &Reader{fname: fname, width: w, height: h}
+	r = &Reader{fname: fname, pipe: pipe, cover: cover}
 	return r, r.extractThumbnail(data)
 }
 
@@ -150,6 +153,14 @@ func (r *Reader) extractThumbnail(data []byte) error {
 					r.bookID = prop.Value.(string)
 				case "cover_image":
 					coverResourceName = prop.Value.(string)
+				case "title":
+					if v, ok := prop.Value.(string); ok {
+						r.title = v
+					}
+				case "author":
+					if v, ok := prop.Value.(string); ok {
+						r.authors = append(r.authors, v)
+					}
 				}
 			}
 			return true
@@ -159,10 +170,33 @@ func (r *Reader) extractThumbnail(data []byte) error {
 		return errors.New("no kindle book metadata found")
 	}
 
-	if r.cdetype != "EBOK" || len(r.asin) == 0 || len(coverResourceName) == 0 {
+	if r.cdetype != "EBOK" || len(r.asin) == 0 {
 		// bail out early - we are only interested in non-personal books
 		return nil
 	}
+	if r.cover != nil {
+		thumb, err := imgutils.MakeThumbnail(r.cover, r.pipe)
+		if err != nil {
+			return err
+		}
+		r.thumbnail = thumb
+		return nil
+	}
+	if len(coverResourceName) == 0 {
+		// book has no cover, draw one so it is recognizable in the library
+		name := strings.TrimSuffix(filepath.Base(r.fname), filepath.Ext(r.fname))
+		img := imgutils.Placeholder(r.title, strings.Join(r.authors, ", "), name, r.pipe.Width, r.pipe.Height)
+		if img == nil {
+			// nothing could be drawn
+			return nil
+		}
+		thumb, err := imgutils.MakeThumbnail(img, r.pipe)
+		if err != nil {
+			return err
+		}
+		r.thumbnail = thumb
+		return nil
+	}
 
 	coverEnty, err := entities.getByName(coverResourceName, symExternalResource)
 	if err != nil {
@@ -183,17 +217,11 @@ func (r *Reader) extractThumbnail(data []byte) error {
 	if img, _, err = image.Decode(bytes.NewReader(coverImgEnty.data)); err != nil {
 		return fmt.Errorf("unable to decode extracted cover: %w", err)
 	}
-	imgthumb := imaging.Thumbnail(img, r.width, r.height, imaging.Lanczos)
-	if imgthumb == nil {
-		return errors.New("unable to resize extracted cover")
-	}
-
-	var buf = new(bytes.Buffer)
-	if err := imaging.Encode(buf, imgthumb, imaging.JPEG, imaging.JPEGQuality(75)); err != nil {
-		return fmt.Errorf("unable to encode produced thumbnail: %w", err)
+	thumb, err := imgutils.MakeThumbnail(img, r.pipe)
+	if err != nil {
+		return err
 	}
-	buf, _ = imgutils.SetJpegDPI(buf, imgutils.DpiPxPerInch, 300, 300)
-	r.thumbnail = buf.Bytes()
+	r.thumbnail = thumb
 
 	return nil
 }
@@ -23,6 +23,7 @@ const (
 	mobiVersion       = 36
 	firstNonText      = 80
 	titleOffset       = 84
+	titleLength       = 88
 	firstRescRecord   = 108
 	firstContentIndex = 192
 	lastContentIndex  = 194
@@ -37,6 +38,7 @@ const (
 	huffTableOffset   = 120
 
 	// exth records of interest
+	exthAuthor        = 100
 	exthASIN          = 113
 	exthStartReading  = 116
 	exthKF8Offset     = 121
@@ -44,6 +46,7 @@ const (
 	exthThumbOffset   = 202
 	exthThumbnailURI  = 129
 	exthCDEType       = 501
+	exthUpdatedTitle  = 503
 	exthCDEContentKey = 504
 )
 
@@ -13,7 +13,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/disintegration/imaging"
 	"go.uber.org/zap"
 
 	"sync2kindle/thumbs/imgutils"
@@ -21,10 +20,12 @@ import (
 
 // Reader - mobi thumbnail extractor.
 type Reader struct {
-	width, height int
-	fname         string
+	pipe  *imgutils.Pipeline
+	fname string
+	cover image.Image // user supplied cover, replaces the one in the book
 	//
 	acr, asin, cdetype, cdekey,
+	title, author,
 	thumbnail []byte
 }
 
@@ -35,13 +36,13 @@ func (r *Reader) String() string {
 	return fmt.Sprintf("asin: %s, cdekey: %s, cdetype: %s, acr: %s", string(r.asin), string(r.cdekey), string(r.cdetype), string(r.acr))
 }
 
-// NewReader returns pointer to Reader with parsed mobi file.
-func NewReader(fname string, w, h int, log *zap.Logger) (*Reader, error) {
+// NewReader returns pointer to Reader with parsed mobi file, thumbnail is made of "cover" when it is not nil.
+func NewReader(fname string, pipe *imgutils.Pipeline, cover image.Image, log *zap.Logger) (*Reader, error) {
 	var r *Reader
 
 	l := log.Named("mobi-reader")
 	l.Debug("MOBI parse starting",
-		zap.String("fname", fname), zap.Int("width", w), zap.Int("height", h))
+		zap.String("fname", fname), zap.Int("width", pipe.Width), zap.Int("height", pipe.Height))
 	defer func(start time.Time) {
 		l.Debug("MOBI parse finished", zap.Stringer("metadata", r), zap.Duration("elapsed", time.Since(start)))
 	}(time.Now())
@@ -51,7 +52,7 @@ func NewReader(fname string, w, h int, log *zap.Logger) (*Reader, error) {
 		return nil, err
 	}
 
-	r = &Reader{fname: fname, width: w, height: h}
+	r = &Reader{fname: fname, pipe: pipe, cover: cover}
 	return r, r.extractThumbnail(data)
 }
 
@@ -145,6 +146,14 @@ func (r *Reader) extractThumbnail(data []byte) error {
 		// bail out early - we are only interested in non-personal books
 		return nil
 	}
+	if r.cover != nil {
+		thumb, err := imgutils.MakeThumbnail(r.cover, r.pipe)
+		if err != nil {
+			return err
+		}
+		r.thumbnail = thumb
+		return nil
+	}
 
 	firstimage := getInt32(rec0, firstRescRecord)
 	exthCover := readExth(rec0, exthCoverOffset)
@@ -162,6 +171,19 @@ func (r *Reader) extractThumbnail(data []byte) error {
 	}
 
 	if coverIndex < 0 {
+		// book has no cover, draw one so it is recognizable in the library
+		r.readTitle(rec0, kfrec0)
+		name := strings.TrimSuffix(filepath.Base(r.fname), filepath.Ext(r.fname))
+		img := imgutils.Placeholder(string(r.title), string(r.author), name, r.pipe.Width, r.pipe.Height)
+		if img == nil {
+			// nothing could be drawn
+			return nil
+		}
+		thumb, err := imgutils.MakeThumbnail(img, r.pipe)
+		if err != nil {
+			return err
+		}
+		r.thumbnail = thumb
 		return nil
 	}
 
@@ -177,28 +199,42 @@ func (r *Reader) extractThumbnail(data []byte) error {
 		}
 		w, h = img.Bounds().Dx(), img.Bounds().Dy()
 	}
-	var buf = new(bytes.Buffer)
-	if img != nil && w > r.width && h > r.height {
+	if img != nil && w > r.pipe.Width && h > r.pipe.Height {
 		// thumbnail is big enough, use it as is but always convert to JPEG
-		if err := imaging.Encode(buf, img, imaging.JPEG, imaging.JPEGQuality(75)); err != nil {
+		thumb, err := imgutils.Encode(img, r.pipe)
+		if err != nil {
 			// NOTE: old code ignored this and tried to extract from the cover instead
 			return fmt.Errorf("unable to encode extracted thumbnail: %w", err)
 		}
-	} else {
-		// recreate thumbnail from cover image if possible
-		thumb := readSection(data, coverIndex)
-		if img, _, err = image.Decode(bytes.NewReader(thumb)); err != nil {
-			return fmt.Errorf("unable to decode extracted thumbnail: %w", err)
+		r.thumbnail = thumb
+		return nil
+	}
+
+	// recreate thumbnail from cover image if possible
+	thumb := readSection(data, coverIndex)
+	if img, _, err = image.Decode(bytes.NewReader(thumb)); err != nil {
+		return fmt.Errorf("unable to decode extracted thumbnail: %w", err)
+	}
+	if r.thumbnail, err = imgutils.MakeThumbnail(img, r.pipe); err != nil {
+		return err
+	}
+	return nil
+}
+
+// readTitle reads book title and authors, KF8 metadata is preferred when present.
+func (r *Reader) readTitle(rec0, kfrec0 []byte) {
+	if ofs, n := getInt32(rec0, titleOffset), getInt32(rec0, titleLength); ofs > 0 && n > 0 && ofs+n <= len(rec0) {
+		r.title = rec0[ofs : ofs+n]
+	}
+	for _, rec := range [][]byte{rec0, kfrec0} {
+		if len(rec) == 0 {
+			continue
 		}
-		imgthumb := imaging.Thumbnail(img, r.width, r.height, imaging.Lanczos)
-		if imgthumb == nil {
-			return errors.New("unable to resize extracted cover")
+		if exth := readExth(rec, exthUpdatedTitle); len(exth) > 0 {
+			r.title = exth[0]
 		}
-		if err := imaging.Encode(buf, imgthumb, imaging.JPEG, imaging.JPEGQuality(75)); err != nil {
-			return fmt.Errorf("unable to encode produced thumbnail: %w", err)
+		if exth := readExth(rec, exthAuthor); len(exth) > 0 {
+			r.author = bytes.Join(exth, []byte(", "))
 		}
 	}
-	buf, _ = imgutils.SetJpegDPI(buf, imgutils.DpiPxPerInch, 300, 300)
-	r.thumbnail = buf.Bytes()
-	return nil
 }
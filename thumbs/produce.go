@@ -1,48 +1,79 @@
 package thumbs
 
 import (
+	"errors"
+	"fmt"
+	"image"
+	"io/fs"
 	"path/filepath"
 	"runtime/debug"
 
 	"go.uber.org/zap"
 
 	"sync2kindle/config"
+	"sync2kindle/thumbs/imgutils"
 	"sync2kindle/thumbs/kfx"
 	"sync2kindle/thumbs/mobi"
 )
 
-func ExtractThumbnail(fname string, params *config.ThumbnailsConfig, log *zap.Logger) (name string) {
+// ExtractThumbnail saves thumbnail of the book "fname" to "params.Dir" returning its name, user supplied cover found
+// next to the book is preferred to the one embedded in the book. Empty name without error means book has no thumbnail
+// (it is not a non-personal book, its format is not supported or it cannot be parsed), error means book or thumbnail
+// could not be read or written this time.
+func ExtractThumbnail(fname string, params *config.ThumbnailsConfig, log *zap.Logger) (name string, err error) {
 
 	defer func() {
 		// there may exist files we cannot parse
 		if rec := recover(); rec != nil {
 			log.Debug("Thumbnail processing ended with panic", zap.String("file", fname), zap.Any("record", rec), zap.ByteString("stack", debug.Stack()))
+			log.Warn("Unable to parse book, no thumbnail", zap.String("file", fname), zap.Any("panic", rec))
+			name, err = "", nil
 		}
 	}()
 
-	switch filepath.Ext(fname) {
-	case ".mobi", ".azw3":
-		r, err := mobi.NewReader(fname, params.Width, params.Height, log)
-		if err != nil {
-			log.Warn("Thumbnail extraction failed", zap.String("file", fname), zap.Error(err))
+	var cover image.Image
+	if p := CoverOverride(fname); len(p) > 0 {
+		if img, err := loadCover(p); err != nil {
+			log.Warn("Unable to load cover override, using cover from the book", zap.String("file", fname), zap.String("cover", p), zap.Error(err))
 		} else {
-			name, err = r.SaveResult(params.Dir)
-			if err != nil {
-				log.Warn("Thumbnail saving failed", zap.String("file", fname), zap.Error(err))
-			}
+			log.Debug("Using cover override", zap.String("file", fname), zap.String("cover", p))
+			cover = img
 		}
+	}
+
+	pipe := &imgutils.Pipeline{
+		Width:    params.Width,
+		Height:   params.Height,
+		Color:    params.Color,
+		Gamma:    params.Gamma,
+		Contrast: params.Contrast,
+		Sharpen:  params.Sharpen,
+		Dither:   params.Dither,
+	}
+
+	var r interface {
+		SaveResult(dir string) (string, error)
+	}
+	switch filepath.Ext(fname) {
+	case ".mobi", ".azw3":
+		r, err = mobi.NewReader(fname, pipe, cover, log)
 	case ".kfx":
-		r, err := kfx.NewReader(fname, params.Width, params.Height, log)
-		if err != nil {
-			log.Warn("Thumbnail extraction failed", zap.String("file", fname), zap.Error(err))
-		} else {
-			name, err = r.SaveResult(params.Dir)
-			if err != nil {
-				log.Warn("Thumbnail saving failed", zap.String("file", fname), zap.Error(err))
-			}
-		}
+		r, err = kfx.NewReader(fname, pipe, cover, log)
 	default:
 		// ignore - not supported
+		return "", nil
+	}
+	if err != nil {
+		var perr *fs.PathError
+		if errors.As(err, &perr) {
+			return "", fmt.Errorf("thumbnail extraction failed: %w", err)
+		}
+		// encrypted, unsupported or broken book, parsing it again will not help
+		log.Warn("Unable to parse book, no thumbnail", zap.String("file", fname), zap.Error(err))
+		return "", nil
+	}
+	if name, err = r.SaveResult(params.Dir); err != nil {
+		return "", fmt.Errorf("thumbnail saving failed: %w", err)
 	}
-	return
+	return name, nil
 }
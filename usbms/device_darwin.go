@@ -1,6 +1,7 @@
 package usbms
 
 import (
+	"context"
 	"errors"
 
 	"go.uber.org/zap"
@@ -15,12 +16,17 @@ func Connect(paths, serial string, eject bool, _ *zap.Logger) (*Device, error) {
 }
 
 // Stub implementations to satisfy the driver interface.
-func (d *Device) Disconnect()                      {}
-func (d *Device) Name() string                     { return driverName }
-func (d *Device) UniqueID() string                 { return "" }
-func (d *Device) MkDir(*objects.ObjectInfo) error  { return errors.New("not supported") }
-func (d *Device) Remove(*objects.ObjectInfo) error { return errors.New("not supported") }
-func (d *Device) Copy(*objects.ObjectInfo) error   { return errors.New("not supported") }
-func (d *Device) GetObjectInfos() (objects.ObjectInfoSet, error) {
+func (d *Device) Disconnect()      {}
+func (d *Device) Name() string     { return driverName }
+func (d *Device) UniqueID() string { return "" }
+func (d *Device) MkDir(context.Context, *objects.ObjectInfo) error {
+	return errors.New("not supported")
+}
+func (d *Device) Remove(context.Context, *objects.ObjectInfo) error {
+	return errors.New("not supported")
+}
+func (d *Device) Copy(context.Context, *objects.ObjectInfo) error { return errors.New("not supported") }
+func (d *Device) Move(context.Context, *objects.ObjectInfo) error { return errors.New("not supported") }
+func (d *Device) GetObjectInfos(context.Context) (objects.ObjectInfoSet, error) {
 	return nil, errors.New("not supported")
 }